@@ -0,0 +1,209 @@
+package din
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// session key under which the id of a logged in user is kept.
+const userSessionKey = "_din_user"
+
+// AuthOptions configures authentication.  These are read from the auth
+// section of the config file.
+type AuthOptions struct {
+	// where browsers are sent when they request a page that requires a
+	// login.  The page they asked for is passed along in the next query
+	// parameter.  If this isn't set, they get a 401 like everybody else.
+	LoginURL string `json:"login_url"`
+
+	// the realm named in the challenges sent by the BasicAuth and
+	// BearerTokens handlers.  Defaults to "din".
+	Realm string `json:"realm"`
+
+	// path of the htpasswd file checked by the BasicAuth handler.
+	Htpasswd string `json:"htpasswd"`
+
+	// tokens accepted by the BearerTokens handler, mapped to the names of
+	// the users they identify.
+	BearerTokens map[string]string `json:"bearer_tokens"`
+}
+
+// ErrUnauthorized is the error given to requests that need an authenticated
+// user, but don't have one.
+var ErrUnauthorized = Error{
+	StatusCode: http.StatusUnauthorized,
+	Message:    "authentication required",
+}
+
+// ErrPermissionDenied is the error given to an authenticated user that lacks
+// a permission required by RequirePermission.
+var ErrPermissionDenied = Error{
+	StatusCode: http.StatusForbidden,
+	Message:    "permission denied",
+}
+
+// A User is whoever is making a request, as identified by an Authenticator.
+type User interface {
+	// a stable, unique identifier for the user.  This is what's stored in
+	// the session by Request.Login.
+	UserId() string
+
+	// tells us whether the user may do whatever the permission names.  What
+	// the permissions are is up to the application.
+	HasPermission(perm string) bool
+}
+
+// An Authenticator identifies the user making a request, by whatever means
+// it knows of: a session, a header, a client certificate, and so on.  A
+// request that doesn't carry the kind of credentials the Authenticator looks
+// for gives a nil User and a nil error, so that the next Authenticator can
+// have a look.  Credentials that are present but wrong give an error, which
+// is rendered in place of the response.
+type Authenticator interface {
+	Authenticate(*Request) (User, error)
+}
+
+// AuthenticatorFunc adapts an ordinary function to the Authenticator
+// interface.
+type AuthenticatorFunc func(*Request) (User, error)
+
+func (f AuthenticatorFunc) Authenticate(r *Request) (User, error) {
+	return f(r)
+}
+
+var authenticators []Authenticator
+
+// RegisterAuthenticator adds an Authenticator to those consulted by the
+// authentication stages.  Authenticators are tried in the order in which
+// they're registered, until one of them identifies the user.
+func RegisterAuthenticator(a Authenticator) {
+	authenticators = append(authenticators, a)
+}
+
+// SessionAuth is an Authenticator for users that have logged in with
+// Request.Login.  It's a function that looks up a user by the id stored in
+// their session; a lookup that gives a nil User (e.g., because the user has
+// since been deleted) leaves the request unauthenticated.
+type SessionAuth func(id string) (User, error)
+
+func (f SessionAuth) Authenticate(r *Request) (User, error) {
+	var id string
+	if err := r.SessionGet(userSessionKey, &id); err != nil {
+		return nil, nil
+	}
+	return f(id)
+}
+
+// User gives the user making the request, or nil if the request hasn't been
+// authenticated, either because no authentication stage has run yet, or
+// because no Authenticator recognized the user.
+func (r *Request) User() User {
+	return r.user
+}
+
+// authenticate runs the registered Authenticators, at most once per request.
+func (r *Request) authenticate() error {
+	if r.authenticated {
+		return nil
+	}
+	r.authenticated = true
+	for _, a := range authenticators {
+		u, err := a.Authenticate(r)
+		if err != nil {
+			return err
+		}
+		if u != nil {
+			r.user = u
+			return nil
+		}
+	}
+	return nil
+}
+
+// Login records in the client's session that they are logged in as u, so
+// that SessionAuth will recognize them on subsequent requests.  The session
+// is moved to a new id, so that a session id that was known to anybody
+// before the login is of no use to them afterwards.
+func (r *Request) Login(u User) error {
+	if u == nil {
+		return errors.New("din: can't log in a nil user")
+	}
+	if err := r.SessionRegenerate(); err != nil {
+		return err
+	}
+	r.SessionSet(userSessionKey, u.UserId())
+	r.user = u
+	r.authenticated = true
+	return nil
+}
+
+// Logout discards the client's session, logging them out.
+func (r *Request) Logout() {
+	r.SessionClear()
+	r.user = nil
+	r.authenticated = true
+}
+
+// Authenticate is a Stage that identifies the user making the request with
+// the registered Authenticators, making them available from Request.User.
+// Anonymous requests are let through; to turn them away, use LoginRequired.
+func Authenticate(req *Request) (Response, error) {
+	return nil, req.authenticate()
+}
+
+// LoginRequired is a Stage that turns away requests that aren't from an
+// authenticated user.  Browsers are redirected to the login_url in the auth
+// config, if there is one; everybody else gets ErrUnauthorized.
+func LoginRequired(req *Request) (Response, error) {
+	if err := req.authenticate(); err != nil {
+		return nil, err
+	}
+	if req.user != nil {
+		return nil, nil
+	}
+	if login := Config.Auth.LoginURL; login != "" && req.Accepts("text/html", "application/json") == "text/html" {
+		u, err := url.Parse(login)
+		if err != nil {
+			return nil, fmt.Errorf("din: invalid login_url %q: %v", login, err)
+		}
+		q := u.Query()
+		q.Set("next", req.URL.RequestURI())
+		u.RawQuery = q.Encode()
+		return Redirect(req, u.String(), http.StatusSeeOther), nil
+	}
+	return nil, ErrUnauthorized
+}
+
+// RequirePermission creates a Stage that only lets through authenticated
+// users that have all of the given permissions.  Other authenticated users
+// get ErrPermissionDenied, and anonymous requests are treated as by
+// LoginRequired.  In routes.json, it's written as, e.g.,
+// "RequirePermission(admin)".
+func RequirePermission(perms ...string) Stage {
+	return func(req *Request) (Response, error) {
+		if res, err := LoginRequired(req); res != nil || err != nil {
+			return res, err
+		}
+		for _, perm := range perms {
+			if !req.user.HasPermission(perm) {
+				e := ErrPermissionDenied
+				e.Message = "permission denied: " + perm
+				return nil, e
+			}
+		}
+		return nil, nil
+	}
+}
+
+func init() {
+	RegisterHandler("Authenticate", Authenticate)
+	RegisterHandler("LoginRequired", LoginRequired)
+	RegisterHandlerFactory("RequirePermission", func(args ...string) (Stage, error) {
+		if len(args) == 0 {
+			return nil, errors.New("RequirePermission needs at least one permission")
+		}
+		return RequirePermission(args...), nil
+	})
+}
@@ -0,0 +1,197 @@
+package din
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/jordanorelli/din/dinutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+type testUser struct {
+	name     string
+	password string
+	perms    []string
+}
+
+func (u *testUser) UserId() string { return u.name }
+
+func (u *testUser) HasPermission(perm string) bool {
+	for _, p := range u.perms {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+func authRouter(t *testing.T) (*Router, func()) {
+	defer func(n int) { dinutil.PasswordIterations = n }(dinutil.PasswordIterations)
+	dinutil.PasswordIterations = 1000
+	users := make(map[string]*testUser)
+	for _, u := range []*testUser{{"bob", "hunter2", nil}, {"alice", "s3cret", []string{"admin", "billing"}}} {
+		hash, err := dinutil.HashPassword(u.password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		users[u.name] = &testUser{u.name, hash, u.perms}
+	}
+
+	saved := authenticators
+	authenticators = nil
+	RegisterAuthenticator(SessionAuth(func(id string) (User, error) {
+		if u, ok := users[id]; ok {
+			return u, nil
+		}
+		return nil, nil
+	}))
+
+	RegisterHandler("testLogin", func(req *Request) (Response, error) {
+		u, ok := users[req.FormValue("user")]
+		if !ok {
+			return nil, ErrUnauthorized
+		}
+		if ok, err := dinutil.CheckPassword(u.password, req.FormValue("password")); err != nil || !ok {
+			return nil, ErrUnauthorized
+		}
+		if err := req.Login(u); err != nil {
+			return nil, err
+		}
+		return EmptyResponse(http.StatusNoContent), nil
+	})
+	RegisterHandler("testLogout", func(req *Request) (Response, error) {
+		req.Logout()
+		return EmptyResponse(http.StatusNoContent), nil
+	})
+	RegisterHandler("testWhoami", func(req *Request) (Response, error) {
+		if req.User() == nil {
+			return PlaintextResponseString("nobody", http.StatusOK), nil
+		}
+		return PlaintextResponseString(req.User().UserId(), http.StatusOK), nil
+	})
+
+	var routes []*Pipeline
+	err := json.Unmarshal([]byte(`[
+		{"route": "^/login$", "name": "login", "handlers": ["testLogin"]},
+		{"route": "^/logout$", "name": "logout", "handlers": ["testLogout"]},
+		{"route": "^/whoami$", "name": "whoami", "handlers": ["Authenticate", "testWhoami"]},
+		{"route": "^/account$", "name": "account", "handlers": ["LoginRequired", "testWhoami"]},
+		{"route": "^/admin$", "name": "admin", "handlers": ["RequirePermission(admin, billing)", "testWhoami"]}
+	]`), &routes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouter(nil, nil)
+	router.routes = routes
+	return router, func() { authenticators = saved }
+}
+
+func TestAuth(t *testing.T) {
+	router, restore := authRouter(t)
+	defer restore()
+
+	login := func(user, password string) (int, *http.Cookie) {
+		form := url.Values{"user": {user}, "password": {password}}
+		req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code, sessionCookie(w)
+	}
+	get := func(path string, cookie *http.Cookie) (int, string) {
+		w := sessionGet(router, path, cookie)
+		return w.Code, w.Body.String()
+	}
+
+	if code, _ := login("bob", "wrong"); code != http.StatusUnauthorized {
+		t.Errorf("expected bad password to be refused, got %d", code)
+	}
+	code, bob := login("bob", "hunter2")
+	if code != http.StatusNoContent || bob == nil {
+		t.Fatalf("expected bob to log in, got %d", code)
+	}
+	_, alice := login("alice", "s3cret")
+
+	tests := []struct {
+		path   string
+		cookie *http.Cookie
+		status int
+		body   string
+	}{
+		{"/whoami", nil, http.StatusOK, "nobody"},
+		{"/whoami", bob, http.StatusOK, "bob"},
+		{"/account", nil, http.StatusUnauthorized, ""},
+		{"/account", bob, http.StatusOK, "bob"},
+		{"/admin", nil, http.StatusUnauthorized, ""},
+		{"/admin", bob, http.StatusForbidden, ""},
+		{"/admin", alice, http.StatusOK, "alice"},
+	}
+	for _, test := range tests {
+		code, body := get(test.path, test.cookie)
+		if code != test.status || (test.body != "" && body != test.body) {
+			t.Errorf("%s as %v: expected %d %q, got %d %q", test.path, test.cookie != nil, test.status, test.body, code, body)
+		}
+	}
+
+	get("/logout", bob)
+	if _, body := get("/whoami", bob); body != "nobody" {
+		t.Errorf("still logged in after logout: %q", body)
+	}
+}
+
+func TestLoginRedirect(t *testing.T) {
+	defer func(opts AuthOptions) { Config.Auth = opts }(Config.Auth)
+	Config.Auth.LoginURL = "/login"
+	router, restore := authRouter(t)
+	defer restore()
+
+	req := httptest.NewRequest("GET", "/account?tab=2", nil)
+	req.Header.Set("Accept", "text/html")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/login?next=%2Faccount%3Ftab%3D2" {
+		t.Errorf("expected browser to be sent to the login page, got %d %q", w.Code, w.Header().Get("Location"))
+	}
+
+	// a login_url with a query of its own keeps it.
+	Config.Auth.LoginURL = "/login?via=account"
+	req = httptest.NewRequest("GET", "/account", nil)
+	req.Header.Set("Accept", "text/html")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/login?next=%2Faccount&via=account" {
+		t.Errorf("expected next to be added to the login page's query, got %d %q", w.Code, w.Header().Get("Location"))
+	}
+
+	req = httptest.NewRequest("GET", "/account", nil)
+	req.Header.Set("Accept", "application/json")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected api client to get a 401, got %d", w.Code)
+	}
+}
+
+func TestHandlerFactory(t *testing.T) {
+	var stage Stage
+	if err := json.Unmarshal([]byte(`"RequirePermission()"`), &stage); err == nil {
+		t.Errorf("expected RequirePermission without arguments to be refused")
+	}
+	if err := json.Unmarshal([]byte(`"NoSuchFactory(x)"`), &stage); err == nil {
+		t.Errorf("expected an unknown factory to be refused")
+	}
+	if err := json.Unmarshal([]byte(`"RequirePermission(a, b)"`), &stage); err != nil || stage == nil {
+		t.Errorf("expected RequirePermission(a, b) to build a stage: %v", err)
+	}
+
+	failing := errors.New("boom")
+	RegisterAuthenticator(AuthenticatorFunc(func(*Request) (User, error) { return nil, failing }))
+	defer func() { authenticators = authenticators[:len(authenticators)-1] }()
+	req := &Request{Request: httptest.NewRequest("GET", "/", nil)}
+	if _, err := Authenticate(req); err != failing {
+		t.Errorf("expected authenticator error to be returned, got %v", err)
+	}
+}
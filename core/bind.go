@@ -0,0 +1,371 @@
+package din
+
+import (
+	"encoding"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the struct tags that Bind understands, and where each of them reads from.
+var bindSources = []string{"path", "query", "form", "header"}
+
+var (
+	timeType            = reflect.TypeOf(time.Time{})
+	durationType        = reflect.TypeOf(time.Duration(0))
+	unmarshalerType     = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// Bind fills the struct pointed to by dst with values from the request.  If
+// the request has a json body, it is decoded into dst first, as if by
+// UnmarshalJSON.  After that, each field tagged with one of the following is
+// filled from the corresponding part of the request, overriding anything
+// found in the body:
+//
+//   path:"id"          the keyword argument "id" captured by the route
+//   query:"page"       the querystring parameter "page"
+//   form:"email"       the form field "email" of a urlencoded or multipart body
+//   header:"X-Token"   the request header "X-Token"
+//
+// Fields may be strings, bools, any of the numeric kinds, time.Time (as an
+// RFC 3339 string or a unix timestamp), time.Duration, or any type
+// implementing din.Unmarshaler or encoding.TextUnmarshaler.  Pointers to any
+// of these are allocated as needed, and slices are filled from parameters
+// that appear more than once.  Untagged struct fields are bound recursively.
+// Parameters that are absent from the request leave their fields untouched.
+//
+// Every field is attempted even after one fails; if any did, the returned
+// error is a 400 ValidationError listing all of them.  Once everything has
+// been bound, dst is checked against its validate tags as if by Validate,
+// which reports failures as a 422.  Fields whose parameters were absent from
+// the request are only checked by required.
+func (r *Request) Bind(dst interface{}) error {
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return &InvalidUnmarshalError{reflect.TypeOf(dst)}
+	}
+
+	var invalid []InvalidParam
+	contentType := r.Header.Get("Content-Type")
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case r.Body == nil:
+	case isJSONContentType(contentType):
+		if err := r.UnmarshalJSON(dst); err != nil {
+			e, ok := err.(Error)
+			if !ok || e.Problem == nil || len(e.Problem.InvalidParams) == 0 {
+				return err
+			}
+			invalid = append(invalid, e.Problem.InvalidParams...)
+		}
+	case mediaType == "multipart/form-data":
+		if err := r.parseMultipart(); err != nil {
+			return err
+		}
+	case mediaType == "application/x-www-form-urlencoded":
+		if err := r.ParseForm(); err != nil {
+			return bodyError(err, "invalid form")
+		}
+	}
+
+	r.bindStruct(rv.Elem(), &invalid, make(map[reflect.Type]bool))
+	if len(invalid) > 0 {
+		return ValidationError(invalid...)
+	}
+	return validate(dst, r)
+}
+
+// bindValues looks up the values for a parameter in the named part of the
+// request.
+func (r *Request) bindValues(source, name string) []string {
+	switch source {
+	case "path":
+		if r.RouteMatch != nil {
+			if v, ok := r.Kwargs[name]; ok {
+				return []string{v}
+			}
+		}
+	case "query":
+		return r.URL.Query()[name]
+	case "form":
+		return r.PostForm[name]
+	case "header":
+		return r.Header[http.CanonicalHeaderKey(name)]
+	}
+	return nil
+}
+
+// bindTag gives the part of the request that a field is bound from, and the
+// name of the parameter there.  Untagged fields give an empty source.
+func bindTag(field reflect.StructField) (source, name string) {
+	for _, s := range bindSources {
+		if tag := field.Tag.Get(s); tag != "" {
+			return s, tag
+		}
+	}
+	return "", ""
+}
+
+// bindStruct binds each field of the struct v, appending a description of
+// every failure to invalid.  It reports whether any field was set.  binding
+// holds the struct types that are being bound further up, so that a type
+// that refers to itself (e.g., a Parent *Node field in a Node) isn't
+// descended into forever.
+func (r *Request) bindStruct(v reflect.Value, invalid *[]InvalidParam, binding map[reflect.Type]bool) bool {
+	set := false
+	t := v.Type()
+	binding[t] = true
+	defer delete(binding, t)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" && !field.Anonymous {
+			continue // unexported
+		}
+		fv := v.Field(i)
+
+		source, name := bindTag(field)
+		if name == "-" {
+			continue
+		}
+
+		if source == "" {
+			if bindsRecursively(field.Type) && fv.CanSet() && !binding[structType(field.Type)] && hasBindTags(field.Type) {
+				if r.bindNested(fv, invalid, binding) {
+					set = true
+				}
+			}
+			continue
+		}
+		if !fv.CanSet() {
+			continue
+		}
+
+		values := r.bindValues(source, name)
+		if len(values) == 0 {
+			continue
+		}
+		if reason := setField(fv, values); reason != "" {
+			*invalid = append(*invalid, InvalidParam{Name: name, Reason: reason})
+			continue
+		}
+		set = true
+	}
+	return set
+}
+
+// bindNested binds an untagged struct field, or a pointer to one.  A nil
+// pointer is only filled in if the request had something to put in it.
+func (r *Request) bindNested(fv reflect.Value, invalid *[]InvalidParam, binding map[reflect.Type]bool) bool {
+	if fv.Kind() != reflect.Ptr {
+		return r.bindStruct(fv, invalid, binding)
+	}
+	if !fv.IsNil() {
+		return r.bindStruct(fv.Elem(), invalid, binding)
+	}
+	nv := reflect.New(fv.Type().Elem())
+	if r.bindStruct(nv.Elem(), invalid, binding) {
+		fv.Set(nv)
+		return true
+	}
+	return false
+}
+
+// bindsRecursively tells us whether an untagged field of type t should be
+// descended into by Bind.
+func bindsRecursively(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct && !parsesItself(t)
+}
+
+// structType gives the struct type of a field that Bind descends into,
+// following a pointer if there is one.
+func structType(t reflect.Type) reflect.Type {
+	if t.Kind() == reflect.Ptr {
+		return t.Elem()
+	}
+	return t
+}
+
+// whether each struct type that Bind has descended into has any fields that
+// it would set.  Types don't change at runtime, so nothing is ever evicted.
+var bindableTypes sync.Map
+
+// hasBindTags tells us whether a struct type (or a pointer to one) has any
+// binding tags, either on its own fields or on those of the untagged structs
+// within it.  Structs that have none are left alone by Bind, rather than
+// being allocated just to find that out.
+func hasBindTags(t reflect.Type) bool {
+	t = structType(t)
+	if b, ok := bindableTypes.Load(t); ok {
+		return b.(bool)
+	}
+	b := findBindTags(t, make(map[reflect.Type]bool))
+	bindableTypes.Store(t, b)
+	return b
+}
+
+func findBindTags(t reflect.Type, seen map[reflect.Type]bool) bool {
+	if seen[t] {
+		return false
+	}
+	seen[t] = true
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" && !field.Anonymous {
+			continue
+		}
+		if source, name := bindTag(field); source != "" {
+			if name != "-" {
+				return true
+			}
+			continue
+		}
+		if bindsRecursively(field.Type) && findBindTags(structType(field.Type), seen) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsesItself tells us whether values of type t know how to read themselves
+// from a string.
+func parsesItself(t reflect.Type) bool {
+	if t == timeType {
+		return true
+	}
+	pt := reflect.PtrTo(t)
+	return pt.Implements(unmarshalerType) || pt.Implements(textUnmarshalerType)
+}
+
+// setField parses values into the field v.  Only slices make use of more than
+// the first value.  If the values can't be parsed, the return value is the
+// reason why, in a form suitable for showing to the user.
+func setField(v reflect.Value, values []string) string {
+	t := v.Type()
+	if t.Kind() == reflect.Slice && t.Elem().Kind() != reflect.Uint8 && !parsesItself(t) {
+		slice := reflect.MakeSlice(t, len(values), len(values))
+		for i, s := range values {
+			if reason := setValue(slice.Index(i), s); reason != "" {
+				return reason
+			}
+		}
+		v.Set(slice)
+		return ""
+	}
+	return setValue(v, values[0])
+}
+
+// setValue parses a single string into v.
+func setValue(v reflect.Value, s string) string {
+	if v.Kind() == reflect.Ptr {
+		nv := reflect.New(v.Type().Elem())
+		if reason := setValue(nv.Elem(), s); reason != "" {
+			return reason
+		}
+		v.Set(nv)
+		return ""
+	}
+
+	if v.CanAddr() {
+		switch u := v.Addr().Interface().(type) {
+		case Unmarshaler:
+			if err := u.Unmarshal(s); err != nil {
+				return "invalid value"
+			}
+			return ""
+		case *time.Time:
+			return setTime(u, s)
+		case encoding.TextUnmarshaler:
+			if err := u.UnmarshalText([]byte(s)); err != nil {
+				return "invalid value"
+			}
+			return ""
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, ok := parseBool(s)
+		if !ok {
+			return "must be a boolean"
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.Type() == durationType {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return "must be a duration"
+			}
+			v.SetInt(int64(d))
+			return ""
+		}
+		i, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return numError(err, "must be an integer")
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		i, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return numError(err, "must be a non-negative integer")
+		}
+		v.SetUint(i)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return numError(err, "must be a number")
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.Uint8 {
+			return "unsupported field type " + v.Type().String()
+		}
+		v.SetBytes([]byte(s))
+	default:
+		return "unsupported field type " + v.Type().String()
+	}
+	return ""
+}
+
+// numError picks the reason to give for a failed strconv parse.
+func numError(err error, reason string) string {
+	if e, ok := err.(*strconv.NumError); ok && e.Err == strconv.ErrRange {
+		return "out of range"
+	}
+	return reason
+}
+
+// setTime parses a time from either an RFC 3339 string or a unix timestamp.
+func setTime(t *time.Time, s string) string {
+	if parsed, err := time.Parse(time.RFC3339, s); err == nil {
+		*t = parsed
+		return ""
+	}
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		*t = time.Unix(secs, 0)
+		return ""
+	}
+	return "must be an RFC 3339 time or a unix timestamp"
+}
+
+// parseBool is a more forgiving strconv.ParseBool, since bools in forms and
+// querystrings come from checkboxes and humans.  A parameter that is present
+// without a value (e.g., "?verbose") counts as true.
+func parseBool(s string) (bool, bool) {
+	switch strings.ToLower(s) {
+	case "", "true", "t", "yes", "y", "on", "1":
+		return true, true
+	case "false", "f", "no", "n", "nay", "non", "off", "0":
+		return false, true
+	}
+	return false, false
+}
@@ -0,0 +1,296 @@
+package din
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type bindPage struct {
+	Number int   `query:"page"`
+	Size   *uint `query:"per_page"`
+}
+
+type bindTarget struct {
+	ID      int64         `path:"id"`
+	Token   string        `header:"X-Token"`
+	Tags    []string      `query:"tag"`
+	Ratio   float32       `query:"ratio"`
+	Verbose bool          `query:"verbose"`
+	Since   time.Time     `query:"since"`
+	Timeout time.Duration `query:"timeout"`
+	Email   string        `form:"email"`
+	Name    string        `json:"name"`
+	Ignored string        `query:"-"`
+	Page    bindPage
+	Extra   *bindPage
+}
+
+func bindRequest(method, target, contentType, body string) *Request {
+	raw, _ := http.NewRequest(method, target, strings.NewReader(body))
+	if contentType != "" {
+		raw.Header.Set("Content-Type", contentType)
+	}
+	raw.Header.Set("X-Token", "sekrit")
+	return &Request{
+		Request:    raw,
+		RouteMatch: &RouteMatch{Kwargs: map[string]string{"id": "42"}},
+	}
+}
+
+func TestBind(t *testing.T) {
+	q := url.Values{
+		"tag":      {"a", "b"},
+		"ratio":    {"0.5"},
+		"verbose":  {""},
+		"since":    {"1364774400"},
+		"timeout":  {"1m30s"},
+		"page":     {"3"},
+		"per_page": {"25"},
+		"Ignored":  {"nope"},
+	}
+	req := bindRequest("POST", "/widgets/42?"+q.Encode(), "application/x-www-form-urlencoded", "email=jordan%40example.com")
+
+	var dest bindTarget
+	if err := req.Bind(&dest); err != nil {
+		t.Fatalf("unexpected bind error: %v", err)
+	}
+	if dest.ID != 42 || dest.Token != "sekrit" || dest.Email != "jordan@example.com" {
+		t.Errorf("bad path, header or form values: %+v", dest)
+	}
+	if len(dest.Tags) != 2 || dest.Tags[1] != "b" {
+		t.Errorf("bad slice value: %v", dest.Tags)
+	}
+	if dest.Ratio != 0.5 || !dest.Verbose || dest.Timeout != 90*time.Second {
+		t.Errorf("bad float, bool or duration values: %+v", dest)
+	}
+	if !dest.Since.Equal(time.Unix(1364774400, 0)) {
+		t.Errorf("bad time value: %v", dest.Since)
+	}
+	if dest.Ignored != "" {
+		t.Errorf("bound a field tagged with -: %q", dest.Ignored)
+	}
+	if dest.Page.Number != 3 || dest.Page.Size == nil || *dest.Page.Size != 25 {
+		t.Errorf("bad nested struct: %+v", dest.Page)
+	}
+	if dest.Extra == nil || dest.Extra.Number != 3 {
+		t.Errorf("bad nested struct pointer: %+v", dest.Extra)
+	}
+}
+
+func TestBindJSON(t *testing.T) {
+	req := bindRequest("POST", "/widgets/42?page=2", "application/json; charset=utf-8", `{"name": "sprocket", "ID": 7}`)
+	var dest bindTarget
+	if err := req.Bind(&dest); err != nil {
+		t.Fatalf("unexpected bind error: %v", err)
+	}
+	if dest.Name != "sprocket" || dest.Page.Number != 2 {
+		t.Errorf("bad json body binding: %+v", dest)
+	}
+	if dest.ID != 42 {
+		t.Errorf("expected path kwarg to override json body, got %d", dest.ID)
+	}
+}
+
+// every field that fails should be reported, not just the first.
+func TestBindErrors(t *testing.T) {
+	req := bindRequest("GET", "/?page=two&per_page=-1&ratio=lots&since=yesterday", "", "")
+	var dest bindTarget
+	err := req.Bind(&dest)
+	e, ok := err.(Error)
+	if !ok || e.Problem == nil {
+		t.Fatalf("expected a validation error, got %v", err)
+	}
+	names := make(map[string]bool)
+	for _, p := range e.Problem.InvalidParams {
+		names[p.Name] = true
+	}
+	for _, name := range []string{"page", "per_page", "ratio", "since"} {
+		if !names[name] {
+			t.Errorf("expected %s in invalid params, got %v", name, e.Problem.InvalidParams)
+		}
+	}
+
+	if err := req.Bind(dest); err == nil {
+		t.Errorf("expected an error binding to a non-pointer")
+	}
+}
+
+type signup struct {
+	Email    string   `form:"email" validate:"required,email"`
+	Username string   `form:"username" validate:"required,min=3,max=12,regexp=^[a-z][a-z0-9_]*$"`
+	Plan     string   `form:"plan" validate:"oneof=free pro"`
+	Age      int      `form:"age" validate:"min=13"`
+	Code     string   `form:"code" validate:"len=6"`
+	Refs     []string `form:"ref" validate:"max=2"`
+	Nick     string   `form:"nick" validate:"even"`
+}
+
+func TestBindValidation(t *testing.T) {
+	RegisterValidator("even", func(v interface{}, param string) error {
+		if len(v.(string))%2 != 0 {
+			return errors.New("must have an even number of characters")
+		}
+		return nil
+	})
+
+	form := url.Values{
+		"email":    {"jordan@example.com"},
+		"username": {"jordan_o"},
+		"plan":     {"pro"},
+		"age":      {"30"},
+		"ref":      {"a", "b"},
+		"nick":     {"jo"},
+	}
+	var ok signup
+	if err := bindRequest("POST", "/", "application/x-www-form-urlencoded", form.Encode()).Bind(&ok); err != nil {
+		t.Errorf("unexpected validation error: %v", err)
+	}
+
+	form = url.Values{
+		"email":    {"Jordan <jordan@example.com>"},
+		"username": {"J"},
+		"plan":     {"enterprise"},
+		"age":      {"9"},
+		"code":     {"12345"},
+		"ref":      {"a", "b", "c"},
+		"nick":     {"joe"},
+	}
+	var bad signup
+	err := bindRequest("POST", "/", "application/x-www-form-urlencoded", form.Encode()).Bind(&bad)
+	e, isError := err.(Error)
+	if !isError || e.Problem == nil {
+		t.Fatalf("expected a validation error, got %v", err)
+	}
+	if e.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("expected status 422, got %d", e.StatusCode)
+	}
+	if len(e.Problem.InvalidParams) != len(form) {
+		t.Errorf("expected %d invalid params, got %v", len(form), e.Problem.InvalidParams)
+	}
+
+	var missing signup
+	err = bindRequest("POST", "/", "application/x-www-form-urlencoded", "").Bind(&missing)
+	if e, isError := err.(Error); !isError || e.Problem == nil || len(e.Problem.InvalidParams) != 2 {
+		t.Errorf("expected email and username to be required, got %v", err)
+	}
+}
+
+type bindNode struct {
+	Name     string `query:"name"`
+	Parent   *bindNode
+	Children []*bindNode
+	Meta     *bindMeta
+	Cycle    *bindCycle
+}
+
+// bindMeta has nothing for Bind to fill in.
+type bindMeta struct {
+	Created time.Time
+	Owner   *bindNode
+}
+
+type bindCycle struct {
+	Node *bindNode
+	Note string `query:"note"`
+}
+
+func TestBindRecursiveTypes(t *testing.T) {
+	req := bindRequest("GET", "/?name=leaf&note=hi", "", "")
+	var dest bindNode
+	if err := req.Bind(&dest); err != nil {
+		t.Fatalf("unexpected bind error: %v", err)
+	}
+	if dest.Name != "leaf" || dest.Parent != nil {
+		t.Errorf("expected only the top level to be bound, got %+v", dest)
+	}
+	if dest.Meta != nil {
+		t.Errorf("expected a struct without binding tags to be left nil, got %+v", dest.Meta)
+	}
+	if dest.Cycle == nil || dest.Cycle.Note != "hi" || dest.Cycle.Node != nil {
+		t.Errorf("expected the nested struct to be bound without looping back, got %+v", dest.Cycle)
+	}
+}
+
+func TestBindValidationZeroValues(t *testing.T) {
+	// parameters that are present but zero are checked like any other.
+	form := url.Values{
+		"email":    {"jordan@example.com"},
+		"username": {"jordan_o"},
+		"plan":     {""},
+		"age":      {"0"},
+		"code":     {""},
+	}
+	var dest signup
+	err := bindRequest("POST", "/", "application/x-www-form-urlencoded", form.Encode()).Bind(&dest)
+	e, isError := err.(Error)
+	if !isError || e.Problem == nil {
+		t.Fatalf("expected a validation error, got %v", err)
+	}
+	names := make(map[string]bool)
+	for _, p := range e.Problem.InvalidParams {
+		names[p.Name] = true
+	}
+	for _, name := range []string{"plan", "age", "code"} {
+		if !names[name] {
+			t.Errorf("expected an explicit zero %s to be rejected, got %v", name, e.Problem.InvalidParams)
+		}
+	}
+	if len(names) != 3 {
+		t.Errorf("expected only the zero values to be rejected, got %v", e.Problem.InvalidParams)
+	}
+
+	var page struct {
+		Page int `query:"page" validate:"min=1"`
+	}
+	if err := bindRequest("GET", "/?page=0", "", "").Bind(&page); err == nil {
+		t.Errorf("expected page=0 to be rejected by min=1")
+	}
+	if err := bindRequest("GET", "/", "", "").Bind(&page); err != nil {
+		t.Errorf("expected an absent page to be accepted, got %v", err)
+	}
+}
+
+func TestValidateZeroValues(t *testing.T) {
+	type counts struct {
+		Min      int    `validate:"min=1"`
+		Optional int    `validate:"omitempty,min=1"`
+		Pointer  *int   `validate:"min=1"`
+		Choice   string `json:"choice" validate:"omitempty,oneof=a b"`
+	}
+	err := Validate(&counts{})
+	e, isError := err.(Error)
+	if !isError || e.Problem == nil || len(e.Problem.InvalidParams) != 1 || e.Problem.InvalidParams[0].Name != "Min" {
+		t.Errorf("expected only Min to fail, got %v", err)
+	}
+
+	zero := 0
+	if err := Validate(&counts{Min: 1, Pointer: &zero}); err == nil {
+		t.Errorf("expected a pointer to zero to be checked")
+	}
+	if err := Validate(&counts{Min: 1, Optional: 5, Choice: "c"}); err == nil {
+		t.Errorf("expected omitempty to check values that aren't zero")
+	}
+}
+
+func TestValidateCycle(t *testing.T) {
+	type node struct {
+		Name string `validate:"required"`
+		Next *node
+	}
+	a := &node{Name: "a"}
+	a.Next = a
+	if err := Validate(a); err != nil {
+		t.Errorf("unexpected validation error: %v", err)
+	}
+
+	b := &node{Next: &node{Name: "c"}}
+	b.Next.Next = b
+	err := Validate(b)
+	if e, isError := err.(Error); !isError || e.Problem == nil || len(e.Problem.InvalidParams) != 1 {
+		t.Errorf("expected the cycle to be checked once, got %v", err)
+	}
+}
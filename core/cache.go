@@ -0,0 +1,570 @@
+package din
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheOptions tells the Cache stage how to cache the responses of a
+// pipeline.  These are read from the cache_options of a route in routes.json:
+//
+//	{"route": "^/news$", "name": "news", "handlers": ["Cache", "NewsHandler"],
+//	 "cache_options": {"ttl": "5m", "stale_while_revalidate": "1m", "vary": ["Accept-Language"]}}
+type CacheOptions struct {
+	// how long a response is served from the cache before it's considered
+	// stale.  A pipeline with no ttl isn't cached.
+	TTL Duration `json:"ttl"`
+
+	// how long past its ttl a stale response may still be served, while a
+	// fresh one is rendered in the background.  Zero means that stale
+	// responses are never served.
+	StaleWhileRevalidate Duration `json:"stale_while_revalidate"`
+
+	// the request headers that the response depends on, each of which
+	// becomes part of the cache key.  Responses with a Vary header naming
+	// any other request header aren't cached, since they couldn't be told
+	// apart.
+	Vary []string `json:"vary"`
+
+	// whether responses are cached separately for each session, which
+	// allows the caching of pages that show who's logged in.  Requests
+	// without a session share their responses as usual.
+	PerSession bool `json:"per_session"`
+}
+
+func (o *CacheOptions) varies(name string) bool {
+	for _, v := range o.Vary {
+		if strings.EqualFold(v, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// A CachedResponse is a rendered response, as kept in a CacheStore.  Cached
+// responses are shared between requests, and must not be modified once
+// they've been stored.
+type CachedResponse struct {
+	Status int
+	Header http.Header
+	Body   []byte
+
+	// when the response was rendered
+	Stored time.Time
+
+	// when the response becomes stale
+	Expires time.Time
+
+	// when the response may no longer be served at all, which is when
+	// stores may forget it.
+	StaleUntil time.Time
+}
+
+func (c *CachedResponse) size() int64 {
+	n := int64(len(c.Body))
+	for k, vs := range c.Header {
+		for _, v := range vs {
+			n += int64(len(k) + len(v))
+		}
+	}
+	return n
+}
+
+// A CacheStore keeps rendered responses for the Cache stage.  Keys are
+// hashes, and so reveal nothing about the requests they came from.
+// CacheStores must be safe for concurrent use.
+type CacheStore interface {
+	// Get gives the response stored under key, or nil if there isn't one.
+	Get(key string) (*CachedResponse, error)
+
+	// Set stores a response under key, replacing any response that's
+	// already there.
+	Set(key string, res *CachedResponse) error
+
+	// Delete removes the response stored under key.  Deleting a response
+	// that doesn't exist is not an error.
+	Delete(key string) error
+}
+
+// the largest body that will be cached.  Larger responses are served as
+// usual, but aren't kept.
+const maxCachedBody = 1 << 20
+
+const (
+	defaultCacheMaxEntries = 10000
+	defaultCacheMaxBytes   = 64 << 20
+)
+
+// MemoryCache is a CacheStore that keeps responses in memory, up to a limit
+// on their number and total size, past which the least recently used
+// responses are evicted.
+type MemoryCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	maxBytes   int64
+	size       int64
+	entries    map[string]*list.Element
+	lru        *list.List
+}
+
+type memoryCacheEntry struct {
+	key string
+	res *CachedResponse
+}
+
+// NewMemoryCache creates a MemoryCache that holds at most maxEntries
+// responses, of at most maxBytes in total.  Zero values select the defaults
+// of 10000 responses and 64MB.
+func NewMemoryCache(maxEntries int, maxBytes int64) *MemoryCache {
+	if maxEntries <= 0 {
+		maxEntries = defaultCacheMaxEntries
+	}
+	if maxBytes <= 0 {
+		maxBytes = defaultCacheMaxBytes
+	}
+	return &MemoryCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// Get gives the response stored under key.  Responses that can no longer be
+// served, even stale, are removed as they're encountered.
+func (m *MemoryCache) Get(key string) (*CachedResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	e := el.Value.(*memoryCacheEntry)
+	if time.Now().After(e.res.StaleUntil) {
+		m.remove(el)
+		return nil, nil
+	}
+	m.lru.MoveToFront(el)
+	return e.res, nil
+}
+
+// Set stores a response under key, evicting the least recently used
+// responses if the cache is over capacity.  A response that is larger than
+// the whole cache isn't stored.
+func (m *MemoryCache) Set(key string, res *CachedResponse) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if el, ok := m.entries[key]; ok {
+		m.remove(el)
+	}
+	size := res.size()
+	if size > m.maxBytes {
+		return nil
+	}
+	m.entries[key] = m.lru.PushFront(&memoryCacheEntry{key: key, res: res})
+	m.size += size
+	for m.lru.Len() > m.maxEntries || m.size > m.maxBytes {
+		m.remove(m.lru.Back())
+	}
+	return nil
+}
+
+// Delete removes the response stored under key.
+func (m *MemoryCache) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if el, ok := m.entries[key]; ok {
+		m.remove(el)
+	}
+	return nil
+}
+
+// Len gives the number of responses in the cache.
+func (m *MemoryCache) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lru.Len()
+}
+
+// remove must be called with the lock held.
+func (m *MemoryCache) remove(el *list.Element) {
+	e := el.Value.(*memoryCacheEntry)
+	m.lru.Remove(el)
+	delete(m.entries, e.key)
+	m.size -= e.res.size()
+}
+
+var (
+	defaultCacheStore     CacheStore
+	defaultCacheStoreOnce sync.Once
+)
+
+// SetCacheStore sets the store used by the Cache stage.  It should be called
+// before the server starts.
+func SetCacheStore(s CacheStore) {
+	defaultCacheStoreOnce.Do(func() {})
+	defaultCacheStore = s
+}
+
+func getCacheStore() CacheStore {
+	defaultCacheStoreOnce.Do(func() {
+		defaultCacheStore = NewMemoryCache(0, 0)
+	})
+	return defaultCacheStore
+}
+
+// a cacheFlight is a response being rendered for the cache.  Requests for the
+// same response that arrive in the meantime wait for it, rather than all
+// rendering it at once.
+type cacheFlight struct {
+	key     string
+	opts    *CacheOptions
+	private bool
+	started time.Time
+	done    chan struct{}
+	capture *cacheCapture
+}
+
+// how long requests wait for another request to render the response they're
+// after before rendering it themselves, and so also how long a flight may go
+// on before it's presumed lost.
+const cacheFlightTimeout = 10 * time.Second
+
+var cacheFlights = struct {
+	sync.Mutex
+	m map[string]*cacheFlight
+}{m: make(map[string]*cacheFlight)}
+
+// joinFlight gives the flight rendering the response under key, starting one
+// if there isn't one.  leader is true if the caller started the flight, and so
+// is responsible for ending it.
+func joinFlight(key string, opts *CacheOptions, private bool) (f *cacheFlight, leader bool) {
+	cacheFlights.Lock()
+	defer cacheFlights.Unlock()
+	now := time.Now()
+	if f, ok := cacheFlights.m[key]; ok && now.Sub(f.started) < cacheFlightTimeout {
+		return f, false
+	}
+	f = &cacheFlight{key: key, opts: opts, private: private, started: now, done: make(chan struct{})}
+	cacheFlights.m[key] = f
+	return f, true
+}
+
+// land ends the flight, storing its response if it turned out to be
+// cacheable, and releases the requests that are waiting for it.
+func (f *cacheFlight) land(req *Request) {
+	if res := f.response(req); res != nil {
+		if err := getCacheStore().Set(f.key, res); err != nil {
+			req.LogError(err)
+		}
+	}
+	cacheFlights.Lock()
+	if cacheFlights.m[f.key] == f {
+		delete(cacheFlights.m, f.key)
+	}
+	cacheFlights.Unlock()
+	close(f.done)
+}
+
+// response gives the response captured by the flight, if it may be cached.
+// Responses that were made for one client in particular, such as those that
+// carry a csrf token or a csp nonce, or that were rendered for a logged-in
+// user, can't be shared with other clients.
+func (f *cacheFlight) response(req *Request) *CachedResponse {
+	c := f.capture
+	if c == nil || c.code == 0 || c.overflow || req.failed || !cacheableStatus(c.code) {
+		return nil
+	}
+	if req.cspNonce != "" || len(req.flashes) > 0 {
+		return nil
+	}
+	if !f.private && (req.csrfToken != "" || req.user != nil) {
+		return nil
+	}
+	h := c.header
+	if h.Get("Set-Cookie") != "" {
+		return nil
+	}
+	for _, v := range h.Values("Cache-Control") {
+		for _, directive := range strings.Split(v, ",") {
+			switch strings.ToLower(strings.TrimSpace(directive)) {
+			case "no-store", "no-cache":
+				return nil
+			case "private":
+				if !f.private {
+					return nil
+				}
+			}
+		}
+	}
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" || !f.opts.varies(name) {
+				return nil
+			}
+		}
+	}
+	now := time.Now()
+	expires := now.Add(time.Duration(f.opts.TTL))
+	return &CachedResponse{
+		Status:     c.code,
+		Header:     h,
+		Body:       c.body.Bytes(),
+		Stored:     now,
+		Expires:    expires,
+		StaleUntil: expires.Add(time.Duration(f.opts.StaleWhileRevalidate)),
+	}
+}
+
+// cacheableStatus tells us whether responses with the given status may be
+// cached, which is the case for the statuses that RFC 9110 considers
+// cacheable by default.
+func cacheableStatus(code int) bool {
+	switch code {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusNoContent,
+		http.StatusMultipleChoices, http.StatusMovedPermanently,
+		http.StatusPermanentRedirect, http.StatusNotFound, http.StatusGone:
+		return true
+	}
+	return false
+}
+
+// cacheCapture keeps a copy of the response written through it.  It sits in
+// front of the hookedWriter, so that the headers it captures are those set by
+// the response itself, and not the ones set for the request by earlier stages
+// (session cookies, rate limits, cors headers and the like), which belong to
+// each request that the response is served to.  It also sits in front of
+// compression, which is applied anew to every response served from the
+// cache.
+type cacheCapture struct {
+	http.ResponseWriter
+	code     int
+	header   http.Header
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (c *cacheCapture) WriteHeader(code int) {
+	if c.code == 0 {
+		c.code = code
+		c.header = c.ResponseWriter.Header().Clone()
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *cacheCapture) Write(b []byte) (int, error) {
+	if c.code == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+	if !c.overflow {
+		if c.body.Len()+len(b) > maxCachedBody {
+			c.overflow = true
+			c.body = bytes.Buffer{}
+		} else {
+			c.body.Write(b)
+		}
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+// cacheWriter gives the writer that the response to req should be rendered
+// into, which captures the response if it's to be cached.
+func (req *Request) cacheWriter(w http.ResponseWriter) http.ResponseWriter {
+	if req.cacheFlight == nil {
+		return w
+	}
+	req.cacheFlight.capture = &cacheCapture{ResponseWriter: w}
+	return req.cacheFlight.capture
+}
+
+// finishCaching lands the request's cache flight, if it has one, however the
+// request ended.  A background revalidation lands its flight even if it never
+// reached the Cache stage, so that the next stale hit can try again.
+func (req *Request) finishCaching() {
+	f := req.cacheFlight
+	if f == nil {
+		f, _ = req.Context().Value(cacheRevalidationKey{}).(*cacheFlight)
+	}
+	if f != nil {
+		req.cacheFlight = nil
+		f.land(req)
+	}
+}
+
+// cacheHit is a response served from the cache.
+type cacheHit struct {
+	res *CachedResponse
+}
+
+func (c *cacheHit) Render(w http.ResponseWriter) error {
+	h := w.Header()
+	for k, v := range c.res.Header {
+		h[k] = append([]string(nil), v...)
+	}
+	h.Set("Age", strconv.FormatInt(int64(time.Since(c.res.Stored)/time.Second), 10))
+	w.WriteHeader(c.res.Status)
+	_, err := w.Write(c.res.Body)
+	return err
+}
+
+func (c *cacheHit) Status() int { return c.res.Status }
+
+func (c *cacheHit) ETag() string { return c.res.Header.Get("ETag") }
+
+func (c *cacheHit) LastModified() time.Time {
+	t, _ := http.ParseTime(c.res.Header.Get("Last-Modified"))
+	return t
+}
+
+// cacheKey identifies the response to a request among those of its pipeline.
+// private is true if the key is specific to the client's session.
+func cacheKey(req *Request, opts *CacheOptions) (key string, private bool) {
+	var b strings.Builder
+	b.WriteString(req.Method)
+	b.WriteByte(' ')
+	b.WriteString(req.URL.RequestURI())
+	for _, name := range opts.Vary {
+		b.WriteByte('\n')
+		b.WriteString(http.CanonicalHeaderKey(name))
+		b.WriteString(": ")
+		b.WriteString(strings.Join(req.Header.Values(name), ", "))
+	}
+	if opts.PerSession {
+		if id, err := req.SessionIdentity(); err == nil {
+			b.WriteString("\nsession: ")
+			b.WriteString(id)
+			private = true
+		}
+	}
+	sum := sha256.Sum256([]byte(b.String()))
+	return hex.EncodeToString(sum[:]), private
+}
+
+type cacheRevalidationKey struct{}
+
+// Cache serves GET and HEAD requests from a cache of rendered responses,
+// according to the cache_options of the pipeline, and caches the responses
+// of the stages that follow it.  Stages ahead of Cache, such as rate limits
+// and authentication, run on every request.  Pipelines without cache_options
+// aren't cached.
+//
+// When several requests miss the cache at once, only one of them renders the
+// response; the others wait for it.  A response that has gone stale, but is
+// within its stale_while_revalidate window, is served as it is while a fresh
+// one is rendered in the background, by a copy of the request that goes
+// through the whole pipeline again and whose response is thrown away.  The
+// copy doesn't count against rate limits or change the client's session.
+//
+// Requests with an Authorization header aren't cached unless the
+// cache_options vary on Authorization.  Responses that set cookies, that are
+// marked no-store, no-cache or (unless cached per session) private, or that
+// were rendered for a logged-in user, aren't cached either.
+func Cache(req *Request) (Response, error) {
+	if req.RouteMatch == nil || req.Pipeline.CacheOptions == nil {
+		return nil, nil
+	}
+	opts := req.Pipeline.CacheOptions
+	if opts.TTL <= 0 || (req.Method != "GET" && req.Method != "HEAD") {
+		return nil, nil
+	}
+	if f, ok := req.Context().Value(cacheRevalidationKey{}).(*cacheFlight); ok {
+		req.cacheFlight = f
+		return nil, nil
+	}
+	if req.Header.Get("Authorization") != "" && !opts.varies("Authorization") {
+		return nil, nil
+	}
+
+	key, private := cacheKey(req, opts)
+	store := getCacheStore()
+	for waited := false; ; waited = true {
+		res, err := store.Get(key)
+		if err != nil {
+			// a broken cache shouldn't take the site down with it.
+			req.LogError(err)
+			return nil, nil
+		}
+		now := time.Now()
+		if res != nil && now.Before(res.Expires) {
+			return &cacheHit{res}, nil
+		}
+		if res != nil && now.Before(res.StaleUntil) {
+			req.revalidate(key, opts, private)
+			return &cacheHit{res}, nil
+		}
+		f, leader := joinFlight(key, opts, private)
+		if leader {
+			req.cacheFlight = f
+			return nil, nil
+		}
+		if waited {
+			return nil, nil
+		}
+		select {
+		case <-f.done:
+		case <-time.After(cacheFlightTimeout):
+			return nil, nil
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// revalidate renders a fresh copy of a stale response in the background,
+// unless that's already being done.  Unless the response is cached per
+// session, the copy of the request doesn't carry the client's credentials
+// (other than those the cache key varies on), since the response is for
+// everybody and shouldn't be rendered as anybody in particular.
+func (req *Request) revalidate(key string, opts *CacheOptions, private bool) {
+	f, leader := joinFlight(key, opts, private)
+	if !leader {
+		return
+	}
+	if req.router == nil {
+		f.land(req)
+		return
+	}
+	raw := req.Request.Clone(context.WithValue(context.Background(), cacheRevalidationKey{}, f))
+	if !private {
+		for _, name := range []string{"Cookie", "Authorization"} {
+			if !opts.varies(name) {
+				raw.Header.Del(name)
+			}
+		}
+	}
+	go req.router.ServeHTTP(&discardWriter{header: make(http.Header)}, raw)
+}
+
+// revalidating tells us whether req is a background revalidation, whose
+// response goes to the cache rather than the client.  A revalidation
+// doesn't count against the client's rate limits, and leaves the client's
+// session as it found it.
+func (req *Request) revalidating() bool {
+	_, ok := req.Context().Value(cacheRevalidationKey{}).(*cacheFlight)
+	return ok
+}
+
+// discardWriter is a ResponseWriter that throws the response away.
+type discardWriter struct {
+	header http.Header
+}
+
+func (d *discardWriter) Header() http.Header         { return d.header }
+func (d *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (d *discardWriter) WriteHeader(int)             {}
+
+func init() {
+	RegisterHandler("Cache", Cache)
+}
@@ -0,0 +1,310 @@
+package din
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func cacheRouter(t *testing.T, calls *int64, release chan struct{}) *Router {
+	SetCacheStore(NewMemoryCache(0, 0))
+	RegisterHandler("testCounted", func(req *Request) (Response, error) {
+		if release != nil {
+			<-release
+		}
+		n := atomic.AddInt64(calls, 1)
+		return PlaintextResponseString(fmt.Sprintf("%s %s #%d", req.URL.RequestURI(), req.Header.Get("Accept-Language"), n), http.StatusOK), nil
+	})
+	RegisterHandler("testNoStore", func(req *Request) (Response, error) {
+		atomic.AddInt64(calls, 1)
+		req.ResponseHeader().Set("X-Per-Request", "yes")
+		return &headerResponse{"Cache-Control", "no-store"}, nil
+	})
+	return httpAuthRouter(t, `[
+		{"route": "^/cached$", "name": "cached", "handlers": ["Cache", "testCounted"],
+		 "cache_options": {"ttl": "1m", "vary": ["Accept-Language"]}},
+		{"route": "^/stale$", "name": "stale", "handlers": ["Cache", "testCounted"],
+		 "cache_options": {"ttl": "30ms", "stale_while_revalidate": "1m"}},
+		{"route": "^/nostore$", "name": "nostore", "handlers": ["Cache", "testNoStore"],
+		 "cache_options": {"ttl": "1m"}},
+		{"route": "^/uncached$", "name": "uncached", "handlers": ["Cache", "testCounted"]}
+	]`)
+}
+
+type headerResponse struct{ name, value string }
+
+func (res *headerResponse) Render(w http.ResponseWriter) error {
+	w.Header().Set(res.name, res.value)
+	_, err := w.Write([]byte("ok"))
+	return err
+}
+
+func (res *headerResponse) Status() int { return http.StatusOK }
+
+func cacheGet(router *Router, method, path string, headers ...string) *httptest.ResponseRecorder {
+	return conditionalRequest(router, method, path, headers...)
+}
+
+func TestCache(t *testing.T) {
+	var calls int64
+	router := cacheRouter(t, &calls, nil)
+
+	tests := []struct {
+		method  string
+		path    string
+		headers []string
+		body    string
+		calls   int64
+	}{
+		{"GET", "/cached", nil, "/cached  #1", 1},
+		{"GET", "/cached", nil, "/cached  #1", 1},
+		{"GET", "/cached?page=2", nil, "/cached?page=2  #2", 2},
+		{"GET", "/cached", []string{"Accept-Language", "fr"}, "/cached fr #3", 3},
+		{"GET", "/cached", []string{"Accept-Language", "fr"}, "/cached fr #3", 3},
+		{"HEAD", "/cached", nil, "/cached  #4", 4},
+		{"POST", "/cached", nil, "/cached  #5", 5},
+		{"GET", "/cached", []string{"Authorization", "Bearer x"}, "/cached  #6", 6},
+		{"GET", "/uncached", nil, "/uncached  #7", 7},
+		{"GET", "/uncached", nil, "/uncached  #8", 8},
+		{"GET", "/cached", nil, "/cached  #1", 8},
+	}
+	for i, test := range tests {
+		w := cacheGet(router, test.method, test.path, test.headers...)
+		if w.Code != http.StatusOK || w.Body.String() != test.body {
+			t.Errorf("%d: %s %s: expected %q, got %d %q", i, test.method, test.path, test.body, w.Code, w.Body.String())
+		}
+		if got := atomic.LoadInt64(&calls); got != test.calls {
+			t.Errorf("%d: %s %s: expected %d calls to the handler, got %d", i, test.method, test.path, test.calls, got)
+		}
+	}
+
+	w := cacheGet(router, "GET", "/cached")
+	if w.Header().Get("Age") == "" {
+		t.Errorf("expected a cached response to carry an Age header: %v", w.Header())
+	}
+
+	// responses marked no-store are rendered every time, and headers set for
+	// the request are sent either way.
+	for i := 0; i < 2; i++ {
+		w := cacheGet(router, "GET", "/nostore")
+		if w.Header().Get("X-Per-Request") != "yes" {
+			t.Errorf("expected the request's own headers, got %v", w.Header())
+		}
+	}
+	if got := atomic.LoadInt64(&calls); got != 10 {
+		t.Errorf("expected no-store responses not to be cached, got %d calls", got)
+	}
+}
+
+func TestCacheCoalescing(t *testing.T) {
+	var calls int64
+	release := make(chan struct{})
+	router := cacheRouter(t, &calls, release)
+
+	var wg sync.WaitGroup
+	bodies := make([]string, 5)
+	for i := range bodies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			bodies[i] = cacheGet(router, "GET", "/cached").Body.String()
+		}(i)
+	}
+	// give the requests time to pile up behind the first one.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("expected concurrent misses to render the response once, got %d", calls)
+	}
+	for i, body := range bodies {
+		if body != "/cached  #1" {
+			t.Errorf("%d: expected the shared response, got %q", i, body)
+		}
+	}
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	var calls int64
+	router := cacheRouter(t, &calls, nil)
+
+	if body := cacheGet(router, "GET", "/stale").Body.String(); body != "/stale  #1" {
+		t.Fatalf("expected a fresh response, got %q", body)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if body := cacheGet(router, "GET", "/stale").Body.String(); body != "/stale  #1" {
+		t.Fatalf("expected the stale response, got %q", body)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		if body := cacheGet(router, "GET", "/stale").Body.String(); body == "/stale  #2" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the stale response to be revalidated in the background")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := atomic.LoadInt64(&calls); got != 2 {
+		t.Errorf("expected a single revalidation, got %d calls", got)
+	}
+}
+
+func TestMemoryCacheEviction(t *testing.T) {
+	m := NewMemoryCache(2, 0)
+	later := time.Now().Add(time.Minute)
+	res := func(body string) *CachedResponse {
+		return &CachedResponse{Status: http.StatusOK, Body: []byte(body), Expires: later, StaleUntil: later}
+	}
+	m.Set("a", res("a"))
+	m.Set("b", res("b"))
+	m.Get("a")
+	m.Set("c", res("c"))
+	if got, _ := m.Get("b"); got != nil {
+		t.Errorf("expected the least recently used response to be evicted")
+	}
+	if got, _ := m.Get("a"); got == nil {
+		t.Errorf("expected a recently used response to be kept")
+	}
+
+	m = NewMemoryCache(0, 10)
+	m.Set("a", res("123456"))
+	m.Set("b", res("123456"))
+	if m.Len() != 1 {
+		t.Errorf("expected the cache to keep within its size, got %d entries", m.Len())
+	}
+	m.Set("big", res("12345678901"))
+	if got, _ := m.Get("big"); got != nil {
+		t.Errorf("expected a response larger than the cache not to be stored")
+	}
+
+	m.Set("old", &CachedResponse{Body: []byte("x"), StaleUntil: time.Now().Add(-time.Second)})
+	if got, _ := m.Get("old"); got != nil {
+		t.Errorf("expected an expired response to be forgotten")
+	}
+}
+
+// revalidationRouter serves a shared and a per-session page, both of which
+// go stale quickly, and records the cookies that each render was made with.
+func revalidationRouter(t *testing.T, calls *int64, cookies *[]string, mu *sync.Mutex) *Router {
+	SetCacheStore(NewMemoryCache(0, 0))
+	SetRateLimitStore(NewMemoryRateLimitStore())
+	RegisterHandler("testCacheLogin", func(req *Request) (Response, error) {
+		req.SessionSet("name", "bob")
+		return EmptyResponse(http.StatusNoContent), nil
+	})
+	RegisterHandler("testCacheSeen", func(req *Request) (Response, error) {
+		n := atomic.AddInt64(calls, 1)
+		mu.Lock()
+		*cookies = append(*cookies, req.Header.Get("Cookie"))
+		mu.Unlock()
+		var name string
+		if req.SessionGet("name", &name) == nil {
+			req.SessionSet("renders:"+req.URL.Path, n)
+		}
+		return PlaintextResponseString(fmt.Sprintf("%s #%d", name, n), http.StatusOK), nil
+	})
+	return httpAuthRouter(t, `[
+		{"route": "^/login$", "name": "login", "handlers": ["testCacheLogin"]},
+		{"route": "^/shared$", "name": "shared", "handlers": ["RateLimit(100, 1m)", "Cache", "testCacheSeen"],
+		 "cache_options": {"ttl": "30ms", "stale_while_revalidate": "1m"}},
+		{"route": "^/mine$", "name": "mine", "handlers": ["Cache", "testCacheSeen"],
+		 "cache_options": {"ttl": "30ms", "stale_while_revalidate": "1m", "per_session": true}}
+	]`)
+}
+
+func TestCacheRevalidationIsolation(t *testing.T) {
+	var (
+		calls   int64
+		cookies []string
+		mu      sync.Mutex
+	)
+	router := revalidationRouter(t, &calls, &cookies, &mu)
+	cookie := sessionCookie(sessionGet(router, "/login", nil))
+	if cookie == nil {
+		t.Fatal("expected a session cookie")
+	}
+	requests := map[string]int{}
+	get := func(path string) *httptest.ResponseRecorder {
+		requests[path]++
+		return cacheGet(router, "GET", path, "Cookie", cookie.Name+"="+cookie.Value)
+	}
+	// waitFor polls path until the revalidated response is served.
+	waitFor := func(path, body string) {
+		deadline := time.Now().Add(time.Second)
+		for get(path).Body.String() != body {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: expected the stale response to be revalidated", path)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	if body := get("/shared").Body.String(); body != "bob #1" {
+		t.Fatalf("expected a fresh response, got %q", body)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if body := get("/shared").Body.String(); body != "bob #1" {
+		t.Fatalf("expected the stale response, got %q", body)
+	}
+	// the shared response is rendered again without the client's session.
+	waitFor("/shared", " #2")
+	want := strconv.Itoa(100 - requests["/shared"] - 1)
+	if got := get("/shared").Header().Get("RateLimit-Remaining"); got != want {
+		t.Errorf("expected the revalidation not to count against the client, got %s remaining, want %s", got, want)
+	}
+
+	if body := get("/mine").Body.String(); body != "bob #3" {
+		t.Fatalf("expected a fresh response, got %q", body)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if body := get("/mine").Body.String(); body != "bob #3" {
+		t.Fatalf("expected the stale response, got %q", body)
+	}
+	waitFor("/mine", "bob #4")
+
+	mu.Lock()
+	seen := append([]string(nil), cookies...)
+	mu.Unlock()
+	if len(seen) != 4 || seen[1] != "" || seen[3] == "" {
+		t.Errorf("expected only the per-session revalidation to carry the client's cookie, got %q", seen)
+	}
+	s, err := sessions.Get(cookie.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renders := s["renders:/mine"]; renders != int64(3) {
+		t.Errorf("expected the revalidation to leave the session alone, got renders %v", renders)
+	}
+}
+
+func TestCachePerSessionCookieStore(t *testing.T) {
+	defer useCookieStore(t, testKey(1))()
+	var (
+		calls   int64
+		cookies []string
+		mu      sync.Mutex
+	)
+	router := revalidationRouter(t, &calls, &cookies, &mu)
+	first := sessionCookie(sessionGet(router, "/login", nil))
+	latest := sessionCookie(sessionGet(router, "/login", first))
+	if first == nil || latest == nil || first.Value == latest.Value {
+		t.Fatalf("expected the session cookie to change when the session is saved, got %v and %v", first, latest)
+	}
+	for i, c := range []*http.Cookie{first, latest, first} {
+		w := cacheGet(router, "GET", "/mine", "Cookie", c.Name+"="+c.Value)
+		if w.Body.String() != "bob #1" {
+			t.Errorf("%d: expected every cookie of the session to share its cached response, got %q", i, w.Body.String())
+		}
+	}
+	other := sessionCookie(sessionGet(router, "/login", nil))
+	if w := cacheGet(router, "GET", "/mine", "Cookie", other.Name+"="+other.Value); w.Body.String() != "bob #2" {
+		t.Errorf("expected another session to get a response of its own, got %q", w.Body.String())
+	}
+}
@@ -0,0 +1,310 @@
+package din
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// CompressionOptions configures the compression of responses.  These are read
+// from the compression section of the config file.
+type CompressionOptions struct {
+	// whether responses are compressed at all.  Defaults to true.
+	Enabled bool `json:"enabled"`
+
+	// responses smaller than this many bytes are sent as they are, since
+	// compressing them saves next to nothing.  Defaults to 1024.
+	MinSize int `json:"min_size"`
+
+	// the media types that are compressed, which may contain wildcards as
+	// understood by path.Match, e.g., "text/*" or "application/*+json".
+	// Media types that are already compressed, such as images, gain nothing
+	// from being compressed again.  Defaults to defaultCompressibleTypes.
+	ContentTypes []string `json:"content_types"`
+
+	// the compression level, from 1 (fastest) to 9 (smallest), as
+	// understood by the encoder.  Zero is the encoder's default.
+	Level int `json:"level"`
+}
+
+const defaultCompressionMinSize = 1024
+
+var defaultCompressibleTypes = []string{
+	"text/*",
+	"application/json",
+	"application/*+json",
+	"application/javascript",
+	"application/xml",
+	"application/*+xml",
+	"image/svg+xml",
+}
+
+func (o CompressionOptions) minSize() int {
+	if o.MinSize > 0 {
+		return o.MinSize
+	}
+	return defaultCompressionMinSize
+}
+
+// compressible tells us whether a response with the given Content-Type should
+// be compressed.
+func (o CompressionOptions) compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	types := o.ContentTypes
+	if types == nil {
+		types = defaultCompressibleTypes
+	}
+	for _, pattern := range types {
+		if ok, _ := path.Match(pattern, mediaType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// An Encoder creates a writer that compresses whatever is written to it into
+// w, at the given level.  Closing the writer must flush any buffered data to
+// w, but must not close w.
+type Encoder func(w io.Writer, level int) (io.WriteCloser, error)
+
+type contentCoding struct {
+	name string
+	enc  Encoder
+}
+
+// registered encodings, in increasing order of preference.
+var encodings []contentCoding
+
+// RegisterEncoding makes a content coding available for compressing
+// responses, such as "br" or "zstd", by way of an encoder from some other
+// package.  Registering a coding that's already registered replaces its
+// encoder.  When a client accepts several codings equally, the one
+// registered last is used, so that codings added by the application are
+// preferred over gzip and deflate, which are built in.
+func RegisterEncoding(name string, enc Encoder) {
+	name = strings.ToLower(name)
+	for i, e := range encodings {
+		if e.name == name {
+			encodings = append(encodings[:i], encodings[i+1:]...)
+			break
+		}
+	}
+	encodings = append(encodings, contentCoding{name: name, enc: enc})
+}
+
+// negotiateCompression picks the encoding to compress the response to req
+// with, or nil if it shouldn't be compressed.
+func negotiateCompression(req *Request) *contentCoding {
+	offers := make([]string, len(encodings))
+	for i := range encodings {
+		offers[i] = encodings[len(encodings)-1-i].name
+	}
+	name := req.AcceptsEncoding(offers...)
+	for i := range encodings {
+		if encodings[i].name == name {
+			return &encodings[i]
+		}
+	}
+	return nil
+}
+
+// addVary adds a header name to the Vary header, unless it's already there.
+func addVary(h http.Header, name string) {
+	for _, v := range h.Values("Vary") {
+		for _, field := range strings.Split(v, ",") {
+			if field = strings.TrimSpace(field); field == "*" || strings.EqualFold(field, name) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", name)
+}
+
+// compressWriter compresses the response written through it, if the response
+// turns out to be worth compressing.  That can't be known until the headers
+// are complete and, for responses that don't declare their length, until
+// enough of the body has been written, so the headers are held back, and the
+// start of the body buffered, until a decision can be made.
+type compressWriter struct {
+	http.ResponseWriter
+	opts     CompressionOptions
+	encoding *contentCoding
+	head     bool
+
+	code        int
+	wroteHeader bool
+	decided     bool
+	buf         []byte
+	enc         io.WriteCloser
+}
+
+// compressWriter wraps w so as to compress the response to req, if
+// compression is enabled.  The wrapper must be closed once the response is
+// complete.
+func (router *Router) compressWriter(w http.ResponseWriter, req *Request) *compressWriter {
+	opts := Config.Compression
+	if !opts.Enabled {
+		return nil
+	}
+	return &compressWriter{
+		ResponseWriter: w,
+		opts:           opts,
+		encoding:       negotiateCompression(req),
+		head:           req.Method == "HEAD",
+	}
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.code = code
+
+	h := w.Header()
+	ctype := h.Get("Content-Type")
+	if ctype == "" || w.opts.compressible(ctype) {
+		// whether or not this response ends up compressed, the same
+		// request with some other Accept-Encoding might have been.
+		if h.Get("Content-Encoding") == "" {
+			addVary(h, "Accept-Encoding")
+		}
+	}
+
+	switch {
+	case w.encoding == nil, w.head,
+		code < 200, code == http.StatusNoContent, code == http.StatusNotModified,
+		code == http.StatusPartialContent, h.Get("Content-Range") != "",
+		h.Get("Content-Encoding") != "",
+		ctype != "" && !w.opts.compressible(ctype):
+		w.passThrough()
+		return
+	}
+	if n, err := strconv.Atoi(h.Get("Content-Length")); err == nil && n < w.opts.minSize() {
+		w.passThrough()
+	}
+}
+
+// passThrough sends the response as it is.
+func (w *compressWriter) passThrough() {
+	w.decided = true
+	w.ResponseWriter.WriteHeader(w.code)
+	if len(w.buf) > 0 {
+		w.ResponseWriter.Write(w.buf)
+		w.buf = nil
+	}
+}
+
+// decide compresses the response if it's compressible and, unless force is
+// set, at least as long as the minimum size; otherwise it's passed through.
+func (w *compressWriter) decide(force bool) error {
+	h := w.Header()
+	if h.Get("Content-Type") == "" {
+		// net/http would sniff this itself, but it can't see through the
+		// compression.
+		h.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+	if !w.opts.compressible(h.Get("Content-Type")) || (!force && len(w.buf) < w.opts.minSize()) {
+		w.passThrough()
+		return nil
+	}
+
+	enc, err := w.encoding.enc(w.ResponseWriter, w.opts.Level)
+	if err != nil {
+		w.passThrough()
+		return err
+	}
+	w.decided = true
+	w.enc = enc
+	h.Del("Content-Length")
+	h.Del("Accept-Ranges")
+	h.Set("Content-Encoding", w.encoding.name)
+	// the compressed response isn't byte-for-byte the same as the
+	// uncompressed one, so a strong validator no longer applies to it.
+	if etag := h.Get("ETag"); strings.HasPrefix(etag, `"`) {
+		h.Set("ETag", "W/"+etag)
+	}
+	w.ResponseWriter.WriteHeader(w.code)
+	if len(w.buf) > 0 {
+		_, err = enc.Write(w.buf)
+		w.buf = nil
+	}
+	return err
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.decided {
+		if w.enc != nil {
+			return w.enc.Write(b)
+		}
+		return w.ResponseWriter.Write(b)
+	}
+	w.buf = append(w.buf, b...)
+	if len(w.buf) >= w.opts.minSize() {
+		if err := w.decide(false); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Flush sends whatever has been written so far, for responses that are
+// streamed.  A response that's flushed before reaching the minimum size is
+// compressed anyway, if its type is compressible, since more is evidently on
+// the way.
+func (w *compressWriter) Flush() {
+	if w.wroteHeader && !w.decided {
+		w.decide(true)
+	}
+	if f, ok := w.enc.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close completes the response.
+func (w *compressWriter) Close() error {
+	if !w.wroteHeader {
+		return nil
+	}
+	if !w.decided {
+		if err := w.decide(false); err != nil {
+			return err
+		}
+	}
+	if w.enc != nil {
+		return w.enc.Close()
+	}
+	return nil
+}
+
+func init() {
+	Config.Compression.Enabled = true
+
+	// the deflate coding is, despite its name, the zlib format.
+	RegisterEncoding("deflate", func(w io.Writer, level int) (io.WriteCloser, error) {
+		if level == 0 {
+			level = zlib.DefaultCompression
+		}
+		return zlib.NewWriterLevel(w, level)
+	})
+	RegisterEncoding("gzip", func(w io.Writer, level int) (io.WriteCloser, error) {
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	})
+}
@@ -0,0 +1,193 @@
+package din
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func compressRouter(t *testing.T) *Router {
+	RegisterHandler("testBig", func(req *Request) (Response, error) {
+		return PlaintextResponseString(strings.Repeat("all work and no play ", 200), http.StatusOK), nil
+	})
+	RegisterHandler("testSmall", func(req *Request) (Response, error) {
+		return PlaintextResponseString("tiny", http.StatusOK), nil
+	})
+	RegisterHandler("testImage", func(req *Request) (Response, error) {
+		return &imageResponse{bytes.Repeat([]byte{0x89}, 4096)}, nil
+	})
+	return httpAuthRouter(t, `[
+		{"route": "^/big$", "name": "big", "handlers": ["testBig"]},
+		{"route": "^/small$", "name": "small", "handlers": ["testSmall"]},
+		{"route": "^/image$", "name": "image", "handlers": ["testImage"]}
+	]`)
+}
+
+type imageResponse struct{ data []byte }
+
+func (res *imageResponse) Render(w http.ResponseWriter) error {
+	w.Header().Set("Content-Type", "image/png")
+	_, err := w.Write(res.data)
+	return err
+}
+
+func (res *imageResponse) Status() int { return http.StatusOK }
+
+func compressGet(router *Router, path, acceptEncoding string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func decompress(t *testing.T, encoding string, body []byte) string {
+	var r io.Reader
+	var err error
+	switch encoding {
+	case "gzip":
+		r, err = gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		r, err = zlib.NewReader(bytes.NewReader(body))
+	default:
+		return string(body)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestCompression(t *testing.T) {
+	router := compressRouter(t)
+	big := strings.Repeat("all work and no play ", 200)
+
+	tests := []struct {
+		path           string
+		acceptEncoding string
+		encoding       string
+	}{
+		{"/big", "gzip, deflate", "gzip"},
+		{"/big", "deflate", "deflate"},
+		{"/big", "deflate;q=1, gzip;q=0.5", "deflate"},
+		{"/big", "*", "gzip"},
+		{"/big", "br", ""},
+		{"/big", "gzip;q=0", ""},
+		{"/big", "gzip;q=0.5, identity", ""},
+		{"/big", "", ""},
+		{"/small", "gzip", ""},
+		{"/image", "gzip", ""},
+	}
+	for _, test := range tests {
+		w := compressGet(router, test.path, test.acceptEncoding)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s %q: expected 200, got %d", test.path, test.acceptEncoding, w.Code)
+			continue
+		}
+		if got := w.Header().Get("Content-Encoding"); got != test.encoding {
+			t.Errorf("%s %q: expected encoding %q, got %q", test.path, test.acceptEncoding, test.encoding, got)
+			continue
+		}
+		if test.path == "/big" {
+			if body := decompress(t, test.encoding, w.Body.Bytes()); body != big {
+				t.Errorf("%s %q: body didn't survive compression", test.path, test.acceptEncoding)
+			}
+		}
+		vary := w.Header().Get("Vary")
+		if test.path == "/image" && vary != "" {
+			t.Errorf("expected incompressible response not to vary, got %q", vary)
+		} else if test.path != "/image" && vary != "Accept-Encoding" {
+			t.Errorf("%s %q: expected Vary: Accept-Encoding, got %q", test.path, test.acceptEncoding, vary)
+		}
+	}
+}
+
+func TestRegisterEncoding(t *testing.T) {
+	saved := append([]contentCoding(nil), encodings...)
+	defer func() { encodings = saved }()
+
+	// an "encoding" that shouts, so that we can tell it was used.
+	RegisterEncoding("shout", func(w io.Writer, level int) (io.WriteCloser, error) {
+		return &shoutWriter{w}, nil
+	})
+	router := compressRouter(t)
+	w := compressGet(router, "/big", "gzip, shout")
+	if w.Header().Get("Content-Encoding") != "shout" || !strings.HasPrefix(w.Body.String(), "ALL WORK") {
+		t.Errorf("expected the registered encoding to be preferred, got %q", w.Header().Get("Content-Encoding"))
+	}
+	w = compressGet(router, "/big", "gzip;q=1, shout;q=0.5")
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Errorf("expected the client's preference to win, got %q", w.Header().Get("Content-Encoding"))
+	}
+}
+
+type shoutWriter struct{ w io.Writer }
+
+func (s *shoutWriter) Write(b []byte) (int, error) { return s.w.Write(bytes.ToUpper(b)) }
+func (s *shoutWriter) Close() error                { return nil }
+
+func TestCompressStatic(t *testing.T) {
+	defer func(root string) { StaticRoot = root }(StaticRoot)
+	StaticRoot = t.TempDir()
+	script := strings.Repeat("console.log('hello');\n", 100)
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(script))
+	zw.Close()
+	write := func(name string, data []byte) {
+		if err := os.WriteFile(filepath.Join(StaticRoot, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("app.js", []byte(script))
+	write("app.js.gz", gz.Bytes())
+	write("notes.txt", []byte(script))
+	router := NewRouter(nil, nil)
+
+	// the precompressed sibling is served as is.
+	w := compressGet(router, "/app.js", "gzip")
+	if w.Header().Get("Content-Encoding") != "gzip" || !bytes.Equal(w.Body.Bytes(), gz.Bytes()) {
+		t.Errorf("expected app.js.gz to be served, got %q", w.Header().Get("Content-Encoding"))
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.Contains(ct, "javascript") {
+		t.Errorf("expected the content type of app.js, got %q", ct)
+	}
+	if w.Header().Get("Content-Length") != strconv.Itoa(gz.Len()) {
+		t.Errorf("expected the length of app.js.gz, got %q", w.Header().Get("Content-Length"))
+	}
+	w = compressGet(router, "/app.js", "")
+	if w.Header().Get("Content-Encoding") != "" || w.Body.String() != script || w.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("expected app.js to be served to a client that doesn't accept gzip: %v", w.Header())
+	}
+
+	// files without a sibling are compressed on the fly, unless a range is
+	// asked for.
+	w = compressGet(router, "/notes.txt", "gzip")
+	if w.Header().Get("Content-Encoding") != "gzip" || decompress(t, "gzip", w.Body.Bytes()) != script {
+		t.Errorf("expected notes.txt to be compressed, got %q", w.Header().Get("Content-Encoding"))
+	}
+	if w.Header().Get("Content-Length") != "" || w.Header().Get("Accept-Ranges") != "" {
+		t.Errorf("expected no length or ranges for a compressed response: %v", w.Header())
+	}
+	w = compressGet(router, "/notes.txt", "gzip", "Range", "bytes=0-9")
+	if w.Code != http.StatusPartialContent || w.Header().Get("Content-Encoding") != "" || w.Body.String() != script[:10] {
+		t.Errorf("expected an uncompressed range, got %d %q", w.Code, w.Header().Get("Content-Encoding"))
+	}
+}
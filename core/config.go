@@ -2,9 +2,11 @@ package din
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 var Config config
@@ -14,7 +16,73 @@ type config struct {
 		Addr         string   `json:"addr"`
 		Debug        bool     `json:"debug"`
 		TemplateDirs []string `json:"template_dirs"`
+
+		// the largest request body, in bytes, that will be accepted by
+		// any route that doesn't set its own limit.  Zero means no limit.
+		MaxBodySize int64 `json:"max_body_size"`
+
+		// the number of bytes of a multipart upload that are held in
+		// memory.  Anything larger is spooled to a temporary file.
+		UploadMemory int64 `json:"upload_memory"`
+
+		// whether the server sits behind a proxy that can be trusted to
+		// set X-Forwarded-For.  Without one, the header is ignored, since
+		// clients can put anything they like in it.
+		TrustProxy bool `json:"trust_proxy"`
 	} `json:"core"`
+
+	// options for decoding json request bodies with Request.UnmarshalJSON
+	JSON JSONOptions `json:"json"`
+
+	// options for csrf protection, as performed by the CSRFProtect stage
+	CSRF CSRFOptions `json:"csrf"`
+
+	// site-wide options for cross-origin requests
+	CORS CORSOptions `json:"cors"`
+
+	// headers set by the SecurityHeaders stage
+	Security SecurityOptions `json:"security"`
+
+	// options for compressing responses
+	Compression CompressionOptions `json:"compression"`
+
+	// options for the session cookie and session lifetimes
+	Sessions SessionOptions `json:"sessions"`
+
+	// options for authentication, as performed by LoginRequired and friends
+	Auth AuthOptions `json:"auth"`
+
+	// options for verifying JSON Web Tokens with the JWTAuth stage
+	JWT JWTOptions `json:"jwt"`
+}
+
+// Duration is a time.Duration that can be read from the config file, either
+// as a string understood by time.ParseDuration (e.g., "30m") or as a number of
+// seconds.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch t := v.(type) {
+	case float64:
+		*d = Duration(t * float64(time.Second))
+	case string:
+		parsed, err := time.ParseDuration(t)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+	default:
+		return fmt.Errorf("din: invalid duration %s", b)
+	}
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
 }
 
 func (c *config) parseFile(path string) error {
@@ -0,0 +1,136 @@
+package din
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// browsers are only obliged to store cookies of up to 4096 bytes, counting
+// the name and the value.
+const maxCookieSize = 4096
+
+// ErrSessionTooLarge is returned when a session holds more than can be stored
+// in a cookie by a CookieStore.
+var ErrSessionTooLarge = Error{
+	StatusCode: http.StatusInternalServerError,
+	Message:    "session is too large to be stored in a cookie",
+}
+
+var errCookieSession = errors.New("session cookie could not be decrypted")
+
+// A ClientSessionHandler is a SessionHandler that keeps the session itself,
+// rather than a reference to it, in the session cookie.  Get is given the
+// value of the session cookie, and Encode produces a new value for it.
+// Since the session lives with the client, Set and Delete have nothing to do
+// beyond what they need for bookkeeping of their own.
+type ClientSessionHandler interface {
+	SessionHandler
+	Encode(Session) (string, error)
+}
+
+// CookieStore is a ClientSessionHandler that stores sessions in the session
+// cookie, encrypted and authenticated with AES-GCM, so that sessions can be
+// shared by any number of servers that have the same keys.
+//
+// A CookieStore may be given several keys, so that keys can be rotated: new
+// sessions are always sealed with the first key, but sessions sealed with
+// any of the keys are accepted.  To rotate keys, add a new key to the front
+// of the list, and drop the old key once the sessions sealed with it have
+// expired.
+//
+// A session stored in a cookie cannot be revoked by the server; Delete does
+// nothing, and it's up to the session timeouts to limit how long a stolen
+// cookie is good for.
+type CookieStore struct {
+	// serializes sessions for the cookie.  Defaults to JSONCodec.
+	Codec SessionCodec
+
+	aeads []cipher.AEAD
+}
+
+// NewCookieStore creates a CookieStore from base64-encoded AES keys, as they
+// appear in the keys list of the sessions config.  Each key must decode to
+// 16, 24 or 32 bytes, selecting AES-128, AES-192 or AES-256; 32 random bytes
+// are recommended, e.g., from `openssl rand -base64 32`.
+func NewCookieStore(keys []string) (*CookieStore, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("din: a cookie session store needs at least one key")
+	}
+	c := &CookieStore{aeads: make([]cipher.AEAD, 0, len(keys))}
+	for i, k := range keys {
+		raw, err := base64.StdEncoding.DecodeString(k)
+		if err != nil {
+			return nil, fmt.Errorf("din: session key %d is not valid base64: %v", i, err)
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return nil, fmt.Errorf("din: session key %d: %v", i, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		c.aeads = append(c.aeads, aead)
+	}
+	return c, nil
+}
+
+// Encode seals the session with the first key.  The name of the session
+// cookie is used as additional data, so that a value can't be lifted from
+// some other cookie sealed with the same key and passed off as a session.
+func (c *CookieStore) Encode(s Session) (string, error) {
+	plaintext, err := codecOrDefault(c.Codec).Encode(s)
+	if err != nil {
+		return "", err
+	}
+	aead := c.aeads[0]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	name := Config.Sessions.cookieName()
+	value := base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, []byte(name)))
+	if len(name)+1+len(value) > maxCookieSize {
+		e := ErrSessionTooLarge
+		e.Cause = fmt.Errorf("encoded session is %d bytes", len(value))
+		return "", e
+	}
+	return value, nil
+}
+
+// Get opens the session sealed in the value of a session cookie.
+func (c *CookieStore) Get(value string) (Session, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, ErrInvalidSessionCookie
+	}
+	name := []byte(Config.Sessions.cookieName())
+	for _, aead := range c.aeads {
+		if len(sealed) < aead.NonceSize() {
+			continue
+		}
+		nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+		plaintext, err := aead.Open(nil, nonce, ciphertext, name)
+		if err != nil {
+			continue
+		}
+		return codecOrDefault(c.Codec).Decode(plaintext)
+	}
+	return nil, errCookieSession
+}
+
+// Set does nothing; the session is written to the cookie by Encode.
+func (c *CookieStore) Set(value string, s Session) error {
+	return nil
+}
+
+// Delete does nothing; the session cookie is removed by SessionClear.
+func (c *CookieStore) Delete(value string) error {
+	return nil
+}
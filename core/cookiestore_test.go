@@ -0,0 +1,102 @@
+package din
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32))
+}
+
+func useCookieStore(t *testing.T, keys ...string) func() {
+	store, err := NewCookieStore(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := sessions
+	SetSessionHandler(store)
+	return func() { SetSessionHandler(old) }
+}
+
+func TestCookieStore(t *testing.T) {
+	defer useCookieStore(t, testKey(1))()
+	router := sessionRouter()
+	router.AddRoute("^/big$", "big", func(req *Request) (Response, error) {
+		req.SessionSet("blob", strings.Repeat("x", maxCookieSize))
+		return EmptyResponse(http.StatusNoContent), nil
+	})
+	router.AddRoute("^/logout$", "logout", func(req *Request) (Response, error) {
+		req.SessionClear()
+		return EmptyResponse(http.StatusNoContent), nil
+	})
+
+	cookie := sessionCookie(sessionGet(router, "/set", nil))
+	if cookie == nil {
+		t.Fatal("expected a session cookie")
+	}
+	if strings.Contains(cookie.Value, "bob") {
+		t.Errorf("session cookie is not encrypted: %s", cookie.Value)
+	}
+	if w := sessionGet(router, "/get", cookie); w.Body.String() != "bob" {
+		t.Errorf("expected session value bob, got %q", w.Body.String())
+	}
+
+	tampered := *cookie
+	raw, _ := base64.RawURLEncoding.DecodeString(cookie.Value)
+	raw[len(raw)-1] ^= 1
+	tampered.Value = base64.RawURLEncoding.EncodeToString(raw)
+	if w := sessionGet(router, "/get", &tampered); w.Body.String() == "bob" {
+		t.Errorf("tampered session cookie was accepted")
+	}
+
+	w := sessionGet(router, "/big", cookie)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected oversized session to fail with 500, got %d", w.Code)
+	}
+	if c := sessionCookie(w); c != nil {
+		t.Errorf("oversized session was written to a cookie of %d bytes", len(c.Value))
+	}
+
+	w = sessionGet(router, "/logout", cookie)
+	if c := sessionCookie(w); c == nil || c.MaxAge >= 0 {
+		t.Errorf("expected logout to expire the session cookie, got %v", c)
+	}
+}
+
+func TestCookieStoreKeyRotation(t *testing.T) {
+	router := sessionRouter()
+	restore := useCookieStore(t, testKey(1))
+	cookie := sessionCookie(sessionGet(router, "/set", nil))
+	restore()
+
+	defer useCookieStore(t, testKey(2), testKey(1))()
+	if w := sessionGet(router, "/get", cookie); w.Body.String() != "bob" {
+		t.Errorf("session sealed with a retired key was rejected: %q", w.Body.String())
+	}
+	rotated := sessionCookie(sessionGet(router, "/set", cookie))
+
+	defer useCookieStore(t, testKey(2))()
+	if w := sessionGet(router, "/get", rotated); w.Body.String() != "bob" {
+		t.Errorf("session was not resealed with the new key: %q", w.Body.String())
+	}
+	if w := sessionGet(router, "/get", cookie); w.Body.String() == "bob" {
+		t.Errorf("session sealed with a dropped key was accepted")
+	}
+}
+
+func TestNewCookieStore(t *testing.T) {
+	bad := [][]string{
+		nil,
+		{"not base64!"},
+		{base64.StdEncoding.EncodeToString([]byte("short"))},
+	}
+	for _, keys := range bad {
+		if _, err := NewCookieStore(keys); err == nil {
+			t.Errorf("expected keys %v to be rejected", keys)
+		}
+	}
+}
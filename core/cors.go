@@ -0,0 +1,213 @@
+package din
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSOptions configures cross-origin resource sharing, which lets pages
+// served from other origins call our routes from the browser.  The options in
+// the cors section of the config file apply to every route; a pipeline may
+// replace them with options of its own in routes.json, e.g.:
+//
+//	{"route": "^/api/", "name": "api", "handlers": [...],
+//	 "cors": {"allowed_origins": ["https://*.example.com"], "allow_credentials": true}}
+//
+// CORS is only enabled for routes whose options allow at least one origin,
+// so a pipeline can opt out of the site's CORS options with "cors": {}.
+//
+// CORS does nothing to exempt requests from CSRFProtect; origins that are to
+// make unsafe requests belong in the trusted_origins of the csrf config too.
+type CORSOptions struct {
+	// origins that may make requests, of the form scheme://host[:port].  An
+	// origin may have a wildcard in place of its leading labels, as in
+	// https://*.example.com, which matches any subdomain of example.com (but
+	// not example.com itself), and "*" matches every origin.
+	AllowedOrigins []string `json:"allowed_origins"`
+
+	// methods that may be used, in addition to the simple methods that
+	// browsers don't ask about.  Defaults to GET, HEAD and POST.
+	AllowedMethods []string `json:"allowed_methods"`
+
+	// request headers that may be sent, in addition to those that browsers
+	// don't ask about.  "*" allows any header.
+	AllowedHeaders []string `json:"allowed_headers"`
+
+	// response headers that scripts may read, in addition to the few that
+	// they always may.
+	ExposedHeaders []string `json:"exposed_headers"`
+
+	// whether requests may carry cookies and credentials.  Credentials are
+	// never allowed for the "*" origin, as browsers won't accept them with
+	// it; list the origins that need them.
+	AllowCredentials bool `json:"allow_credentials"`
+
+	// how long browsers may cache the answer to a preflight request.  Zero
+	// leaves it up to the browser, which usually means a few seconds.
+	MaxAge Duration `json:"max_age"`
+}
+
+func (o *CORSOptions) enabled() bool {
+	return o != nil && len(o.AllowedOrigins) > 0
+}
+
+func (o *CORSOptions) methods() []string {
+	if len(o.AllowedMethods) > 0 {
+		return o.AllowedMethods
+	}
+	return []string{"GET", "HEAD", "POST"}
+}
+
+// allowOrigin gives the value of the Access-Control-Allow-Origin header for a
+// request from origin, or "" if the origin isn't allowed.
+func (o *CORSOptions) allowOrigin(origin string) string {
+	for _, allowed := range o.AllowedOrigins {
+		switch {
+		case allowed == "*":
+			if !o.AllowCredentials {
+				return "*"
+			}
+		case strings.EqualFold(allowed, origin):
+			return origin
+		case matchWildcardOrigin(allowed, origin):
+			return origin
+		}
+	}
+	return ""
+}
+
+// matchWildcardOrigin tells us whether origin matches a pattern such as
+// https://*.example.com.  The wildcard stands for one or more labels of a
+// hostname, and nothing else.
+func matchWildcardOrigin(pattern, origin string) bool {
+	i := strings.Index(pattern, "*")
+	if i < 0 {
+		return false
+	}
+	prefix, suffix := strings.ToLower(pattern[:i]), strings.ToLower(pattern[i+1:])
+	origin = strings.ToLower(origin)
+	if !strings.HasPrefix(origin, prefix) || !strings.HasSuffix(origin, suffix) || len(origin) <= len(prefix)+len(suffix) {
+		return false
+	}
+	for _, c := range origin[len(prefix) : len(origin)-len(suffix)] {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+func (o *CORSOptions) allowMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "POST":
+		return true
+	}
+	for _, m := range o.methods() {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowHeaders tells us whether every header named in the
+// Access-Control-Request-Headers of a preflight request may be sent.
+func (o *CORSOptions) allowHeaders(requested string) bool {
+	for _, h := range strings.Split(requested, ",") {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+		ok := false
+		for _, allowed := range o.AllowedHeaders {
+			if allowed == "*" || strings.EqualFold(allowed, h) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// corsOptions gives the CORS options that apply to the request's route, or
+// nil if CORS isn't enabled for it.
+func (r *Request) corsOptions() *CORSOptions {
+	opts := &Config.CORS
+	if r.RouteMatch != nil && r.Pipeline != nil && r.Pipeline.CORS != nil {
+		opts = r.Pipeline.CORS
+	}
+	if !opts.enabled() {
+		return nil
+	}
+	return opts
+}
+
+// isPreflight tells us whether a request is a CORS preflight request, which
+// asks whether the real request may be made, rather than being a request of
+// its own.
+func isPreflight(req *Request) bool {
+	return req.Method == "OPTIONS" && req.Header.Get("Origin") != "" &&
+		req.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// handleCORS adds the CORS headers for a request to its response.  Preflight
+// requests are answered then and there, without troubling the pipeline's
+// stages, in which case handleCORS tells us that the request has been
+// handled.  The CORS headers are set on the request's ResponseHeader, so w
+// must be the router's hookedWriter for them to be sent.
+func (router *Router) handleCORS(w http.ResponseWriter, req *Request) bool {
+	opts := req.corsOptions()
+	if opts == nil {
+		return false
+	}
+	h := req.ResponseHeader()
+	h.Add("Vary", "Origin")
+
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	allowed := opts.allowOrigin(origin)
+
+	if !isPreflight(req) {
+		if allowed == "" {
+			return false
+		}
+		h.Set("Access-Control-Allow-Origin", allowed)
+		if opts.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if len(opts.ExposedHeaders) > 0 {
+			h.Set("Access-Control-Expose-Headers", strings.Join(opts.ExposedHeaders, ", "))
+		}
+		return false
+	}
+
+	// a preflight that we refuse gets an answer without any CORS headers,
+	// which the browser takes as a refusal.
+	h.Add("Vary", "Access-Control-Request-Method")
+	h.Add("Vary", "Access-Control-Request-Headers")
+	method := req.Header.Get("Access-Control-Request-Method")
+	requested := req.Header.Get("Access-Control-Request-Headers")
+	if allowed != "" && opts.allowMethod(method) && opts.allowHeaders(requested) {
+		h.Set("Access-Control-Allow-Origin", allowed)
+		h.Set("Access-Control-Allow-Methods", strings.Join(opts.methods(), ", "))
+		if requested != "" {
+			h.Set("Access-Control-Allow-Headers", requested)
+		}
+		if opts.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if opts.MaxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(time.Duration(opts.MaxAge)/time.Second)))
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	req.LogResponse(http.StatusNoContent)
+	return true
+}
@@ -0,0 +1,126 @@
+package din
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func corsRouter(t *testing.T) *Router {
+	RegisterHandler("testOk", func(req *Request) (Response, error) {
+		return PlaintextResponseString("ok", http.StatusOK), nil
+	})
+	return httpAuthRouter(t, `[
+		{"route": "^/site$", "name": "site", "handlers": ["testOk"]},
+		{"route": "^/api$", "name": "api", "handlers": ["testOk"],
+		 "cors": {"allowed_origins": ["https://app.example.com", "https://*.example.org"], "allowed_methods": ["GET", "PUT", "DELETE"],
+		          "allowed_headers": ["Content-Type", "Authorization"], "exposed_headers": ["X-Total"],
+		          "allow_credentials": true, "max_age": "10m"}},
+		{"route": "^/private$", "name": "private", "handlers": ["testOk"], "cors": {}}
+	]`)
+}
+
+func corsRequest(router *Router, method, path, origin string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestCORS(t *testing.T) {
+	defer func(opts CORSOptions) { Config.CORS = opts }(Config.CORS)
+	Config.CORS = CORSOptions{AllowedOrigins: []string{"*"}}
+	router := corsRouter(t)
+
+	tests := []struct {
+		name        string
+		path        string
+		origin      string
+		allowOrigin string
+	}{
+		{"site wide", "/site", "https://anywhere.test", "*"},
+		{"no origin", "/site", "", ""},
+		{"exact", "/api", "https://app.example.com", "https://app.example.com"},
+		{"wildcard", "/api", "https://a.b.example.org", "https://a.b.example.org"},
+		{"wildcard needs a subdomain", "/api", "https://example.org", ""},
+		{"wildcard is only a hostname", "/api", "https://evil.com/.example.org", ""},
+		{"other origin", "/api", "https://evil.com", ""},
+		{"opted out", "/private", "https://anywhere.test", ""},
+	}
+	for _, test := range tests {
+		w := corsRequest(router, "GET", test.path, test.origin)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: expected the request to be served, got %d", test.name, w.Code)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != test.allowOrigin {
+			t.Errorf("%s: expected Access-Control-Allow-Origin %q, got %q", test.name, test.allowOrigin, got)
+		}
+	}
+
+	w := corsRequest(router, "GET", "/api", "https://app.example.com")
+	if w.Header().Get("Access-Control-Allow-Credentials") != "true" || w.Header().Get("Access-Control-Expose-Headers") != "X-Total" {
+		t.Errorf("missing credentials or exposed headers: %v", w.Header())
+	}
+	if w.Header().Get("Vary") != "Origin" {
+		t.Errorf("expected response to vary by origin, got %q", w.Header().Get("Vary"))
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	router := corsRouter(t)
+
+	w := corsRequest(router, "OPTIONS", "/api", "https://app.example.com",
+		"Access-Control-Request-Method", "PUT",
+		"Access-Control-Request-Headers", "content-type, authorization")
+	if w.Code != http.StatusNoContent || w.Body.Len() != 0 {
+		t.Fatalf("expected an empty 204, got %d %q", w.Code, w.Body.String())
+	}
+	expected := map[string]string{
+		"Access-Control-Allow-Origin":      "https://app.example.com",
+		"Access-Control-Allow-Methods":     "GET, PUT, DELETE",
+		"Access-Control-Allow-Headers":     "content-type, authorization",
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Max-Age":           "600",
+	}
+	for k, v := range expected {
+		if got := w.Header().Get(k); got != v {
+			t.Errorf("expected %s: %q, got %q", k, v, got)
+		}
+	}
+
+	refused := []struct {
+		name    string
+		origin  string
+		headers []string
+	}{
+		{"origin", "https://evil.com", []string{"Access-Control-Request-Method", "PUT"}},
+		{"method", "https://app.example.com", []string{"Access-Control-Request-Method", "PATCH"}},
+		{"header", "https://app.example.com", []string{"Access-Control-Request-Method", "PUT", "Access-Control-Request-Headers", "X-Secret"}},
+	}
+	for _, test := range refused {
+		w := corsRequest(router, "OPTIONS", "/api", test.origin, test.headers...)
+		if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("%s: expected preflight to be refused, got %d %v", test.name, w.Code, w.Header())
+		}
+	}
+
+	// without CORS, an OPTIONS request goes to the pipeline like any other.
+	w = corsRequest(router, "OPTIONS", "/private", "https://app.example.com", "Access-Control-Request-Method", "PUT")
+	if w.Code != http.StatusOK {
+		t.Errorf("expected OPTIONS to reach the pipeline when CORS is off, got %d", w.Code)
+	}
+}
+
+func TestCORSWildcardCredentials(t *testing.T) {
+	opts := &CORSOptions{AllowedOrigins: []string{"*"}, AllowCredentials: true, MaxAge: Duration(time.Minute)}
+	if got := opts.allowOrigin("https://anywhere.test"); got != "" {
+		t.Errorf("expected credentials to be withheld from the * origin, got %q", got)
+	}
+}
@@ -0,0 +1,287 @@
+package din
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"github.com/jordanorelli/din/dinutil"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// CSRFOptions configures csrf protection.  The zero value stores tokens in the
+// session and reads them from the CSRFKey form field or the X-CSRF-Token
+// header.
+type CSRFOptions struct {
+	// name of the form field carrying the token.  Defaults to CSRFKey.
+	FieldName string `json:"field_name"`
+
+	// name of the header carrying the token, for ajax requests.  Defaults to
+	// X-CSRF-Token.
+	HeaderName string `json:"header_name"`
+
+	// store the token in a cookie of its own instead of in the session.  This
+	// is useful for sites that don't otherwise use sessions.
+	UseCookie bool `json:"use_cookie"`
+
+	// name of the cookie holding the token when UseCookie is set.  Defaults to
+	// CSRFKey.
+	CookieName string `json:"cookie_name"`
+
+	// origins other than our own, of the form scheme://host[:port], that are
+	// permitted to submit unsafe requests.
+	TrustedOrigins []string `json:"trusted_origins"`
+}
+
+func (o CSRFOptions) fieldName() string {
+	if o.FieldName != "" {
+		return o.FieldName
+	}
+	return CSRFKey
+}
+
+func (o CSRFOptions) headerName() string {
+	if o.HeaderName != "" {
+		return o.HeaderName
+	}
+	return "X-CSRF-Token"
+}
+
+func (o CSRFOptions) cookieName() string {
+	if o.CookieName != "" {
+		return o.CookieName
+	}
+	return CSRFKey
+}
+
+// number of random bytes in a csrf token.
+const csrfTokenLen = 32
+
+var (
+	errCSRFMissing   = errors.New("csrf token missing from request")
+	errCSRFUnknown   = errors.New("no csrf token has been issued to this client")
+	errCSRFMismatch  = errors.New("csrf token mismatch")
+	errCSRFOrigin    = errors.New("request origin is not trusted")
+	errCSRFNoReferer = errors.New("https request has neither an Origin nor a Referer")
+)
+
+// ErrCSRF is the error rendered when a request fails csrf verification.  The
+// specific reason for the failure is logged as the error's cause.
+var ErrCSRF = Error{
+	StatusCode: http.StatusForbidden,
+	Message:    "csrf verification failed",
+}
+
+// the methods that are defined as not changing anything on the server, and so
+// aren't subject to csrf checks.
+func isSafeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	return false
+}
+
+// CSRFToken returns the csrf token for the client making this request,
+// issuing a new one if the client doesn't have one yet.  Depending on the
+// csrf config, the token lives either in the client's session or in a cookie
+// of its own.  The token is what should be submitted back with unsafe
+// requests; in templates, it is available as {{csrf_token}}.
+//
+// The token is masked afresh each time it's given out, so that it's
+// different in every page even though the client's token stays the same.
+// Otherwise, a page compressed with the token in it would give the token
+// away to an attacker able to put text of their own in the page and watch
+// the size of the response (the BREACH attack).
+func (r *Request) CSRFToken() (string, error) {
+	token, err := r.csrfSecret()
+	if err != nil {
+		return "", err
+	}
+	return maskCSRFToken(token)
+}
+
+// csrfSecret gives the client's csrf token as it was issued, issuing one if
+// need be.
+func (r *Request) csrfSecret() (string, error) {
+	if r.csrfToken != "" {
+		return r.csrfToken, nil
+	}
+	if token := r.issuedCSRFToken(); token != "" {
+		r.csrfToken = token
+		return token, nil
+	}
+
+	token, err := dinutil.SecureToken(csrfTokenLen)
+	if err != nil {
+		return "", err
+	}
+	opts := Config.CSRF
+	if opts.UseCookie {
+		r.SetCookie(&http.Cookie{
+			Name:     opts.cookieName(),
+			Value:    token,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   r.UsingSSL(),
+			SameSite: http.SameSiteLaxMode,
+		})
+	} else {
+		r.SessionSet(CSRFKey, token)
+	}
+	r.csrfToken = token
+	return token, nil
+}
+
+// maskCSRFToken XORs token with a random pad of the same length, giving the
+// pad followed by the result.
+func maskCSRFToken(token string) (string, error) {
+	masked := make([]byte, 2*len(token))
+	pad := masked[:len(token)]
+	if _, err := io.ReadFull(rand.Reader, pad); err != nil {
+		return "", err
+	}
+	for i := range token {
+		masked[len(token)+i] = pad[i] ^ token[i]
+	}
+	return base64.RawURLEncoding.EncodeToString(masked), nil
+}
+
+// unmaskCSRFToken undoes maskCSRFToken.  It gives an empty string for
+// anything that isn't a masked token.
+func unmaskCSRFToken(submitted string) string {
+	masked, err := base64.RawURLEncoding.DecodeString(submitted)
+	if err != nil || len(masked)%2 != 0 {
+		return ""
+	}
+	n := len(masked) / 2
+	token := make([]byte, n)
+	for i := range token {
+		token[i] = masked[i] ^ masked[n+i]
+	}
+	return string(token)
+}
+
+// issuedCSRFToken finds the token that was previously issued to the client,
+// or an empty string if there isn't one.
+func (r *Request) issuedCSRFToken() string {
+	opts := Config.CSRF
+	if opts.UseCookie {
+		cookie, err := r.Cookie(opts.cookieName())
+		if err != nil {
+			return ""
+		}
+		return cookie.Value
+	}
+	var token string
+	if err := r.SessionGet(CSRFKey, &token); err != nil {
+		return ""
+	}
+	return token
+}
+
+// checkCSRFToken compares the token submitted with the request to the one that
+// was issued to the client.  The token may be submitted masked, as given out
+// by CSRFToken, or as it was issued, as when it's read from the csrf cookie.
+func (r *Request) checkCSRFToken() error {
+	opts := Config.CSRF
+	submitted := r.Header.Get(opts.headerName())
+	if submitted == "" {
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+			r.parseMultipart()
+		}
+		submitted = r.PostFormValue(opts.fieldName())
+	}
+	if submitted == "" {
+		return errCSRFMissing
+	}
+	issued := r.issuedCSRFToken()
+	if issued == "" {
+		return errCSRFUnknown
+	}
+	if len(submitted) != len(issued) {
+		submitted = unmaskCSRFToken(submitted)
+	}
+	if subtle.ConstantTimeCompare([]byte(submitted), []byte(issued)) != 1 {
+		return errCSRFMismatch
+	}
+	return nil
+}
+
+// origin gives the scheme://host[:port] that the request was addressed to.
+func (r *Request) origin() string {
+	if r.UsingSSL() || r.TLS != nil {
+		return "https://" + r.Host
+	}
+	return "http://" + r.Host
+}
+
+// checkCSRFOrigin verifies that an unsafe request came from a page served by
+// us (or by a trusted origin).  Browsers send an Origin header with unsafe
+// requests; for those that don't, we fall back to the Referer.  Https
+// requests with neither are rejected, since a Referer is only ever stripped
+// from them by something in between us and the browser.
+func (r *Request) checkCSRFOrigin() error {
+	source := r.Header.Get("Origin")
+	if source == "" {
+		referer := r.Header.Get("Referer")
+		if referer == "" {
+			if r.UsingSSL() || r.TLS != nil {
+				return errCSRFNoReferer
+			}
+			return nil
+		}
+		u, err := url.Parse(referer)
+		if err != nil {
+			return errCSRFOrigin
+		}
+		source = u.Scheme + "://" + u.Host
+	}
+	if strings.EqualFold(source, r.origin()) {
+		return nil
+	}
+	for _, trusted := range Config.CSRF.TrustedOrigins {
+		if strings.EqualFold(source, strings.TrimRight(trusted, "/")) {
+			return nil
+		}
+	}
+	return errCSRFOrigin
+}
+
+// CSRFProtect is a Stage that rejects unsafe requests (anything other than
+// GET, HEAD, OPTIONS or TRACE) that don't come from one of our own pages.  A
+// request passes if its Origin (or Referer) is our own or a trusted origin,
+// and it carries the client's csrf token in either the csrf form field or
+// the csrf header.  Failing requests get ErrCSRF.  Pipelines with
+// csrf_exempt set are let through untouched, which allows CSRFProtect to be
+// installed for every route with Router.Use.  CSRFProtect is registered as
+// a handler under its own name, for use in routes.json.
+func CSRFProtect(req *Request) (Response, error) {
+	if isSafeMethod(req.Method) {
+		return nil, nil
+	}
+	if req.Pipeline != nil && req.Pipeline.CSRFExempt {
+		return nil, nil
+	}
+	if err := req.checkCSRFOrigin(); err != nil {
+		e := ErrCSRF
+		e.Cause = err
+		return nil, e
+	}
+	if err := req.checkCSRFToken(); err != nil {
+		e := ErrCSRF
+		e.Cause = err
+		return nil, e
+	}
+	return nil, nil
+}
+
+func init() {
+	RegisterHandler("CSRFProtect", CSRFProtect)
+	RegisterRequestTemplateFn("csrf_token", func(req *Request) interface{} {
+		return req.CSRFToken
+	})
+}
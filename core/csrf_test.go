@@ -0,0 +1,134 @@
+package din
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func csrfRouter(t *testing.T) *Router {
+	tmpl, err := template.New("form").Funcs(templateFuncs).Parse(`{{csrf_token}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouter(nil, nil)
+	router.Use(CSRFProtect)
+	router.AddRoute("^/form$", "form", func(req *Request) (Response, error) {
+		if req.Method == "POST" {
+			return PlaintextResponseString("ok", http.StatusOK), nil
+		}
+		return &TemplateResponse{Template: tmpl, StatusCode: http.StatusOK}, nil
+	})
+	hook := router.AddRoute("^/hook$", "hook", func(req *Request) (Response, error) {
+		return PlaintextResponseString("ok", http.StatusOK), nil
+	})
+	hook.CSRFExempt = true
+	return router
+}
+
+func TestCSRF(t *testing.T) {
+	router := csrfRouter(t)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/form", nil))
+	token := w.Body.String()
+	cookies := w.Result().Cookies()
+	if w.Code != http.StatusOK || len(token) < 40 || len(cookies) == 0 {
+		t.Fatalf("expected a token and a session cookie, got %d %q %v", w.Code, token, cookies)
+	}
+
+	post := func(path, origin string, form url.Values, header string) int {
+		req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		if header != "" {
+			req.Header.Set("X-CSRF-Token", header)
+		}
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	tests := []struct {
+		desc   string
+		path   string
+		origin string
+		form   url.Values
+		header string
+		status int
+	}{
+		{"form token", "/form", "http://example.com", url.Values{CSRFKey: {token}}, "", http.StatusOK},
+		{"header token", "/form", "http://example.com", nil, token, http.StatusOK},
+		{"no origin over http", "/form", "", url.Values{CSRFKey: {token}}, "", http.StatusOK},
+		{"missing token", "/form", "http://example.com", nil, "", http.StatusForbidden},
+		{"wrong token", "/form", "http://example.com", url.Values{CSRFKey: {token[1:]}}, "", http.StatusForbidden},
+		{"foreign origin", "/form", "http://evil.example", url.Values{CSRFKey: {token}}, "", http.StatusForbidden},
+		{"exempt route", "/hook", "http://evil.example", nil, "", http.StatusOK},
+	}
+	for _, test := range tests {
+		if status := post(test.path, test.origin, test.form, test.header); status != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.desc, test.status, status)
+		}
+	}
+
+	// the token is masked differently in every page, but each of them is
+	// accepted.
+	req := httptest.NewRequest("GET", "/form", nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	again := w.Body.String()
+	if again == token || len(again) != len(token) {
+		t.Errorf("expected the token to be masked afresh, got %q and %q", token, again)
+	}
+	if status := post("/form", "http://example.com", url.Values{CSRFKey: {again}}, ""); status != http.StatusOK {
+		t.Errorf("expected the token from another page to be accepted, got %d", status)
+	}
+	tampered := []byte(again)
+	tampered[len(tampered)/2] ^= 1
+	if status := post("/form", "http://example.com", url.Values{CSRFKey: {string(tampered)}}, ""); status != http.StatusForbidden {
+		t.Errorf("expected a tampered token to be refused, got %d", status)
+	}
+}
+
+func TestCSRFCookie(t *testing.T) {
+	defer func(opts CSRFOptions) { Config.CSRF = opts }(Config.CSRF)
+	Config.CSRF = CSRFOptions{UseCookie: true, CookieName: "csrf"}
+	router := csrfRouter(t)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/form", nil))
+	var cookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "csrf" {
+			cookie = c
+		}
+	}
+	if cookie == nil || !cookie.HttpOnly || unmaskCSRFToken(w.Body.String()) != cookie.Value {
+		t.Fatalf("expected an http-only csrf cookie holding the token, got %v", cookie)
+	}
+	if strings.Contains(w.Body.String(), cookie.Value) {
+		t.Errorf("expected the token in the page to be masked")
+	}
+
+	for _, token := range []string{w.Body.String(), cookie.Value} {
+		req := httptest.NewRequest("POST", "/form", nil)
+		req.Header.Set("X-CSRF-Token", token)
+		req.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("%q: expected cookie-bound token to be accepted, got %d", token, w.Code)
+		}
+	}
+}
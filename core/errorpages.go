@@ -0,0 +1,114 @@
+package din
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+)
+
+// ErrorContext is the value handed to error page templates when rendering a
+// din.Error as html.  Only the user-safe parts of the error are exposed; the
+// error's Cause never makes it into a template.
+type ErrorContext struct {
+	StatusCode int
+	StatusText string
+	Message    string
+	Problem    *Problem
+	Request    *Request
+}
+
+// the error page that is rendered when a project doesn't define its own.  A
+// project may override it for a specific status code by creating a template
+// at errors/<code>.html (e.g., errors/404.html) in one of its template
+// directories, or for every status code by creating errors/error.html.
+var defaultErrorTemplate = template.Must(template.New("din-error").Parse(`<!DOCTYPE html>
+<html>
+  <head>
+    <title>{{.StatusCode}} {{.StatusText}}</title>
+  </head>
+  <body>
+    <h1>{{.StatusCode}} {{.StatusText}}</h1>
+    <p>{{.Message}}</p>
+    {{with .Problem}}{{with .InvalidParams}}
+    <ul>
+      {{range .}}<li><code>{{.Name}}</code>: {{.Reason}}</li>
+      {{end}}
+    </ul>
+    {{end}}{{end}}
+  </body>
+</html>
+`))
+
+// errorTemplate finds the template to be used when rendering an error page for
+// the given status code.  Templates that exist but can't be parsed are logged
+// and skipped, since failing to render an error page would leave the user
+// with nothing at all.
+func errorTemplate(req *Request, code int) *template.Template {
+	for _, relpath := range []string{"errors/" + strconv.Itoa(code) + ".html", "errors/error.html"} {
+		if _, err := locateTemplate(relpath); err != nil {
+			continue
+		}
+		t, err := Template(relpath)
+		if err != nil {
+			req.LogError(err)
+			continue
+		}
+		return t
+	}
+	return defaultErrorTemplate
+}
+
+// renderError writes a din.Error to the client in whatever format it is most
+// willing to accept: an html error page, an RFC 7807 problem document, or
+// plain text.  Clients asking for plain old json get the problem document
+// too.
+func renderError(w http.ResponseWriter, req *Request, e Error) {
+	ctx := ErrorContext{
+		StatusCode: e.StatusCode,
+		StatusText: http.StatusText(e.StatusCode),
+		Message:    e.Message,
+		Problem:    e.Problem,
+		Request:    req,
+	}
+	if ctx.Message == "" {
+		ctx.Message = ctx.StatusText
+	}
+
+	var buf bytes.Buffer
+	contentType := req.Accepts("text/html", ProblemContentType, "application/json", "text/plain")
+	switch contentType {
+	case "text/html":
+		// error pages are rendered like any other TemplateResponse, so that
+		// they get the request's template functions, and so that the cached
+		// template is never executed itself.
+		page := &TemplateResponse{Template: errorTemplate(req, e.StatusCode), Context: ctx}
+		page.bindRequest(req)
+		if err := page.boundTemplate().Execute(&buf, ctx); err != nil {
+			req.LogError(err)
+			buf.Reset()
+			defaultErrorTemplate.Execute(&buf, ctx)
+		}
+		contentType = "text/html; charset=utf-8"
+	case ProblemContentType, "application/json":
+		if err := json.NewEncoder(&buf).Encode(e.Problem.document(e)); err != nil {
+			// most likely an extension that can't be marshaled; the standard
+			// members are always safe.
+			req.LogError(err)
+			buf.Reset()
+			json.NewEncoder(&buf).Encode((*Problem)(nil).document(e))
+		}
+		contentType = ProblemContentType
+	default:
+		fmt.Fprintln(&buf, ctx.Message)
+		contentType = "text/plain; charset=utf-8"
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(e.StatusCode)
+	w.Write(buf.Bytes())
+}
@@ -16,21 +16,68 @@ var (
 		StatusCode: http.StatusBadRequest,
 		Message:    `din: querykey missing`,
 	}
+	ErrNotFound = Error{
+		StatusCode: http.StatusNotFound,
+		Message:    "page not found",
+	}
+	ErrFileNotFound = Error{
+		StatusCode: http.StatusNotFound,
+		Message:    "file not found",
+	}
+	ErrBodyTooLarge = Error{
+		StatusCode: http.StatusRequestEntityTooLarge,
+		Message:    "request body too large",
+	}
+	ErrTimeout = Error{
+		StatusCode: http.StatusGatewayTimeout,
+		Message:    "request timed out",
+	}
 )
 
 // the din.Error type is to be used for errors that can be rendered to be shown
 // to the user.  If a din.Error is the last error in a pipeline, the error's
 // StatusCode will be used to inform the proper HTTP status code.  The message
-// is assumed to be safe to be shown to a user.  (future versions will likely
-// include another unsafe message field for logging, but I haven't gotten there
-// yet.)
+// is assumed to be safe to be shown to a user.  The Cause, on the other hand,
+// is for our eyes only: it is written to the server log alongside the message,
+// but it is never rendered into a response.  An Error may optionally carry a
+// Problem, which gives api clients a machine-readable description of what
+// went wrong.
 type Error struct {
 	StatusCode int
 	Message    string
+	Cause      error
+	Problem    *Problem
 }
 
 func (e Error) Error() string { return e.Message }
 
+// WrapError creates a din.Error that carries cause as its internal-only
+// explanation.  The formatted message is what the user gets to see.
+func WrapError(cause error, code int, format string, vals ...interface{}) error {
+	return Error{
+		StatusCode: code,
+		Message:    fmt.Sprintf(format, vals...),
+		Cause:      cause,
+	}
+}
+
+// asError converts an arbitrary error into a din.Error.  Errors that aren't
+// already din.Errors are assumed to be unsafe to show to the user, so they're
+// tucked away in the Cause field behind a generic 500 message.
+func asError(err error) Error {
+	if e, ok := err.(Error); ok {
+		if e.StatusCode == 0 {
+			e.StatusCode = http.StatusInternalServerError
+		}
+		return e
+	}
+	return Error{
+		StatusCode: http.StatusInternalServerError,
+		Message:    http.StatusText(http.StatusInternalServerError),
+		Cause:      err,
+	}
+}
+
 func InternalServerError(format string, vals ...interface{}) error {
 	return Error{
 		StatusCode: http.StatusInternalServerError,
@@ -0,0 +1,146 @@
+package din
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func errorResponse(accept string, err error) *httptest.ResponseRecorder {
+	raw, _ := http.NewRequest("GET", "/", nil)
+	raw.Header.Set("Accept", accept)
+	w := httptest.NewRecorder()
+	DefaultErrorHandler(w, &Request{Request: raw}, err)
+	return w
+}
+
+func TestErrorNegotiation(t *testing.T) {
+	err := Error{StatusCode: http.StatusNotFound, Message: "no such widget"}
+	tests := []struct {
+		accept      string
+		contentType string
+	}{
+		{"text/html", "text/html; charset=utf-8"},
+		{"application/json", "application/problem+json"},
+		{"application/problem+json", "application/problem+json"},
+		{"text/plain", "text/plain; charset=utf-8"},
+		{"image/png", "text/plain; charset=utf-8"},
+	}
+	for _, test := range tests {
+		w := errorResponse(test.accept, err)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Accept %q: expected status 404, got %d", test.accept, w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != test.contentType {
+			t.Errorf("Accept %q: expected content type %q, got %q", test.accept, test.contentType, ct)
+		}
+		if !strings.Contains(w.Body.String(), "no such widget") {
+			t.Errorf("Accept %q: message missing from body %q", test.accept, w.Body.String())
+		}
+	}
+}
+
+// the cause of an error is for the logs only; it should never make its way
+// into the response.
+func TestErrorCauseHidden(t *testing.T) {
+	secret := errors.New("dial tcp 10.0.0.7:5432: connection refused")
+	for _, err := range []error{WrapError(secret, http.StatusBadGateway, "database unavailable"), secret} {
+		for _, accept := range []string{"text/html", "application/json", "text/plain"} {
+			w := errorResponse(accept, err)
+			if strings.Contains(w.Body.String(), "10.0.0.7") {
+				t.Errorf("Accept %q: error cause leaked into body %q", accept, w.Body.String())
+			}
+		}
+	}
+}
+
+func TestProblemDocument(t *testing.T) {
+	err := ValidationError(
+		InvalidParam{Name: "page", Reason: "must be an integer"},
+		InvalidParam{Name: "per_page", Reason: "out of range"},
+	)
+	err.Problem.Instance = "/widgets"
+	err.Problem.Extensions = map[string]interface{}{"balance": 30, "status": 200}
+
+	w := errorResponse("application/json", err)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", w.Code)
+	}
+	var doc struct {
+		Type          string         `json:"type"`
+		Title         string         `json:"title"`
+		Status        int            `json:"status"`
+		Instance      string         `json:"instance"`
+		Balance       int            `json:"balance"`
+		InvalidParams []InvalidParam `json:"invalid-params"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("unable to parse problem document %q: %v", w.Body.String(), err)
+	}
+	if doc.Type != "about:blank" {
+		t.Errorf("expected type about:blank, got %q", doc.Type)
+	}
+	if doc.Status != http.StatusBadRequest {
+		t.Errorf("extension overrode problem status: got %d", doc.Status)
+	}
+	if doc.Instance != "/widgets" || doc.Balance != 30 {
+		t.Errorf("bad instance or extension in problem document %q", w.Body.String())
+	}
+	if len(doc.InvalidParams) != 2 || doc.InvalidParams[0].Name != "page" || doc.InvalidParams[1].Name != "per_page" {
+		t.Errorf("bad invalid-params in problem document %q", w.Body.String())
+	}
+}
+
+func TestBoundedIntProblem(t *testing.T) {
+	raw, _ := http.NewRequest("GET", "/?count=9000", nil)
+	req := &Request{Request: raw}
+	_, err := req.BoundedInt("count", true, 1, 100)
+	e, ok := err.(Error)
+	if !ok {
+		t.Fatalf("expected a din.Error, got %v", err)
+	}
+	if e.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", e.StatusCode)
+	}
+	if e.Problem == nil || len(e.Problem.InvalidParams) != 1 || e.Problem.InvalidParams[0].Name != "count" {
+		t.Errorf("expected a problem naming the count parameter, got %+v", e.Problem)
+	}
+}
+
+func TestErrorPageTemplateFuncs(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "errors"), 0755)
+	page := `<p>{{.StatusCode}} {{csp_nonce}} {{len flashes}} {{if csrf_token}}signed{{end}}</p>`
+	if err := os.WriteFile(filepath.Join(dir, "errors", "404.html"), []byte(page), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func(dirs []string) { Config.Core.TemplateDirs = dirs }(Config.Core.TemplateDirs)
+	Config.Core.TemplateDirs = []string{dir}
+
+	router := NewRouter(nil, nil)
+	// twice, since rendering the cached template itself would stop it from
+	// being cloned for the next request.
+	for i := 0; i < 2; i++ {
+		w := serve(router, "/nope", "text/html")
+		body := w.Body.String()
+		if w.Code != http.StatusNotFound || !strings.HasPrefix(body, "<p>404 ") || !strings.HasSuffix(body, " 0 signed</p>") {
+			t.Fatalf("expected the error page to have the request's template functions, got %d %q", w.Code, body)
+		}
+		if nonce := strings.Fields(body)[1]; nonce == "" || nonce == "0" {
+			t.Errorf("expected a csp nonce, got %q", body)
+		}
+	}
+
+	res, err := NewTemplateResponse("errors/404.html", ErrorContext{StatusCode: 404}, http.StatusNotFound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.boundTemplate() == res.Template {
+		t.Errorf("expected the cached error template to still be clonable")
+	}
+}
@@ -0,0 +1,369 @@
+package din
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrPreconditionFailed is the error given to conditional requests whose
+// If-Match or If-Unmodified-Since conditions don't hold, typically because
+// somebody else has changed the resource since the client last saw it.
+var ErrPreconditionFailed = Error{
+	StatusCode: http.StatusPreconditionFailed,
+	Message:    "precondition failed",
+}
+
+// StrongETag makes a strong entity tag from an opaque value, which must not
+// contain double quotes.  A strong ETag promises that two responses with the
+// same tag are identical, byte for byte.
+func StrongETag(v string) string {
+	return `"` + v + `"`
+}
+
+// WeakETag makes a weak entity tag from an opaque value, which must not
+// contain double quotes.  A weak ETag only promises that two responses with
+// the same tag are equivalent, e.g., the same page rendered at different
+// times.
+func WeakETag(v string) string {
+	return `W/"` + v + `"`
+}
+
+// An ETagResponse is a Response that declares its entity tag, as made by
+// StrongETag or WeakETag, so that the router can answer conditional requests
+// for it.
+type ETagResponse interface {
+	Response
+	ETag() string
+}
+
+// A LastModifiedResponse is a Response that declares when the resource it
+// represents last changed, so that the router can answer conditional
+// requests for it.
+type LastModifiedResponse interface {
+	Response
+	LastModified() time.Time
+}
+
+// validatedResponse attaches validators to a Response that doesn't declare
+// any of its own.
+type validatedResponse struct {
+	Response
+	etag    string
+	modtime time.Time
+}
+
+func (v *validatedResponse) ETag() string {
+	if v.etag == "" {
+		if e, ok := v.Response.(ETagResponse); ok {
+			return e.ETag()
+		}
+	}
+	return v.etag
+}
+
+func (v *validatedResponse) LastModified() time.Time {
+	if v.modtime.IsZero() {
+		if m, ok := v.Response.(LastModifiedResponse); ok {
+			return m.LastModified()
+		}
+	}
+	return v.modtime
+}
+
+func (v *validatedResponse) bindRequest(req *Request) {
+	if b, ok := v.Response.(requestBinder); ok {
+		b.bindRequest(req)
+	}
+}
+
+func (v *validatedResponse) Render(w http.ResponseWriter) error {
+	setValidators(w.Header(), v.ETag(), v.LastModified())
+	return v.Response.Render(w)
+}
+
+// WithETag attaches an entity tag, as made by StrongETag or WeakETag, to a
+// response.  An ETag that isn't quoted is taken to be a strong one.
+func WithETag(res Response, etag string) Response {
+	if !strings.HasPrefix(etag, `"`) && !strings.HasPrefix(etag, `W/"`) {
+		etag = StrongETag(etag)
+	}
+	if v, ok := res.(*validatedResponse); ok {
+		v.etag = etag
+		return v
+	}
+	return &validatedResponse{Response: res, etag: etag}
+}
+
+// WithLastModified attaches the time at which the resource last changed to a
+// response.
+func WithLastModified(res Response, modtime time.Time) Response {
+	if v, ok := res.(*validatedResponse); ok {
+		v.modtime = modtime
+		return v
+	}
+	return &validatedResponse{Response: res, modtime: modtime}
+}
+
+// hashedResponse is a Response whose ETag is computed from its rendered
+// body.  It has to be rendered into a buffer before its ETag is known.
+type hashedResponse struct {
+	Response
+	rendered bool
+	header   http.Header
+	code     int
+	body     bytes.Buffer
+	etag     string
+}
+
+// HashETag gives a response a strong ETag computed from the hash of its
+// body, for responses that have no cheaper way of telling whether they've
+// changed.  The response is still rendered on every request, but the body is
+// only sent to clients that don't already have it.
+func HashETag(res Response) Response {
+	return &hashedResponse{Response: res, header: make(http.Header)}
+}
+
+func (h *hashedResponse) bindRequest(req *Request) {
+	if b, ok := h.Response.(requestBinder); ok {
+		b.bindRequest(req)
+	}
+}
+
+func (h *hashedResponse) Header() http.Header { return h.header }
+
+func (h *hashedResponse) WriteHeader(code int) {
+	if h.code == 0 {
+		h.code = code
+	}
+}
+
+func (h *hashedResponse) Write(b []byte) (int, error) {
+	h.WriteHeader(http.StatusOK)
+	return h.body.Write(b)
+}
+
+// render renders the underlying response into the buffer, once.
+func (h *hashedResponse) render() error {
+	if h.rendered {
+		return nil
+	}
+	h.rendered = true
+	if err := h.Response.Render(h); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(h.body.Bytes())
+	h.etag = StrongETag(base64.RawURLEncoding.EncodeToString(sum[:18]))
+	return nil
+}
+
+func (h *hashedResponse) ETag() string {
+	if err := h.render(); err != nil {
+		return ""
+	}
+	return h.etag
+}
+
+func (h *hashedResponse) Render(w http.ResponseWriter) error {
+	if err := h.render(); err != nil {
+		return err
+	}
+	dst := w.Header()
+	for k, v := range h.header {
+		dst[k] = append(dst[k], v...)
+	}
+	dst.Set("ETag", h.etag)
+	if h.code == 0 {
+		h.code = http.StatusOK
+	}
+	w.WriteHeader(h.code)
+	_, err := w.Write(h.body.Bytes())
+	return err
+}
+
+func (h *hashedResponse) Status() int {
+	if h.rendered && h.code != 0 {
+		return h.code
+	}
+	return h.Response.Status()
+}
+
+// responseValidators gives whatever validators a response declares.
+func responseValidators(res Response) (etag string, modtime time.Time) {
+	if e, ok := res.(ETagResponse); ok {
+		etag = e.ETag()
+	}
+	if m, ok := res.(LastModifiedResponse); ok {
+		modtime = m.LastModified()
+	}
+	return etag, modtime
+}
+
+func setValidators(h http.Header, etag string, modtime time.Time) {
+	if etag != "" {
+		h.Set("ETag", etag)
+	}
+	if !modtime.IsZero() {
+		h.Set("Last-Modified", modtime.UTC().Format(http.TimeFormat))
+	}
+}
+
+// Preconditions evaluates the conditional headers of the request (If-Match,
+// If-None-Match, If-Modified-Since and If-Unmodified-Since) against the
+// current validators of the resource it's about; either may be left empty.
+// It gives a 304 Response if the client's copy is current, and
+// ErrPreconditionFailed if a condition on changing the resource doesn't hold.
+// Otherwise it gives nil and nil, and the request should be carried out.
+//
+// The router evaluates the conditions for GET and HEAD requests whose
+// responses declare validators on its own.  Handlers for requests that change
+// things, such as PUT or DELETE, should call Preconditions themselves before
+// changing anything, so that one client doesn't overwrite changes that it
+// hasn't seen:
+//
+//	if res, err := req.Preconditions(doc.ETag(), doc.Modified); res != nil || err != nil {
+//		return res, err
+//	}
+func (r *Request) Preconditions(etag string, modtime time.Time) (Response, error) {
+	switch checkPreconditions(r.Request, etag, modtime) {
+	case http.StatusNotModified:
+		return &notModifiedResponse{etag: etag, modtime: modtime}, nil
+	case http.StatusPreconditionFailed:
+		return nil, ErrPreconditionFailed
+	}
+	return nil, nil
+}
+
+type notModifiedResponse struct {
+	etag    string
+	modtime time.Time
+}
+
+func (n *notModifiedResponse) Render(w http.ResponseWriter) error {
+	setValidators(w.Header(), n.etag, n.modtime)
+	w.WriteHeader(http.StatusNotModified)
+	return nil
+}
+
+func (n *notModifiedResponse) Status() int { return http.StatusNotModified }
+
+// conditional answers a GET or HEAD request with a 304 or an error, if its
+// conditional headers say that the response it would otherwise get isn't
+// wanted.  It gives a nil Response and a nil error if the response should be
+// sent as it is.
+func conditional(req *Request, res Response) (Response, error) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return nil, nil
+	}
+	if code := res.Status(); code != 0 && (code < 200 || code > 299) {
+		return nil, nil
+	}
+	etag, modtime := responseValidators(res)
+	if etag == "" && modtime.IsZero() {
+		return nil, nil
+	}
+	return req.Preconditions(etag, modtime)
+}
+
+// checkPreconditions evaluates the conditional headers of a request in the
+// order given by RFC 9110, section 13.2.2.  It gives 0 if the request should
+// be carried out, or the status it should be answered with instead.
+func checkPreconditions(r *http.Request, etag string, modtime time.Time) int {
+	if im := r.Header.Get("If-Match"); im != "" {
+		if !etagListMatch(im, etag, false) {
+			return http.StatusPreconditionFailed
+		}
+	} else if ius := r.Header.Get("If-Unmodified-Since"); ius != "" && !modtime.IsZero() {
+		if t, err := http.ParseTime(ius); err == nil && modtime.Truncate(time.Second).After(t) {
+			return http.StatusPreconditionFailed
+		}
+	}
+
+	safe := r.Method == "GET" || r.Method == "HEAD"
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if etagListMatch(inm, etag, true) {
+			if safe {
+				return http.StatusNotModified
+			}
+			return http.StatusPreconditionFailed
+		}
+	} else if ims := r.Header.Get("If-Modified-Since"); ims != "" && safe && !modtime.IsZero() {
+		if t, err := http.ParseTime(ims); err == nil && !modtime.Truncate(time.Second).After(t) {
+			return http.StatusNotModified
+		}
+	}
+	return 0
+}
+
+// checkIfRange tells us whether the ranges of a request with an If-Range
+// header should be honored: only if the client's copy, which it names by its
+// ETag or modification time, is still current.  Otherwise the client gets
+// the whole thing.
+func checkIfRange(r *http.Request, etag string, modtime time.Time) bool {
+	ir := r.Header.Get("If-Range")
+	if ir == "" {
+		return true
+	}
+	if strings.HasPrefix(ir, `"`) || strings.HasPrefix(ir, `W/"`) {
+		return etagStrongMatch(ir, etag)
+	}
+	t, err := http.ParseTime(ir)
+	return err == nil && !modtime.IsZero() && modtime.Truncate(time.Second).Equal(t)
+}
+
+// etagListMatch tells us whether etag is in a list of entity tags from an
+// If-Match or If-None-Match header, or the list is "*" and there's a current
+// representation, which is assumed to be the case.  If-None-Match uses the
+// weak comparison, in which W/"x" matches "x", and If-Match uses the strong
+// comparison, in which weak tags match nothing.
+func etagListMatch(list, etag string, weak bool) bool {
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+	if etag == "" {
+		return false
+	}
+	for _, candidate := range splitETags(list) {
+		if weak && strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+		if !weak && etagStrongMatch(candidate, etag) {
+			return true
+		}
+	}
+	return false
+}
+
+func etagStrongMatch(a, b string) bool {
+	return a == b && strings.HasPrefix(a, `"`)
+}
+
+// splitETags splits a comma-separated list of entity tags.  Commas are
+// allowed inside the quotes of an entity tag, so this can't be done with
+// strings.Split.
+func splitETags(list string) []string {
+	var tags []string
+	for {
+		list = strings.TrimLeft(list, " \t,")
+		if list == "" {
+			return tags
+		}
+		start := 0
+		if strings.HasPrefix(list, "W/") {
+			start = 2
+		}
+		if len(list) <= start || list[start] != '"' {
+			return tags
+		}
+		end := strings.IndexByte(list[start+1:], '"')
+		if end < 0 {
+			return tags
+		}
+		end += start + 2
+		tags = append(tags, list[:end])
+		list = list[end:]
+	}
+}
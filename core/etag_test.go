@@ -0,0 +1,162 @@
+package din
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func etagRouter(t *testing.T) *Router {
+	modified := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	RegisterHandler("testETag", func(req *Request) (Response, error) {
+		return WithETag(PlaintextResponseString("version one", http.StatusOK), "v1"), nil
+	})
+	RegisterHandler("testHashETag", func(req *Request) (Response, error) {
+		return HashETag(PlaintextResponseString("hash me", http.StatusOK)), nil
+	})
+	RegisterHandler("testModified", func(req *Request) (Response, error) {
+		return WithLastModified(PlaintextResponseString("old news", http.StatusOK), modified), nil
+	})
+	RegisterHandler("testPut", func(req *Request) (Response, error) {
+		if res, err := req.Preconditions(`"v1"`, modified); res != nil || err != nil {
+			return res, err
+		}
+		return EmptyResponse(http.StatusNoContent), nil
+	})
+	return httpAuthRouter(t, `[
+		{"route": "^/etag$", "name": "etag", "handlers": ["testETag"]},
+		{"route": "^/hash$", "name": "hash", "handlers": ["testHashETag"]},
+		{"route": "^/modified$", "name": "modified", "handlers": ["testModified"]},
+		{"route": "^/put$", "name": "put", "handlers": ["testPut"]}
+	]`)
+}
+
+func conditionalRequest(router *Router, method, path string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestConditionalRequests(t *testing.T) {
+	router := etagRouter(t)
+
+	w := conditionalRequest(router, "GET", "/hash")
+	hashed := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || !strings.HasPrefix(hashed, `"`) || w.Body.String() != "hash me" {
+		t.Fatalf("expected a hashed ETag, got %d %q", w.Code, hashed)
+	}
+
+	tests := []struct {
+		method  string
+		path    string
+		headers []string
+		status  int
+	}{
+		{"GET", "/etag", nil, http.StatusOK},
+		{"GET", "/etag", []string{"If-None-Match", `"v1"`}, http.StatusNotModified},
+		{"GET", "/etag", []string{"If-None-Match", `W/"v1"`}, http.StatusNotModified},
+		{"GET", "/etag", []string{"If-None-Match", `"v0", "v1"`}, http.StatusNotModified},
+		{"GET", "/etag", []string{"If-None-Match", `"v0"`}, http.StatusOK},
+		{"GET", "/etag", []string{"If-None-Match", `*`}, http.StatusNotModified},
+		{"GET", "/etag", []string{"If-Match", `"v1"`}, http.StatusOK},
+		{"GET", "/etag", []string{"If-Match", `W/"v1"`}, http.StatusPreconditionFailed},
+		{"GET", "/etag", []string{"If-Match", `"v2"`}, http.StatusPreconditionFailed},
+		{"HEAD", "/etag", []string{"If-None-Match", `"v1"`}, http.StatusNotModified},
+		{"GET", "/hash", []string{"If-None-Match", hashed}, http.StatusNotModified},
+		{"GET", "/modified", []string{"If-Modified-Since", "Sun, 01 Mar 2020 12:00:00 GMT"}, http.StatusNotModified},
+		{"GET", "/modified", []string{"If-Modified-Since", "Sun, 01 Mar 2020 11:59:59 GMT"}, http.StatusOK},
+		{"GET", "/modified", []string{"If-Unmodified-Since", "Sun, 01 Mar 2020 11:00:00 GMT"}, http.StatusPreconditionFailed},
+		// If-None-Match takes precedence over If-Modified-Since.
+		{"GET", "/modified", []string{"If-None-Match", `"x"`, "If-Modified-Since", "Sun, 01 Mar 2020 12:00:00 GMT"}, http.StatusOK},
+		{"PUT", "/put", nil, http.StatusNoContent},
+		{"PUT", "/put", []string{"If-Match", `"v1"`}, http.StatusNoContent},
+		{"PUT", "/put", []string{"If-Match", `"v0"`}, http.StatusPreconditionFailed},
+		{"PUT", "/put", []string{"If-None-Match", `*`}, http.StatusPreconditionFailed},
+		{"PUT", "/put", []string{"If-Unmodified-Since", "Sun, 01 Mar 2020 12:00:00 GMT"}, http.StatusNoContent},
+	}
+	for _, test := range tests {
+		w := conditionalRequest(router, test.method, test.path, test.headers...)
+		if w.Code != test.status {
+			t.Errorf("%s %s %v: expected %d, got %d", test.method, test.path, test.headers, test.status, w.Code)
+			continue
+		}
+		if test.status == http.StatusNotModified {
+			if w.Body.Len() != 0 {
+				t.Errorf("%s %s %v: expected no body with a 304, got %q", test.method, test.path, test.headers, w.Body.String())
+			}
+			if w.Header().Get("ETag") == "" && w.Header().Get("Last-Modified") == "" {
+				t.Errorf("%s %s %v: expected validators with a 304", test.method, test.path, test.headers)
+			}
+		}
+	}
+}
+
+func TestStaticConditionalRequests(t *testing.T) {
+	defer func(root string) { StaticRoot = root }(StaticRoot)
+	StaticRoot = t.TempDir()
+	if err := os.WriteFile(filepath.Join(StaticRoot, "data.bin"), []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouter(nil, nil)
+
+	w := conditionalRequest(router, "GET", "/data.bin")
+	etag, modified := w.Header().Get("ETag"), w.Header().Get("Last-Modified")
+	if w.Code != http.StatusOK || etag == "" || modified == "" {
+		t.Fatalf("expected validators, got %d %v", w.Code, w.Header())
+	}
+
+	tests := []struct {
+		headers []string
+		status  int
+		body    string
+	}{
+		{[]string{"If-None-Match", etag}, http.StatusNotModified, ""},
+		{[]string{"If-Modified-Since", modified}, http.StatusNotModified, ""},
+		{[]string{"If-Match", `"nope"`}, http.StatusPreconditionFailed, ""},
+		{[]string{"If-Match", etag, "Range", "bytes=2-4"}, http.StatusPartialContent, "234"},
+		{[]string{"If-Range", etag, "Range", "bytes=2-4"}, http.StatusPartialContent, "234"},
+		{[]string{"If-Range", modified, "Range", "bytes=2-4"}, http.StatusPartialContent, "234"},
+		{[]string{"If-Range", `"stale"`, "Range", "bytes=2-4"}, http.StatusOK, "0123456789"},
+		{[]string{"If-Range", "Sun, 01 Mar 2020 12:00:00 GMT", "Range", "bytes=2-4"}, http.StatusOK, "0123456789"},
+	}
+	for _, test := range tests {
+		w := conditionalRequest(router, "GET", "/data.bin", test.headers...)
+		if w.Code != test.status {
+			t.Errorf("%v: expected %d, got %d", test.headers, test.status, w.Code)
+			continue
+		}
+		if test.body != "" && w.Body.String() != test.body {
+			t.Errorf("%v: expected %q, got %q", test.headers, test.body, w.Body.String())
+		}
+	}
+
+	// a failed precondition is rendered like any other error.
+	w = conditionalRequest(router, "GET", "/data.bin", "If-Match", `"nope"`, "Accept", ProblemContentType)
+	if w.Code != http.StatusPreconditionFailed || w.Header().Get("Content-Type") != ProblemContentType {
+		t.Errorf("expected a problem document with the 412, got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	if err := os.WriteFile(filepath.Join(StaticRoot, "data.bin.gz"), []byte("not really gzip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w = conditionalRequest(router, "GET", "/data.bin", "If-Match", `"nope"`, "Accept-Encoding", "gzip")
+	if w.Code != http.StatusPreconditionFailed || w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("expected an uncompressed 412, got %d %q", w.Code, w.Header().Get("Content-Encoding"))
+	}
+}
+
+func TestSplitETags(t *testing.T) {
+	got := splitETags(`"a", W/"b,c" ,"d"`)
+	want := []string{`"a"`, `W/"b,c"`, `"d"`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
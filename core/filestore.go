@@ -0,0 +1,257 @@
+package din
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// name of the lock file that a FileStore keeps in its directory.
+const fileStoreLock = ".lock"
+
+// FileStore is a SessionHandler that keeps each session in a file of its own
+// under a directory, so that sessions survive a restart of the server, and
+// can be shared by several server processes on the same machine (or on
+// machines sharing the directory over a filesystem that supports locking).
+// Sessions are written to a temporary file that is then renamed over the old
+// one, so that a reader never sees a partially written session, and access to
+// the directory is coordinated between processes with a lock file.
+type FileStore struct {
+	// serializes sessions for the session files.  Defaults to JSONCodec.
+	Codec SessionCodec
+
+	dir    string
+	ttl    time.Duration
+	done   chan struct{}
+	closer sync.Once
+}
+
+// the contents of a session file.
+type sessionFile struct {
+	Expires int64  `json:"expires"`
+	Data    []byte `json:"data"`
+}
+
+// NewFileStore creates a FileStore keeping sessions in dir, which is created
+// if it doesn't exist, and starts a background sweeper that removes expired
+// session files until the store is closed.  A zero ttl is taken from the
+// sessions config.
+func NewFileStore(dir string, ttl time.Duration) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	f := &FileStore{dir: dir, ttl: ttl, done: make(chan struct{})}
+	go f.sweeper(defaultSweepInterval)
+	return f, nil
+}
+
+func (f *FileStore) getTTL() time.Duration {
+	if f.ttl > 0 {
+		return f.ttl
+	}
+	return Config.Sessions.storeTTL()
+}
+
+// path gives the path of the file holding the session with the given id.
+// Files are named by a hash of the id, so that the id can't be used to
+// escape the directory, and so that the session ids themselves aren't
+// exposed to anybody that can list the directory.
+func (f *FileStore) path(id string) string {
+	return filepath.Join(f.dir, hashSessionId(id))
+}
+
+// lock takes the store's lock file, shared or exclusive, returning the
+// function that releases it.
+func (f *FileStore) lock(exclusive bool) (func(), error) {
+	fi, err := os.OpenFile(filepath.Join(f.dir, fileStoreLock), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	unlock, err := lockFile(fi, exclusive)
+	if err != nil {
+		fi.Close()
+		return nil, err
+	}
+	return func() {
+		unlock()
+		fi.Close()
+	}, nil
+}
+
+func (f *FileStore) Get(id string) (Session, error) {
+	unlock, err := f.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return f.read(id)
+}
+
+func (f *FileStore) Set(id string, s Session) error {
+	unlock, err := f.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return f.write(id, s)
+}
+
+// Touch reads the session back and writes it out again with its access time
+// updated, holding the lock throughout, so that nothing written in between
+// is lost.
+func (f *FileStore) Touch(id string, accessed time.Time) error {
+	unlock, err := f.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	s, err := f.read(id)
+	if err != nil {
+		return err
+	}
+	s.setTimestamp(sessionAccessedKey, accessed)
+	return f.write(id, s)
+}
+
+// read reads the session stored under id.  It must be called with the lock
+// held.
+func (f *FileStore) read(id string) (Session, error) {
+	raw, err := os.ReadFile(f.path(id))
+	if os.IsNotExist(err) {
+		return nil, ErrUnknownSessionId
+	}
+	if err != nil {
+		return nil, err
+	}
+	var sf sessionFile
+	if err := json.Unmarshal(raw, &sf); err != nil {
+		return nil, err
+	}
+	if time.Now().Unix() > sf.Expires {
+		return nil, ErrUnknownSessionId
+	}
+	return codecOrDefault(f.Codec).Decode(sf.Data)
+}
+
+// write stores the session under id.  It must be called with the exclusive
+// lock held.
+func (f *FileStore) write(id string, s Session) error {
+	data, err := codecOrDefault(f.Codec).Encode(s)
+	if err != nil {
+		return err
+	}
+	raw, err := json.Marshal(sessionFile{
+		Expires: time.Now().Add(f.getTTL()).Unix(),
+		Data:    data,
+	})
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(f.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), f.path(id))
+}
+
+func (f *FileStore) Delete(id string) error {
+	unlock, err := f.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := os.Remove(f.path(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Close stops the store's background sweeper.
+func (f *FileStore) Close() error {
+	f.closer.Do(func() { close(f.done) })
+	return nil
+}
+
+// sweep removes the files of sessions that expired before now.  The
+// directory is listed and each file read without the lock, so that sessions
+// can be used while a large directory is swept; the lock is only taken to
+// remove a file, which is read again first in case it was refreshed in the
+// meantime.
+func (f *FileStore) sweep(now time.Time) error {
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(f.dir, entry.Name())
+		if !sessionFileExpired(path, now) {
+			continue
+		}
+		unlock, err := f.lock(true)
+		if err != nil {
+			return err
+		}
+		if sessionFileExpired(path, now) {
+			os.Remove(path)
+		}
+		unlock()
+	}
+	return nil
+}
+
+// sessionFileExpired tells us whether the session file at path expired
+// before now.  Files that can't be parsed count as expired, and files that
+// can't be read (most likely because they've already been removed) don't.
+func sessionFileExpired(path string, now time.Time) bool {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	var sf sessionFile
+	return json.Unmarshal(raw, &sf) != nil || now.Unix() > sf.Expires
+}
+
+func (f *FileStore) sweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			f.sweep(now)
+		case <-f.done:
+			return
+		}
+	}
+}
+
+// hashSessionId gives the name under which a durable session store files a
+// session.  Stores that persist sessions store them under a hash of the
+// session id, so that whoever can read the store can't use what they find
+// there to hijack sessions.
+func hashSessionId(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
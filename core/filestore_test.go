@@ -0,0 +1,134 @@
+package din
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sessionStoreTests puts a durable session store through its paces.  expire
+// should make the session stored under the given id look as if it had
+// expired.
+func sessionStoreTests(t *testing.T, store SessionHandler, expire func(id string)) {
+	if _, err := store.Get("missing"); err != ErrUnknownSessionId {
+		t.Errorf("expected ErrUnknownSessionId for a missing session, got %v", err)
+	}
+
+	if err := store.Set("a", Session{"name": "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Set("a", Session{"name": "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	s, err := store.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s["name"] != "alice" {
+		t.Errorf("expected the latest session to be stored, got %v", s["name"])
+	}
+
+	if err := store.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("a"); err != ErrUnknownSessionId {
+		t.Errorf("expected ErrUnknownSessionId after delete, got %v", err)
+	}
+	if err := store.Delete("a"); err != nil {
+		t.Errorf("deleting a missing session failed: %v", err)
+	}
+
+	store.Set("old", Session{})
+	expire("old")
+	if _, err := store.Get("old"); err != ErrUnknownSessionId {
+		t.Errorf("expected ErrUnknownSessionId for an expired session, got %v", err)
+	}
+
+	if toucher, ok := store.(SessionToucher); ok {
+		accessed := time.Unix(1700000000, 0)
+		store.Set("touched", Session{"name": "carol"})
+		if err := toucher.Touch("touched", accessed); err != nil {
+			t.Fatal(err)
+		}
+		s, err := store.Get("touched")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := s.timestamp(sessionAccessedKey); s["name"] != "carol" || !got.Equal(accessed) {
+			t.Errorf("expected a touch to update only the access time, got %v", s)
+		}
+		store.Delete("touched")
+		if err := toucher.Touch("touched", accessed); err != ErrUnknownSessionId {
+			t.Errorf("expected ErrUnknownSessionId touching a missing session, got %v", err)
+		}
+		if _, err := store.Get("touched"); err != ErrUnknownSessionId {
+			t.Errorf("touching a missing session created it")
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if err := store.Set("shared", Session{"n": float64(i)}); err != nil {
+					t.Errorf("concurrent set failed: %v", err)
+				}
+				if _, err := store.Get("shared"); err != nil {
+					t.Errorf("concurrent get failed: %v", err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	sessionStoreTests(t, store, func(id string) {
+		raw, _ := json.Marshal(sessionFile{Expires: time.Now().Add(-time.Hour).Unix()})
+		os.WriteFile(store.path(id), raw, 0600)
+	})
+
+	store.sweep(time.Now())
+	if _, err := os.Stat(store.path("old")); !os.IsNotExist(err) {
+		t.Errorf("expired session file was not swept")
+	}
+	if _, err := os.Stat(store.path("shared")); err != nil {
+		t.Errorf("live session file was swept: %v", err)
+	}
+	leftovers, _ := filepath.Glob(filepath.Join(dir, ".tmp-*"))
+	if len(leftovers) > 0 {
+		t.Errorf("temporary files were left behind: %v", leftovers)
+	}
+	if _, err := os.Stat(filepath.Join(dir, hashSessionId("shared"))); err != nil {
+		t.Errorf("session file is not named for the hash of its id: %v", err)
+	}
+
+	// a sweep that has nothing to remove doesn't wait on sessions in use.
+	unlock, err := store.lock(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	swept := make(chan struct{})
+	go func() {
+		store.sweep(time.Now())
+		close(swept)
+	}()
+	select {
+	case <-swept:
+	case <-time.After(time.Second):
+		t.Errorf("sweep blocked on a session that was being read")
+	}
+}
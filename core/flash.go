@@ -0,0 +1,56 @@
+package din
+
+// session key under which flash messages wait to be shown.
+const flashKey = "_din_flashes"
+
+// Levels of flash message.  These are only conventions; any level may be
+// used, e.g., as a css class when the flashes are rendered.
+const (
+	FlashInfo    = "info"
+	FlashSuccess = "success"
+	FlashWarning = "warning"
+	FlashError   = "error"
+)
+
+// A Flash is a one-time message to the user, such as "your changes have been
+// saved", to be shown on the next page they see.
+type Flash struct {
+	Level   string `json:"level"`
+	Message string `json:"message"`
+}
+
+// Flash stores a message in the client's session, to be shown by whichever
+// request calls Flashes next, typically the page that the client is
+// redirected to.  A session is started if the client doesn't have one.
+func (r *Request) Flash(level, msg string) {
+	var flashes []Flash
+	r.SessionGet(flashKey, &flashes)
+	r.SessionSet(flashKey, append(flashes, Flash{Level: level, Message: msg}))
+}
+
+// Flashes gives the flash messages waiting in the client's session, in the
+// order in which they were added, and removes them from the session so that
+// they're only shown once.  Repeated calls in the same request give the same
+// messages, so that a handler can look at the flashes without keeping them
+// from being rendered by its template.  In templates, the flashes are
+// available as {{flashes}}, e.g.:
+//
+//	{{range flashes}}<p class="{{.Level}}">{{.Message}}</p>{{end}}
+func (r *Request) Flashes() []Flash {
+	if r.flashesRead {
+		return r.flashes
+	}
+	r.flashesRead = true
+	if err := r.SessionGet(flashKey, &r.flashes); err != nil {
+		return nil
+	}
+	r.sessionDelete(flashKey)
+	return r.flashes
+}
+
+func init() {
+	RegisterSessionType([]Flash(nil))
+	RegisterRequestTemplateFn("flashes", func(req *Request) interface{} {
+		return req.Flashes
+	})
+}
@@ -0,0 +1,66 @@
+package din
+
+import (
+	"html/template"
+	"net/http"
+	"testing"
+)
+
+func flashRouter(t *testing.T) *Router {
+	tmpl, err := template.New("page").Funcs(templateFuncs).Parse(`{{range flashes}}[{{.Level}}:{{.Message}}]{{end}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouter(nil, nil)
+	router.AddRoute("^/save$", "save", func(req *Request) (Response, error) {
+		req.Flash(FlashSuccess, "saved")
+		req.Flash(FlashWarning, "but <carefully>")
+		return Redirect(req, "/page", http.StatusSeeOther), nil
+	})
+	router.AddRoute("^/page$", "page", func(req *Request) (Response, error) {
+		req.Flashes()
+		return &TemplateResponse{Template: tmpl, StatusCode: http.StatusOK}, nil
+	})
+	return router
+}
+
+func testFlashes(t *testing.T, router *Router) {
+	w := sessionGet(router, "/save", nil)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("expected a redirect, got %d", w.Code)
+	}
+	cookie := sessionCookie(w)
+	if cookie == nil {
+		t.Fatal("expected flashing to start a session")
+	}
+
+	w = sessionGet(router, "/page", cookie)
+	want := "[success:saved][warning:but &lt;carefully&gt;]"
+	if w.Body.String() != want {
+		t.Errorf("expected flashes %q, got %q", want, w.Body.String())
+	}
+	if c := sessionCookie(w); c != nil {
+		cookie = c
+	}
+
+	if w := sessionGet(router, "/page", cookie); w.Body.String() != "" {
+		t.Errorf("flashes were shown twice: %q", w.Body.String())
+	}
+}
+
+func TestFlash(t *testing.T) {
+	testFlashes(t, flashRouter(t))
+}
+
+func TestFlashCookieStore(t *testing.T) {
+	defer useCookieStore(t, testKey(1))()
+	testFlashes(t, flashRouter(t))
+}
+
+func TestFlashNoSession(t *testing.T) {
+	router := flashRouter(t)
+	w := sessionGet(router, "/page", nil)
+	if w.Body.String() != "" || sessionCookie(w) != nil {
+		t.Errorf("reading flashes without a session should do nothing, got %q %v", w.Body.String(), sessionCookie(w))
+	}
+}
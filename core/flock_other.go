@@ -0,0 +1,23 @@
+//go:build !unix
+
+package din
+
+import (
+	"os"
+	"sync"
+)
+
+// without flock (on windows, the standard library doesn't give us LockFileEx),
+// the best we can do is to keep the goroutines of a single process from
+// stepping on each other, so a directory of sessions should not be shared
+// between processes on these platforms.
+var fileLocks sync.RWMutex
+
+func lockFile(f *os.File, exclusive bool) (func(), error) {
+	if exclusive {
+		fileLocks.Lock()
+		return fileLocks.Unlock, nil
+	}
+	fileLocks.RLock()
+	return fileLocks.RUnlock, nil
+}
@@ -1,12 +1,66 @@
 package din
 
+import (
+	"fmt"
+	"strings"
+)
+
 var handlerRegistry = make(map[string]Stage, 20)
 
+// a StageFactory builds a Stage from the arguments given to it in
+// routes.json, where a handler written as "Name(a, b)" is built by the factory
+// registered as Name, with the arguments "a" and "b".
+type StageFactory func(args ...string) (Stage, error)
+
+var factoryRegistry = make(map[string]StageFactory, 10)
+
 func RegisterHandler(name string, stage Stage) {
 	handlerRegistry[name] = stage
 }
 
-func getHandler(name string) (Stage, bool) {
-	stage, ok := handlerRegistry[name]
-	return stage, ok
+// RegisterHandlerFactory registers a factory of stages that take arguments,
+// so that the stages can be named, along with their arguments, in the
+// handlers of a route in routes.json.
+func RegisterHandlerFactory(name string, factory StageFactory) {
+	factoryRegistry[name] = factory
+}
+
+// getHandler finds the stage for a handler named in routes.json: either the
+// name of a registered handler, or a call to a registered factory.
+func getHandler(name string) (Stage, error) {
+	if stage, ok := handlerRegistry[name]; ok {
+		return stage, nil
+	}
+	fname, args, ok := parseHandlerCall(name)
+	if !ok {
+		return nil, ErrUnknownHandler(name)
+	}
+	factory, ok := factoryRegistry[fname]
+	if !ok {
+		return nil, ErrUnknownHandler(fname)
+	}
+	stage, err := factory(args...)
+	if err != nil {
+		return nil, fmt.Errorf("bad handler %s: %v", name, err)
+	}
+	return stage, nil
+}
+
+// parseHandlerCall splits a handler of the form "Name(a, b)" into its name
+// and arguments.
+func parseHandlerCall(s string) (string, []string, bool) {
+	open := strings.IndexByte(s, '(')
+	if open < 1 || !strings.HasSuffix(s, ")") {
+		return "", nil, false
+	}
+	name := strings.TrimSpace(s[:open])
+	inner := strings.TrimSpace(s[open+1 : len(s)-1])
+	if inner == "" {
+		return name, nil, true
+	}
+	args := strings.Split(inner, ",")
+	for i := range args {
+		args[i] = strings.TrimSpace(args[i])
+	}
+	return name, args, true
 }
@@ -0,0 +1,369 @@
+package din
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/jordanorelli/din/dinutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NamedUser is a User known only by name, such as one authenticated with
+// HTTP Basic auth against an htpasswd file, or with a bearer token.  It has
+// no permissions.
+type NamedUser string
+
+func (u NamedUser) UserId() string {
+	return string(u)
+}
+
+func (u NamedUser) HasPermission(perm string) bool {
+	return false
+}
+
+// challenge fails a request for lack of credentials, telling the client how
+// to authenticate with a WWW-Authenticate header, as required of a 401.
+func challenge(req *Request, scheme, realm string, params ...string) error {
+	parts := append([]string{"realm=" + strconv.Quote(realm)}, params...)
+	req.ResponseHeader().Set("WWW-Authenticate", scheme+" "+strings.Join(parts, ", "))
+	return ErrUnauthorized
+}
+
+// BasicAuth creates a Stage that requires HTTP Basic auth.  check is given
+// the name and password sent by the client, and gives the User they
+// identify, or nil if they're wrong.  Requests without the right credentials
+// are turned away with a 401 and a challenge for the realm.  Htpasswd.Check
+// will do as a check function.
+//
+// BasicAuth is also registered as a handler in two forms, for use in
+// routes.json: "BasicAuth" checks against the htpasswd file and realm in the
+// auth config, and "BasicAuth(realm, path)" checks against the htpasswd file
+// at path.
+func BasicAuth(realm string, check func(name, password string) (User, error)) Stage {
+	return func(req *Request) (Response, error) {
+		name, password, ok := req.BasicAuth()
+		if !ok {
+			return nil, challenge(req, "Basic", realm, `charset="UTF-8"`)
+		}
+		u, err := check(name, password)
+		if err != nil {
+			return nil, err
+		}
+		if u == nil {
+			return nil, challenge(req, "Basic", realm, `charset="UTF-8"`)
+		}
+		req.user = u
+		req.authenticated = true
+		return nil, nil
+	}
+}
+
+// BearerFunc creates a Stage that requires a bearer token, as described in
+// RFC 6750.  lookup is given the token sent by the client, and gives the User
+// it identifies, or nil if it's no good.  Requests without a token, or with
+// a bad one, are turned away with a 401 and a challenge for the realm.
+func BearerFunc(realm string, lookup func(token string) (User, error)) Stage {
+	return func(req *Request) (Response, error) {
+		token, ok := bearerToken(req)
+		if !ok {
+			return nil, challenge(req, "Bearer", realm)
+		}
+		u, err := lookup(token)
+		if err != nil {
+			return nil, err
+		}
+		if u == nil {
+			return nil, challenge(req, "Bearer", realm, `error="invalid_token"`)
+		}
+		req.user = u
+		req.authenticated = true
+		return nil, nil
+	}
+}
+
+// bearerToken gives the token in a request's Authorization header, if it
+// carries one.
+func bearerToken(req *Request) (string, bool) {
+	auth := req.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return "", false
+	}
+	token := strings.TrimSpace(auth[7:])
+	return token, token != ""
+}
+
+// BearerTokens creates a bearer token Stage that accepts a fixed set of
+// tokens, given as a map of tokens to the names of the users they identify.
+// Tokens are compared by their sha256 hashes, so that the time taken to find
+// a token gives nothing away about the tokens we have.
+//
+// "BearerTokens" is registered as a handler that accepts the bearer_tokens in
+// the auth config, for use in routes.json.
+func BearerTokens(realm string, tokens map[string]string) Stage {
+	hashed := make(map[[sha256.Size]byte]NamedUser, len(tokens))
+	for token, name := range tokens {
+		hashed[sha256.Sum256([]byte(token))] = NamedUser(name)
+	}
+	return BearerFunc(realm, func(token string) (User, error) {
+		if u, ok := hashed[sha256.Sum256([]byte(token))]; ok {
+			return u, nil
+		}
+		return nil, nil
+	})
+}
+
+// Htpasswd checks passwords against a file in the format used by Apache's
+// htpasswd: one name:hash pair per line.  Hashes may be apr1 ($apr1$), the
+// htpasswd default; SHA-1 ({SHA}), which is weak, and is only supported for
+// the sake of old files; or din's own pbkdf2 ($pbkdf2-sha256$), as made by
+// dinutil.HashPassword.  bcrypt hashes are not supported.  The file is read
+// again whenever it changes.
+type Htpasswd struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	users   map[string]string
+}
+
+// LoadHtpasswd reads the htpasswd file at path.
+func LoadHtpasswd(path string) (*Htpasswd, error) {
+	h := &Htpasswd{path: path}
+	if err := h.reload(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// reload rereads the file if it has changed since it was last read.  It
+// must be called with the lock held.
+func (h *Htpasswd) reload() error {
+	info, err := os.Stat(h.path)
+	if err != nil {
+		return err
+	}
+	if h.users != nil && info.ModTime().Equal(h.modTime) {
+		return nil
+	}
+	users, err := parseHtpasswd(h.path)
+	if err != nil {
+		return err
+	}
+	h.users, h.modTime = users, info.ModTime()
+	return nil
+}
+
+func parseHtpasswd(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, hash, ok := strings.Cut(line, ":")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("%s:%d: expected name:hash", path, n)
+		}
+		switch {
+		case strings.HasPrefix(hash, "$apr1$"), strings.HasPrefix(hash, "{SHA}"), strings.HasPrefix(hash, "$pbkdf2-sha256$"):
+		case strings.HasPrefix(hash, "$2"):
+			return nil, fmt.Errorf("%s:%d: bcrypt hashes are not supported", path, n)
+		default:
+			return nil, fmt.Errorf("%s:%d: unrecognized password hash", path, n)
+		}
+		users[name] = hash
+	}
+	return users, scanner.Err()
+}
+
+// Check gives the user with the given name if the password is theirs, and
+// nil otherwise.  Its signature is that of the check function of BasicAuth.
+func (h *Htpasswd) Check(name, password string) (User, error) {
+	h.mu.Lock()
+	if err := h.reload(); err != nil {
+		h.mu.Unlock()
+		return nil, err
+	}
+	hash, ok := h.users[name]
+	h.mu.Unlock()
+
+	if ok && checkHtpasswdHash(hash, password) {
+		return NamedUser(name), nil
+	}
+	return nil, nil
+}
+
+func checkHtpasswdHash(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt := strings.TrimPrefix(hash, "$apr1$")
+		if i := strings.IndexByte(salt, '$'); i >= 0 {
+			salt = salt[:i]
+		}
+		return subtle.ConstantTimeCompare([]byte(apr1(password, salt)), []byte(hash)) == 1
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		computed := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1
+	case strings.HasPrefix(hash, "$pbkdf2-sha256$"):
+		ok, err := dinutil.CheckPassword(hash, password)
+		return err == nil && ok
+	}
+	return false
+}
+
+// apr1 computes Apache's variant of the md5-crypt password hash, as used by
+// htpasswd.  This follows apr_md5.c.
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.Sum([]byte(password + salt + password))
+	ctx := md5.New()
+	ctx.Write([]byte(password + magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			ctx.Write(alt[:])
+		} else {
+			ctx.Write(alt[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	final := ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		ctx := md5.New()
+		if i&1 != 0 {
+			ctx.Write(pw)
+		} else {
+			ctx.Write(final)
+		}
+		if i%3 != 0 {
+			ctx.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			ctx.Write(pw)
+		}
+		if i&1 != 0 {
+			ctx.Write(final)
+		} else {
+			ctx.Write(pw)
+		}
+		final = ctx.Sum(nil)
+	}
+
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	var out []byte
+	to64 := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out = append(out, itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		to64(uint32(final[g[0]])<<16|uint32(final[g[1]])<<8|uint32(final[g[2]]), 4)
+	}
+	to64(uint32(final[11]), 2)
+	return magic + salt + "$" + string(out)
+}
+
+// htpasswd files named in routes.json and the auth config, loaded once each.
+var htpasswdFiles = struct {
+	sync.Mutex
+	byPath map[string]*Htpasswd
+}{byPath: make(map[string]*Htpasswd)}
+
+func loadHtpasswdFile(path string) (*Htpasswd, error) {
+	htpasswdFiles.Lock()
+	defer htpasswdFiles.Unlock()
+	if h, ok := htpasswdFiles.byPath[path]; ok {
+		return h, nil
+	}
+	h, err := LoadHtpasswd(path)
+	if err != nil {
+		return nil, err
+	}
+	htpasswdFiles.byPath[path] = h
+	return h, nil
+}
+
+func (o AuthOptions) realm() string {
+	if o.Realm != "" {
+		return o.Realm
+	}
+	return "din"
+}
+
+// configBasicAuth is the "BasicAuth" handler.  The routes file is read before
+// the config file, so the htpasswd file named in the config is only loaded
+// when the first request comes in.
+func configBasicAuth(req *Request) (Response, error) {
+	if Config.Auth.Htpasswd == "" {
+		return nil, errors.New("din: BasicAuth needs an htpasswd file in the auth config")
+	}
+	h, err := loadHtpasswdFile(Config.Auth.Htpasswd)
+	if err != nil {
+		return nil, err
+	}
+	return BasicAuth(Config.Auth.realm(), h.Check)(req)
+}
+
+// the Stage built from the bearer_tokens in the auth config by
+// configureAuth, so that the tokens are hashed once rather than on every
+// request.
+var configTokens Stage
+
+// configureAuth prepares the parts of the auth config that are used on every
+// request.  It's called once the config file has been read; changes made to
+// the config after that aren't seen until it's called again.
+func configureAuth() {
+	configTokens = BearerTokens(Config.Auth.realm(), Config.Auth.BearerTokens)
+}
+
+// configBearerTokens is the "BearerTokens" handler.
+func configBearerTokens(req *Request) (Response, error) {
+	if configTokens == nil {
+		return nil, errors.New("din: BearerTokens used before the auth config was loaded")
+	}
+	return configTokens(req)
+}
+
+func init() {
+	RegisterHandler("BasicAuth", configBasicAuth)
+	RegisterHandler("BearerTokens", configBearerTokens)
+	RegisterHandlerFactory("BasicAuth", func(args ...string) (Stage, error) {
+		if len(args) != 2 {
+			return nil, errors.New("BasicAuth takes a realm and the path of an htpasswd file")
+		}
+		h, err := loadHtpasswdFile(args[1])
+		if err != nil {
+			return nil, err
+		}
+		return BasicAuth(args[0], h.Check), nil
+	})
+}
@@ -0,0 +1,198 @@
+package din
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jordanorelli/din/dinutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestApr1(t *testing.T) {
+	// from `openssl passwd -apr1 -salt <salt> <password>`
+	tests := []struct{ password, salt, hash string }{
+		{"hunter2", "r31.....", "$apr1$r31.....$plRWvy3XbzxRYaBWYhhQm/"},
+		{"a much longer password than sixteen", "abcdefgh", "$apr1$abcdefgh$CWmSdRXg6.q2WlUC6/oKv1"},
+	}
+	for _, test := range tests {
+		if hash := apr1(test.password, test.salt); hash != test.hash {
+			t.Errorf("apr1(%q, %q): expected %s, got %s", test.password, test.salt, test.hash, hash)
+		}
+	}
+}
+
+func writeHtpasswd(t *testing.T) string {
+	defer func(n int) { dinutil.PasswordIterations = n }(dinutil.PasswordIterations)
+	dinutil.PasswordIterations = 1000
+	pbkdf2, err := dinutil.HashPassword("s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	contents := fmt.Sprintf(`# admins
+bob:$apr1$r31.....$plRWvy3XbzxRYaBWYhhQm/
+carol:{SHA}87u9ZqY9S/F0eUBXjsPQEDUw4h0=
+alice:%s
+`, pbkdf2)
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func httpAuthRouter(t *testing.T, routes string) *Router {
+	RegisterHandler("testWhoami", func(req *Request) (Response, error) {
+		return PlaintextResponseString(req.User().UserId(), http.StatusOK), nil
+	})
+	var pipelines []*Pipeline
+	if err := json.Unmarshal([]byte(routes), &pipelines); err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouter(nil, nil)
+	router.routes = pipelines
+	return router
+}
+
+func TestBasicAuth(t *testing.T) {
+	path := writeHtpasswd(t)
+	router := httpAuthRouter(t, fmt.Sprintf(`[
+		{"route": "^/admin$", "name": "admin", "handlers": ["BasicAuth(admin area, %s)", "testWhoami"]}
+	]`, path))
+
+	tests := []struct {
+		user, password string
+		status         int
+	}{
+		{"bob", "hunter2", http.StatusOK},
+		{"carol", "hunter2", http.StatusOK},
+		{"alice", "s3cret", http.StatusOK},
+		{"bob", "s3cret", http.StatusUnauthorized},
+		{"dave", "hunter2", http.StatusUnauthorized},
+		{"", "", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/admin", nil)
+		if test.user != "" {
+			req.SetBasicAuth(test.user, test.password)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("%s:%s: expected %d, got %d", test.user, test.password, test.status, w.Code)
+			continue
+		}
+		if test.status == http.StatusOK && w.Body.String() != test.user {
+			t.Errorf("expected to be authenticated as %s, got %q", test.user, w.Body.String())
+		}
+		if test.status == http.StatusUnauthorized {
+			if h := w.Header().Get("WWW-Authenticate"); h != `Basic realm="admin area", charset="UTF-8"` {
+				t.Errorf("bad challenge: %q", h)
+			}
+		}
+	}
+}
+
+func TestHtpasswdReload(t *testing.T) {
+	path := writeHtpasswd(t)
+	h, err := LoadHtpasswd(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := h.Check("bob", "hunter2"); u == nil {
+		t.Fatal("expected bob to be accepted")
+	}
+
+	if err := os.WriteFile(path, []byte("carol:{SHA}87u9ZqY9S/F0eUBXjsPQEDUw4h0=\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path, later, later)
+	if u, _ := h.Check("bob", "hunter2"); u != nil {
+		t.Errorf("expected bob to be gone after the file changed")
+	}
+	if u, _ := h.Check("carol", "hunter2"); u == nil {
+		t.Errorf("expected carol to be accepted after the file changed")
+	}
+
+	if err := os.WriteFile(path, []byte("bob:$2y$05$abcdefghijklmnopqrstuv\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadHtpasswd(path); err == nil {
+		t.Errorf("expected bcrypt hashes to be refused")
+	}
+}
+
+func TestBearerAuth(t *testing.T) {
+	defer func(opts AuthOptions) {
+		Config.Auth = opts
+		configureAuth()
+	}(Config.Auth)
+	Config.Auth.Realm = "api"
+	Config.Auth.BearerTokens = map[string]string{"t0ken": "deploy-bot"}
+	configureAuth()
+	RegisterHandler("testBearerFunc", BearerFunc("api", func(token string) (User, error) {
+		if token == "dynamic" {
+			return NamedUser("dyn"), nil
+		}
+		return nil, nil
+	}))
+	router := httpAuthRouter(t, `[
+		{"route": "^/static$", "name": "static", "handlers": ["BearerTokens", "testWhoami"]},
+		{"route": "^/func$", "name": "func", "handlers": ["testBearerFunc", "testWhoami"]}
+	]`)
+
+	tests := []struct {
+		path, auth string
+		status     int
+		body       string
+		challenge  string
+	}{
+		{"/static", "Bearer t0ken", http.StatusOK, "deploy-bot", ""},
+		{"/static", "bearer t0ken", http.StatusOK, "deploy-bot", ""},
+		{"/static", "Bearer nope", http.StatusUnauthorized, "", `Bearer realm="api", error="invalid_token"`},
+		{"/static", "", http.StatusUnauthorized, "", `Bearer realm="api"`},
+		{"/static", "Basic Ym9iOmh1bnRlcjI=", http.StatusUnauthorized, "", `Bearer realm="api"`},
+		{"/func", "Bearer dynamic", http.StatusOK, "dyn", ""},
+		{"/func", "Bearer t0ken", http.StatusUnauthorized, "", `Bearer realm="api", error="invalid_token"`},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.path, nil)
+		if test.auth != "" {
+			req.Header.Set("Authorization", test.auth)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("%s %q: expected %d, got %d", test.path, test.auth, test.status, w.Code)
+			continue
+		}
+		if test.body != "" && w.Body.String() != test.body {
+			t.Errorf("%s %q: expected %q, got %q", test.path, test.auth, test.body, w.Body.String())
+		}
+		if h := w.Header().Get("WWW-Authenticate"); h != test.challenge {
+			t.Errorf("%s %q: expected challenge %q, got %q", test.path, test.auth, test.challenge, h)
+		}
+	}
+
+	// the configured tokens are hashed once, when the config is loaded, and
+	// again when it's reloaded.
+	bearer := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/static", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	Config.Auth.BearerTokens = map[string]string{"n3w": "new-bot"}
+	configureAuth()
+	if w := bearer("n3w"); w.Code != http.StatusOK || w.Body.String() != "new-bot" {
+		t.Errorf("expected a token from the new config to be accepted, got %d %q", w.Code, w.Body.String())
+	}
+	if w := bearer("t0ken"); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a token dropped from the config to be refused, got %d", w.Code)
+	}
+}
@@ -0,0 +1,226 @@
+package din
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// JSONOptions controls how strictly a json request body is decoded.  The zero
+// value is as forgiving as encoding/json itself.
+type JSONOptions struct {
+	// reject objects with keys that don't correspond to any field of the
+	// destination.
+	DisallowUnknownFields bool `json:"disallow_unknown_fields"`
+
+	// reject bodies that contain anything other than whitespace after the
+	// first json value.
+	SingleValue bool `json:"single_value"`
+
+	// the largest body, in bytes, that will be decoded.  Zero means no limit
+	// beyond any max_body_size that is in effect for the route.
+	MaxBytes int64 `json:"max_bytes"`
+
+	// reject requests whose Content-Type isn't application/json or one of
+	// its +json relatives.
+	RequireContentType bool `json:"require_content_type"`
+}
+
+// errJSONTooLarge is returned by a jsonBodyReader that has been asked to read
+// beyond its limit.
+var errJSONTooLarge = errors.New("json body exceeds max_bytes")
+
+// jsonBodyReader counts the bytes read from a request body, so that errors
+// that encoding/json reports without an offset can be given one.  If limit is
+// positive, it also acts like io.LimitReader, except that it distinguishes
+// between a body that ends exactly at the limit and one that keeps going.
+type jsonBodyReader struct {
+	r     io.Reader
+	limit int64
+	n     int64
+}
+
+func (b *jsonBodyReader) Read(p []byte) (int, error) {
+	if b.limit > 0 {
+		if b.n >= b.limit {
+			var extra [1]byte
+			if n, _ := b.r.Read(extra[:]); n > 0 {
+				return 0, errJSONTooLarge
+			}
+			return 0, io.EOF
+		}
+		if int64(len(p)) > b.limit-b.n {
+			p = p[:b.limit-b.n]
+		}
+	}
+	n, err := b.r.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// isJSONContentType tells us whether a Content-Type header describes json.
+func isJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// DecodeJSON decodes the request body as json into v, according to opts.
+// Failures are reported as din.Errors with an RFC 7807 problem attached.
+// Wherever possible, the message names the byte offset in the body at which
+// decoding failed, and the path of the field that was being decoded, e.g.,
+// "items.price".  Bodies that are too large get a 413, bodies that aren't
+// json get a 415, and everything else gets a 400.
+func (r *Request) DecodeJSON(v interface{}, opts JSONOptions) error {
+	if opts.RequireContentType && !isJSONContentType(r.Header.Get("Content-Type")) {
+		return Error{
+			StatusCode: http.StatusUnsupportedMediaType,
+			Message:    "expected a request body of type application/json",
+		}
+	}
+	if r.Body == nil {
+		return jsonError(nil, 0, "empty json body")
+	}
+
+	body := &jsonBodyReader{r: r.Body, limit: opts.MaxBytes}
+	var src io.Reader = body
+	var raw bytes.Buffer
+	if opts.DisallowUnknownFields {
+		// a copy of what the decoder reads is kept, so that a failure can
+		// be told apart from the others by decoding it again without the
+		// restriction.
+		src = io.TeeReader(body, &raw)
+	}
+	dec := json.NewDecoder(src)
+	if opts.DisallowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+
+	if err := dec.Decode(v); err != nil {
+		offset := dec.InputOffset()
+		if err == io.ErrUnexpectedEOF {
+			offset = body.n
+		}
+		if opts.DisallowUnknownFields && decodesLoosely(raw.Bytes(), v) {
+			return unknownFieldError(err, offset)
+		}
+		return decodeError(err, offset)
+	}
+	if opts.SingleValue {
+		offset := dec.InputOffset()
+		if _, err := dec.Token(); err != io.EOF {
+			if err == errJSONTooLarge {
+				return decodeError(err, offset)
+			}
+			return jsonError(err, offset, fmt.Sprintf("unexpected data after json value at byte offset %d", offset))
+		}
+	}
+	return nil
+}
+
+// decodeError translates an error from encoding/json into a din.Error.
+// offset is how far into the body the decoder had gotten when it gave up,
+// which is used for errors that don't carry an offset of their own.
+func decodeError(err error, offset int64) error {
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		return jsonError(err, e.Offset, fmt.Sprintf("invalid json at byte offset %d: %s", e.Offset, strings.TrimPrefix(e.Error(), "json: ")))
+	case *json.UnmarshalTypeError:
+		reason := "must be " + jsonTypeName(e.Type)
+		if e.Field == "" {
+			return jsonError(err, e.Offset, fmt.Sprintf("json body at byte offset %d %s", e.Offset, reason))
+		}
+		verr := jsonError(err, e.Offset, fmt.Sprintf("invalid value for field %s at byte offset %d: %s", e.Field, e.Offset, reason))
+		verr.Problem.InvalidParams = []InvalidParam{{Name: e.Field, Reason: reason}}
+		return verr
+	case *json.InvalidUnmarshalError:
+		return InternalServerError("unable to decode json")
+	}
+
+	switch {
+	case err == io.EOF:
+		return jsonError(err, offset, "empty json body")
+	case err == io.ErrUnexpectedEOF:
+		return jsonError(err, offset, fmt.Sprintf("unexpected end of json input at byte offset %d", offset))
+	case err == errJSONTooLarge:
+		e := ErrBodyTooLarge
+		e.Cause = err
+		return e
+	}
+	return bodyError(err, "invalid json input")
+}
+
+// decodesLoosely tells us whether the first json value in data can be decoded
+// into a fresh value of the type that v points to when unknown fields are
+// allowed, which, when decoding with DisallowUnknownFields failed, means
+// that an unknown field was the only problem.
+func decodesLoosely(data []byte, v interface{}) bool {
+	t := reflect.TypeOf(v)
+	if t == nil || t.Kind() != reflect.Ptr {
+		return false
+	}
+	return json.NewDecoder(bytes.NewReader(data)).Decode(reflect.New(t.Elem()).Interface()) == nil
+}
+
+// unknownFieldError reports a json object with a key that doesn't correspond
+// to any field of the destination.  encoding/json doesn't export a type for
+// this error, so the name of the field is taken from its message where that
+// has the expected form, and left out otherwise.
+func unknownFieldError(err error, offset int64) Error {
+	const prefix = "json: unknown field "
+	if msg := err.Error(); strings.HasPrefix(msg, prefix) {
+		if field, uerr := strconv.Unquote(strings.TrimPrefix(msg, prefix)); uerr == nil {
+			verr := jsonError(err, offset, fmt.Sprintf("unknown field %q at byte offset %d", field, offset))
+			verr.Problem.InvalidParams = []InvalidParam{{Name: field, Reason: "unknown field"}}
+			return verr
+		}
+	}
+	return jsonError(err, offset, fmt.Sprintf("unknown field at byte offset %d", offset))
+}
+
+// jsonError creates the 400 error for a json body that couldn't be decoded.
+// The offset is included in the problem document, for clients that want to
+// point at the offending part of their request.
+func jsonError(cause error, offset int64, msg string) Error {
+	return Error{
+		StatusCode: http.StatusBadRequest,
+		Message:    msg,
+		Cause:      cause,
+		Problem: &Problem{
+			Title:      "invalid json input",
+			Extensions: map[string]interface{}{"offset": offset},
+		},
+	}
+}
+
+// jsonTypeName describes a Go type in terms of the json value that would be
+// needed to fill it, for use in error messages shown to api clients.
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.String:
+		return "a string"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	case reflect.Ptr:
+		return jsonTypeName(t.Elem())
+	}
+	return "a " + t.String()
+}
@@ -0,0 +1,107 @@
+package din
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+type jsonItem struct {
+	Price float64 `json:"price"`
+}
+
+type jsonOrder struct {
+	Name  string     `json:"name"`
+	Items []jsonItem `json:"items"`
+}
+
+var strictJSON = JSONOptions{
+	DisallowUnknownFields: true,
+	SingleValue:           true,
+	MaxBytes:              64,
+	RequireContentType:    true,
+}
+
+var decodeTests = []struct {
+	contentType string
+	body        string
+	status      int
+	message     string
+}{
+	{"application/json", `{"name": "x", "items": [{"price": 1.5}]}`, 0, ""},
+	{"application/vnd.api+json; charset=utf-8", `{"name": "x"}  `, 0, ""},
+	{"text/plain", `{"name": "x"}`, http.StatusUnsupportedMediaType, "application/json"},
+	{"application/json", ``, http.StatusBadRequest, "empty json body"},
+	{"application/json", `{"name": "x",}`, http.StatusBadRequest, "invalid json at byte offset 14"},
+	{"application/json", `{"name": "x"`, http.StatusBadRequest, "unexpected end of json input at byte offset 12"},
+	{"application/json", `{"items": [{"price": "free"}]}`, http.StatusBadRequest, "price at byte offset 27: must be a number"},
+	{"application/json", `{"name": "x", "nmae": "y"}`, http.StatusBadRequest, `unknown field "nmae"`},
+	{"application/json", `{"name": "x"} {"name": "y"}`, http.StatusBadRequest, "unexpected data after json value at byte offset 13"},
+	{"application/json", `{"name": "` + strings.Repeat("x", 64) + `"}`, http.StatusRequestEntityTooLarge, ""},
+	{"application/json", `{"name": "x"}` + strings.Repeat(" ", 51) + `{}`, http.StatusRequestEntityTooLarge, ""},
+}
+
+func TestDecodeJSON(t *testing.T) {
+	for i, test := range decodeTests {
+		raw, _ := http.NewRequest("POST", "/", strings.NewReader(test.body))
+		raw.Header.Set("Content-Type", test.contentType)
+		req := &Request{Request: raw}
+
+		var order jsonOrder
+		err := req.DecodeJSON(&order, strictJSON)
+		if test.status == 0 {
+			if err != nil {
+				t.Errorf("test %d: unexpected error: %v", i, err)
+			}
+			continue
+		}
+		e, ok := err.(Error)
+		if !ok {
+			t.Errorf("test %d: expected a din.Error, got %v", i, err)
+			continue
+		}
+		if e.StatusCode != test.status {
+			t.Errorf("test %d: expected status %d, got %d (%v)", i, test.status, e.StatusCode, err)
+		}
+		if !strings.Contains(e.Message, test.message) {
+			t.Errorf("test %d: expected message containing %q, got %q", i, test.message, e.Message)
+		}
+	}
+}
+
+// unknownFieldError takes the name of the field from encoding/json's message,
+// so a change to that message should show up here first.
+func TestUnknownFieldMessage(t *testing.T) {
+	dec := json.NewDecoder(strings.NewReader(`{"name": "x", "nmae": "y"}`))
+	dec.DisallowUnknownFields()
+	var order jsonOrder
+	err := dec.Decode(&order)
+	if err == nil || err.Error() != `json: unknown field "nmae"` {
+		t.Fatalf("encoding/json changed its unknown field message: %v", err)
+	}
+	e := unknownFieldError(err, 26)
+	if e.Problem == nil || len(e.Problem.InvalidParams) != 1 || e.Problem.InvalidParams[0].Name != "nmae" {
+		t.Errorf("expected the unknown field to be named, got %+v", e.Problem)
+	}
+}
+
+// jsonPicky fails to unmarshal with an error that has no type of its own.
+type jsonPicky struct{}
+
+func (*jsonPicky) UnmarshalJSON([]byte) error {
+	return errors.New("picky: no thanks")
+}
+
+func TestDecodeJSONUnmarshalerError(t *testing.T) {
+	raw, _ := http.NewRequest("POST", "/", strings.NewReader(`{"picky": 1}`))
+	req := &Request{Request: raw}
+	var dest struct {
+		Picky jsonPicky `json:"picky"`
+	}
+	err := req.DecodeJSON(&dest, JSONOptions{DisallowUnknownFields: true})
+	if e, ok := err.(Error); !ok || strings.Contains(e.Message, "unknown field") {
+		t.Errorf("expected an unmarshaler's error not to be taken for an unknown field, got %v", err)
+	}
+}
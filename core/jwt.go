@@ -0,0 +1,521 @@
+package din
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JWTOptions configures the JWTAuth handler.  These are read from the jwt
+// section of the config file.
+type JWTOptions struct {
+	// path of a JWKS file holding the keys that tokens may be signed with.
+	// The file is read again whenever it changes, so that keys can be
+	// rotated without restarting the server.
+	JWKS string `json:"jwks"`
+
+	// a base64-encoded secret for tokens signed with HS256, for services
+	// that share a secret rather than publishing a JWKS.
+	Secret string `json:"secret"`
+
+	// when set, tokens must have been issued by this issuer.
+	Issuer string `json:"issuer"`
+
+	// when set, tokens must name this audience.
+	Audience string `json:"audience"`
+
+	// name of a cookie that may carry the token, for browsers.  The
+	// Authorization header is preferred when a request has both.
+	Cookie string `json:"cookie"`
+
+	// how far the clocks of the issuer and the server may disagree when
+	// checking exp and nbf.
+	Leeway Duration `json:"leeway"`
+}
+
+// Claims are the claims of a verified JWT, as decoded from its payload.
+// Numbers are kept as json.Numbers.
+type Claims map[string]interface{}
+
+// String gives the named claim if it's a string, and "" otherwise.
+func (c Claims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// Subject gives the sub claim, which identifies whoever the token was issued
+// to.
+func (c Claims) Subject() string {
+	return c.String("sub")
+}
+
+// Time gives a claim that holds a NumericDate, such as exp, iat or nbf.  ok
+// is false if the claim is absent or isn't a number.
+func (c Claims) Time(name string) (t time.Time, ok bool) {
+	n, isNum := c[name].(json.Number)
+	if !isNum {
+		return time.Time{}, false
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	sec, frac := int64(f), f-float64(int64(f))
+	return time.Unix(sec, int64(frac*1e9)), true
+}
+
+// Audience gives the aud claim, which may be either a single string or a
+// list of them.
+func (c Claims) Audience() []string {
+	switch aud := c["aud"].(type) {
+	case string:
+		return []string{aud}
+	case []interface{}:
+		var out []string
+		for _, v := range aud {
+			if s, ok := v.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+// Claims gives the claims of the JWT that the request was authenticated
+// with, or nil if it wasn't authenticated by JWTAuth.
+func (r *Request) Claims() Claims {
+	return r.claims
+}
+
+// The signature algorithms supported for JWTs.  Tokens signed with any other
+// algorithm, including "none", are rejected.
+const (
+	JWTHS256 = "HS256"
+	JWTRS256 = "RS256"
+	JWTEdDSA = "EdDSA"
+)
+
+// A JWTKey is a key that can verify the signatures of tokens.  Key is a
+// []byte for HS256, an *rsa.PublicKey for RS256, or an ed25519.PublicKey for
+// EdDSA.
+type JWTKey struct {
+	// the key id, matched against the kid in the token header.  May be
+	// empty.
+	Id string
+
+	// the algorithm the key is used with.  A token is only checked against
+	// keys for the algorithm named in its header, so that a key can't be
+	// used with an algorithm it wasn't meant for.
+	Algorithm string
+
+	Key interface{}
+}
+
+// A JWTKeySet provides the keys with which tokens may be signed.
+type JWTKeySet interface {
+	JWTKeys() ([]JWTKey, error)
+}
+
+// StaticKeys is a JWTKeySet of keys known ahead of time.
+type StaticKeys []JWTKey
+
+func (k StaticKeys) JWTKeys() ([]JWTKey, error) {
+	return k, nil
+}
+
+// JWKSFile is a JWTKeySet read from a file holding a JSON Web Key Set, as
+// described in RFC 7517.  Keys of type oct, RSA and OKP (Ed25519) are
+// understood; keys of other types, and keys meant for encryption, are
+// ignored.  The file is read again whenever it changes, so that keys can be
+// rotated by publishing the new key alongside the old one, and removing the
+// old key once the tokens signed with it have expired.
+type JWKSFile struct {
+	path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	keys    []JWTKey
+}
+
+// LoadJWKS reads the JWKS file at path.
+func LoadJWKS(path string) (*JWKSFile, error) {
+	f := &JWKSFile{path: path}
+	if _, err := f.JWTKeys(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// JWTKeys gives the keys in the file, reading it again first if it has
+// changed.
+func (f *JWKSFile) JWTKeys() ([]JWTKey, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return nil, err
+	}
+	if f.keys != nil && info.ModTime().Equal(f.modTime) {
+		return f.keys, nil
+	}
+	raw, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := ParseJWKS(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", f.path, err)
+	}
+	f.keys, f.modTime = keys, info.ModTime()
+	return keys, nil
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	K   string `json:"k"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+}
+
+// ParseJWKS parses a JSON Web Key Set.
+func ParseJWKS(raw []byte) ([]JWTKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(raw, &set); err != nil {
+		return nil, err
+	}
+	keys := make([]JWTKey, 0, len(set.Keys))
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.parse()
+		if err != nil {
+			return nil, fmt.Errorf("key %d (%s): %v", i, k.Kid, err)
+		}
+		if key.Key != nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// parse converts a jwk to a JWTKey.  Keys of unknown types give a JWTKey with
+// a nil Key.
+func (k jwk) parse() (JWTKey, error) {
+	key := JWTKey{Id: k.Kid, Algorithm: k.Alg}
+	b64 := base64.RawURLEncoding
+	switch k.Kty {
+	case "oct":
+		secret, err := b64.DecodeString(k.K)
+		if err != nil || len(secret) == 0 {
+			return key, errors.New("invalid k")
+		}
+		key.Key = secret
+		if key.Algorithm == "" {
+			key.Algorithm = JWTHS256
+		}
+	case "RSA":
+		n, err := b64.DecodeString(k.N)
+		if err != nil || len(n) == 0 {
+			return key, errors.New("invalid n")
+		}
+		e, err := b64.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return key, errors.New("invalid e")
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if pub.N.BitLen() < 2048 {
+			return key, errors.New("RSA keys must be at least 2048 bits")
+		}
+		key.Key = pub
+		if key.Algorithm == "" {
+			key.Algorithm = JWTRS256
+		}
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return key, nil
+		}
+		x, err := b64.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return key, errors.New("invalid x")
+		}
+		key.Key = ed25519.PublicKey(x)
+		if key.Algorithm == "" {
+			key.Algorithm = JWTEdDSA
+		}
+	}
+	return key, nil
+}
+
+// a JWTError explains why a token was rejected.
+type JWTError string
+
+func (e JWTError) Error() string { return string(e) }
+
+// JWTVerifier verifies JWTs, checking their signatures against a key set,
+// and their exp, nbf, iss and aud claims.  exp and nbf are only checked when
+// the token has them.
+type JWTVerifier struct {
+	Keys     JWTKeySet
+	Issuer   string
+	Audience string
+	Leeway   time.Duration
+}
+
+// Verify verifies a token in the JWS compact serialization, giving its
+// claims.  A token that doesn't pass gives a JWTError; any other error is a
+// failure to get at the keys.
+func (v *JWTVerifier) Verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, JWTError("malformed token")
+	}
+	b64 := base64.RawURLEncoding
+
+	var header struct {
+		Alg  string   `json:"alg"`
+		Kid  string   `json:"kid"`
+		Crit []string `json:"crit"`
+	}
+	raw, err := b64.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(raw, &header) != nil {
+		return nil, JWTError("malformed token header")
+	}
+	switch header.Alg {
+	case JWTHS256, JWTRS256, JWTEdDSA:
+	default:
+		return nil, JWTError("unsupported algorithm " + strconv.Quote(header.Alg))
+	}
+	if len(header.Crit) > 0 {
+		return nil, JWTError("unsupported critical header parameters")
+	}
+	sig, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return nil, JWTError("malformed token signature")
+	}
+
+	keys, err := v.Keys.JWTKeys()
+	if err != nil {
+		return nil, err
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified, known := false, false
+	for _, key := range keys {
+		if key.Algorithm != header.Alg || (header.Kid != "" && key.Id != header.Kid) {
+			continue
+		}
+		known = true
+		if verifySignature(header.Alg, key.Key, signed, sig) {
+			verified = true
+			break
+		}
+	}
+	if !known {
+		return nil, JWTError("unknown signing key")
+	}
+	if !verified {
+		return nil, JWTError("invalid signature")
+	}
+
+	raw, err = b64.DecodeString(parts[1])
+	if err != nil {
+		return nil, JWTError("malformed token payload")
+	}
+	var claims Claims
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&claims); err != nil || claims == nil {
+		return nil, JWTError("malformed token payload")
+	}
+	if err := v.checkClaims(claims, time.Now()); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (v *JWTVerifier) checkClaims(c Claims, now time.Time) error {
+	if _, present := c["exp"]; present {
+		exp, ok := c.Time("exp")
+		if !ok {
+			return JWTError("invalid exp claim")
+		}
+		if !now.Before(exp.Add(v.Leeway)) {
+			return JWTError("token has expired")
+		}
+	}
+	if _, present := c["nbf"]; present {
+		nbf, ok := c.Time("nbf")
+		if !ok {
+			return JWTError("invalid nbf claim")
+		}
+		if now.Add(v.Leeway).Before(nbf) {
+			return JWTError("token is not valid yet")
+		}
+	}
+	if v.Issuer != "" && c.String("iss") != v.Issuer {
+		return JWTError("wrong issuer")
+	}
+	if v.Audience != "" {
+		for _, aud := range c.Audience() {
+			if aud == v.Audience {
+				return nil
+			}
+		}
+		return JWTError("wrong audience")
+	}
+	return nil
+}
+
+func verifySignature(alg string, key interface{}, signed, sig []byte) bool {
+	switch alg {
+	case JWTHS256:
+		secret, ok := key.([]byte)
+		if !ok {
+			return false
+		}
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), sig)
+	case JWTRS256:
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+		sum := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig) == nil
+	case JWTEdDSA:
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok {
+			return false
+		}
+		return ed25519.Verify(pub, signed, sig)
+	}
+	return false
+}
+
+// JWTAuth creates a Stage that requires a JWT, either as a bearer token in the
+// Authorization header or, if cookie isn't empty, in the named cookie.  The
+// claims of a verified token are available from Request.Claims, and its
+// subject becomes the request's User.  Requests without a token, or with one
+// that fails verification, are turned away with a 401 and a challenge for the
+// realm.
+//
+// "JWTAuth" is registered as a handler that verifies tokens as described by
+// the jwt config, for use in routes.json.
+func JWTAuth(v *JWTVerifier, realm, cookie string) Stage {
+	return func(req *Request) (Response, error) {
+		token, ok := bearerToken(req)
+		if !ok && cookie != "" {
+			if c, err := req.Cookie(cookie); err == nil && c.Value != "" {
+				token, ok = c.Value, true
+			}
+		}
+		if !ok {
+			return nil, challenge(req, "Bearer", realm)
+		}
+		claims, err := v.Verify(token)
+		if err != nil {
+			jerr, ok := err.(JWTError)
+			if !ok {
+				return nil, err
+			}
+			challenge(req, "Bearer", realm, `error="invalid_token"`, "error_description="+strconv.Quote(string(jerr)))
+			e := ErrUnauthorized
+			e.Message = "invalid token: " + string(jerr)
+			return nil, e
+		}
+		req.claims = claims
+		req.user = NamedUser(claims.Subject())
+		req.authenticated = true
+		return nil, nil
+	}
+}
+
+// JWKS files named in the config, loaded once each.
+var jwksFiles = struct {
+	sync.Mutex
+	byPath map[string]*JWKSFile
+}{byPath: make(map[string]*JWKSFile)}
+
+func loadJWKSFile(path string) (*JWKSFile, error) {
+	jwksFiles.Lock()
+	defer jwksFiles.Unlock()
+	if f, ok := jwksFiles.byPath[path]; ok {
+		return f, nil
+	}
+	f, err := LoadJWKS(path)
+	if err != nil {
+		return nil, err
+	}
+	jwksFiles.byPath[path] = f
+	return f, nil
+}
+
+// configKeys is the JWTKeySet described by the jwt config: the keys in the
+// JWKS file, if there is one, and the shared secret, if there is one.
+type configKeys JWTOptions
+
+func (o configKeys) JWTKeys() ([]JWTKey, error) {
+	var keys []JWTKey
+	if o.JWKS != "" {
+		f, err := loadJWKSFile(o.JWKS)
+		if err != nil {
+			return nil, err
+		}
+		fileKeys, err := f.JWTKeys()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, fileKeys...)
+	}
+	if o.Secret != "" {
+		secret, err := base64.StdEncoding.DecodeString(o.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("din: jwt secret is not valid base64: %v", err)
+		}
+		keys = append(keys, JWTKey{Algorithm: JWTHS256, Key: secret})
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("din: JWTAuth needs a jwks file or a secret in the jwt config")
+	}
+	return keys, nil
+}
+
+// configJWTAuth is the "JWTAuth" handler.  Like the BasicAuth handler, it
+// reads the config when requests come in, since routes are read first.
+func configJWTAuth(req *Request) (Response, error) {
+	o := Config.JWT
+	v := &JWTVerifier{
+		Keys:     configKeys(o),
+		Issuer:   o.Issuer,
+		Audience: o.Audience,
+		Leeway:   time.Duration(o.Leeway),
+	}
+	return JWTAuth(v, Config.Auth.realm(), o.Cookie)(req)
+}
+
+func init() {
+	RegisterHandler("JWTAuth", configJWTAuth)
+}
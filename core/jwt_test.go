@@ -0,0 +1,223 @@
+package din
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signJWT makes a token, signing it with key, which is a []byte, an
+// *rsa.PrivateKey or an ed25519.PrivateKey.
+func signJWT(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	b64 := base64.RawURLEncoding
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	signed := b64.EncodeToString(h) + "." + b64.EncodeToString(c)
+
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		sum := sha256.Sum256([]byte(signed))
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, sum[:]); err != nil {
+			t.Fatal(err)
+		}
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(signed))
+	}
+	return signed + "." + b64.EncodeToString(sig)
+}
+
+type jwtTestKeys struct {
+	secret []byte
+	rsa    *rsa.PrivateKey
+	ed     ed25519.PrivateKey
+}
+
+func newJWTTestKeys(t *testing.T) jwtTestKeys {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jwtTestKeys{secret: []byte("0123456789abcdef0123456789abcdef"), rsa: rsaKey, ed: edKey}
+}
+
+func (k jwtTestKeys) jwks(rsaKid string) []byte {
+	b64 := base64.RawURLEncoding
+	set := map[string]interface{}{"keys": []map[string]string{
+		{"kty": "oct", "kid": "shared", "k": b64.EncodeToString(k.secret)},
+		{"kty": "RSA", "kid": rsaKid, "use": "sig", "n": b64.EncodeToString(k.rsa.N.Bytes()), "e": b64.EncodeToString(big.NewInt(int64(k.rsa.E)).Bytes())},
+		{"kty": "OKP", "kid": "ed", "crv": "Ed25519", "x": b64.EncodeToString(k.ed.Public().(ed25519.PublicKey))},
+		{"kty": "RSA", "kid": "enc", "use": "enc", "n": "AQAB", "e": "AQAB"},
+	}}
+	raw, _ := json.Marshal(set)
+	return raw
+}
+
+func TestJWTVerify(t *testing.T) {
+	keys := newJWTTestKeys(t)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, keys.jwks("rsa1"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	jwks, err := LoadJWKS(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &JWTVerifier{Keys: jwks, Issuer: "auth.example.com", Audience: "api", Leeway: 10 * time.Second}
+
+	now := time.Now().Unix()
+	good := map[string]interface{}{"sub": "bob", "iss": "auth.example.com", "aud": []string{"web", "api"}, "exp": now + 60}
+	with := func(k string, val interface{}) map[string]interface{} {
+		c := make(map[string]interface{})
+		for k, v := range good {
+			c[k] = v
+		}
+		if val == nil {
+			delete(c, k)
+		} else {
+			c[k] = val
+		}
+		return c
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		err   string
+	}{
+		{"hs256", signJWT(t, "HS256", "shared", keys.secret, good), ""},
+		{"rs256", signJWT(t, "RS256", "rsa1", keys.rsa, good), ""},
+		{"eddsa", signJWT(t, "EdDSA", "ed", keys.ed, good), ""},
+		{"no kid", signJWT(t, "EdDSA", "", keys.ed, good), ""},
+		{"string aud", signJWT(t, "HS256", "shared", keys.secret, with("aud", "api")), ""},
+		{"no exp", signJWT(t, "HS256", "shared", keys.secret, with("exp", nil)), ""},
+		{"within leeway", signJWT(t, "HS256", "shared", keys.secret, with("exp", now-5)), ""},
+		{"expired", signJWT(t, "HS256", "shared", keys.secret, with("exp", now-60)), "token has expired"},
+		{"not yet", signJWT(t, "HS256", "shared", keys.secret, with("nbf", now+60)), "token is not valid yet"},
+		{"issuer", signJWT(t, "HS256", "shared", keys.secret, with("iss", "evil.example.com")), "wrong issuer"},
+		{"audience", signJWT(t, "HS256", "shared", keys.secret, with("aud", "web")), "wrong audience"},
+		{"unknown kid", signJWT(t, "RS256", "rsa2", keys.rsa, good), "unknown signing key"},
+		{"wrong key", signJWT(t, "HS256", "shared", []byte("not the secret"), good), "invalid signature"},
+		{"alg confusion", signJWT(t, "HS256", "rsa1", keys.secret, good), "unknown signing key"},
+		{"none", strings.TrimSuffix(signJWT(t, "none", "", nil, good), "."), "malformed token"},
+		{"unsigned", signJWT(t, "none", "", nil, good), `unsupported algorithm "none"`},
+		{"garbage", "abc.def", "malformed token"},
+	}
+	for _, test := range tests {
+		claims, err := v.Verify(test.token)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+			} else if claims.Subject() != "bob" {
+				t.Errorf("%s: expected subject bob, got %q", test.name, claims.Subject())
+			}
+			continue
+		}
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+		}
+	}
+
+	// rotate the RSA key: tokens signed with the old key stop working, and
+	// tokens signed with the new one start working.
+	old := signJWT(t, "RS256", "rsa1", keys.rsa, good)
+	rotated := keys
+	if rotated.rsa, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, rotated.jwks("rsa2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path, later, later)
+	if _, err := v.Verify(old); err == nil {
+		t.Errorf("expected token signed with a retired key to be refused")
+	}
+	if _, err := v.Verify(signJWT(t, "RS256", "rsa2", rotated.rsa, good)); err != nil {
+		t.Errorf("expected token signed with the new key to be accepted: %v", err)
+	}
+}
+
+func TestJWTAuth(t *testing.T) {
+	keys := newJWTTestKeys(t)
+	defer func(opts JWTOptions) { Config.JWT = opts }(Config.JWT)
+	Config.JWT = JWTOptions{
+		Secret:   base64.StdEncoding.EncodeToString(keys.secret),
+		Audience: "api",
+		Cookie:   "token",
+	}
+	RegisterHandler("testClaims", func(req *Request) (Response, error) {
+		return PlaintextResponseString(req.User().UserId()+" "+req.Claims().String("role"), http.StatusOK), nil
+	})
+	router := httpAuthRouter(t, `[
+		{"route": "^/api$", "name": "api", "handlers": ["JWTAuth", "testClaims"]}
+	]`)
+
+	token := signJWT(t, "HS256", "", keys.secret, map[string]interface{}{
+		"sub": "bob", "aud": "api", "role": "admin", "exp": time.Now().Unix() + 60,
+	})
+	expired := signJWT(t, "HS256", "", keys.secret, map[string]interface{}{
+		"sub": "bob", "aud": "api", "exp": time.Now().Unix() - 60,
+	})
+
+	tests := []struct {
+		name      string
+		auth      string
+		cookie    string
+		status    int
+		body      string
+		challenge string
+	}{
+		{"header", "Bearer " + token, "", http.StatusOK, "bob admin", ""},
+		{"cookie", "", token, http.StatusOK, "bob admin", ""},
+		{"none", "", "", http.StatusUnauthorized, "", `Bearer realm="din"`},
+		{"expired", "Bearer " + expired, "", http.StatusUnauthorized, "", `Bearer realm="din", error="invalid_token", error_description="token has expired"`},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/api", nil)
+		if test.auth != "" {
+			req.Header.Set("Authorization", test.auth)
+		}
+		if test.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "token", Value: test.cookie})
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("%s: expected %d, got %d", test.name, test.status, w.Code)
+			continue
+		}
+		if test.body != "" && w.Body.String() != test.body {
+			t.Errorf("%s: expected %q, got %q", test.name, test.body, w.Body.String())
+		}
+		if h := w.Header().Get("WWW-Authenticate"); h != test.challenge {
+			t.Errorf("%s: expected challenge %q, got %q", test.name, test.challenge, h)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package din
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	// how long sessions are kept when no session timeouts are configured.
+	defaultSessionTTL = 24 * time.Hour
+
+	// how many sessions the in-memory store holds, unless configured
+	// otherwise.
+	defaultMaxSessions = 100000
+
+	// how often the in-memory store looks for expired sessions.
+	defaultSweepInterval = time.Minute
+)
+
+// MemoryStore is a SessionHandler that keeps sessions in memory.  It's the
+// default SessionHandler.  It's safe for concurrent use.  Sessions are dropped
+// once they've gone unused for longer than the store's ttl, and when the store
+// is full, the least recently used session is evicted to make room for a new
+// one.  Since the sessions are kept in process memory, they're lost whenever
+// the server restarts, and they can't be shared between servers.
+type MemoryStore struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // front is most recently used
+	done    chan struct{}
+	closed  bool
+}
+
+type memoryEntry struct {
+	id      string
+	s       Session
+	expires time.Time
+}
+
+// NewMemoryStore creates a MemoryStore and starts its background sweeper,
+// which runs until the store is closed.  A zero ttl or maxEntries is taken
+// from the sessions config each time it's needed, so that the default store,
+// which is created before the config file is read, follows the config.
+func NewMemoryStore(ttl time.Duration, maxEntries int) *MemoryStore {
+	m := &MemoryStore{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+		done:       make(chan struct{}),
+	}
+	go m.sweeper(defaultSweepInterval)
+	return m
+}
+
+func (m *MemoryStore) getTTL() time.Duration {
+	if m.ttl > 0 {
+		return m.ttl
+	}
+	return Config.Sessions.storeTTL()
+}
+
+func (m *MemoryStore) getMaxEntries() int {
+	if m.maxEntries > 0 {
+		return m.maxEntries
+	}
+	return Config.Sessions.maxSessions()
+}
+
+// Get retrieves a copy of the session stored under id, so that the caller is
+// free to modify it without affecting other requests that are using the same
+// session.  Reading a session counts as using it.
+func (m *MemoryStore) Get(id string) (Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.entries[id]
+	if !ok {
+		return nil, ErrUnknownSessionId
+	}
+	e := el.Value.(*memoryEntry)
+	now := time.Now()
+	if now.After(e.expires) {
+		m.remove(el)
+		return nil, ErrUnknownSessionId
+	}
+	e.expires = now.Add(m.getTTL())
+	m.lru.MoveToFront(el)
+	return copySession(e.s), nil
+}
+
+// Set stores a copy of the session under id, evicting the least recently used
+// sessions if the store is over capacity.
+func (m *MemoryStore) Set(id string, s Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	expires := time.Now().Add(m.getTTL())
+	if el, ok := m.entries[id]; ok {
+		e := el.Value.(*memoryEntry)
+		e.s = copySession(s)
+		e.expires = expires
+		m.lru.MoveToFront(el)
+		return nil
+	}
+	m.entries[id] = m.lru.PushFront(&memoryEntry{id: id, s: copySession(s), expires: expires})
+	for max := m.getMaxEntries(); m.lru.Len() > max; {
+		m.remove(m.lru.Back())
+	}
+	return nil
+}
+
+// Touch records when the session stored under id was accessed, and counts
+// as using it.
+func (m *MemoryStore) Touch(id string, accessed time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	el, ok := m.entries[id]
+	if !ok {
+		return ErrUnknownSessionId
+	}
+	e := el.Value.(*memoryEntry)
+	now := time.Now()
+	if now.After(e.expires) {
+		m.remove(el)
+		return ErrUnknownSessionId
+	}
+	e.s.setTimestamp(sessionAccessedKey, accessed)
+	e.expires = now.Add(m.getTTL())
+	m.lru.MoveToFront(el)
+	return nil
+}
+
+// Delete removes the session stored under id.  Deleting a session that
+// doesn't exist is not an error.
+func (m *MemoryStore) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if el, ok := m.entries[id]; ok {
+		m.remove(el)
+	}
+	return nil
+}
+
+// Len gives the number of sessions in the store, including any that have
+// expired but haven't been swept yet.
+func (m *MemoryStore) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lru.Len()
+}
+
+// Close stops the store's background sweeper.  The store remains usable, but
+// expired sessions are only removed as they're encountered.
+func (m *MemoryStore) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.closed {
+		m.closed = true
+		close(m.done)
+	}
+	return nil
+}
+
+// remove must be called with the lock held.
+func (m *MemoryStore) remove(el *list.Element) {
+	m.lru.Remove(el)
+	delete(m.entries, el.Value.(*memoryEntry).id)
+}
+
+// sweep removes every session that expired before now.  Since Get and Set
+// push the sessions they touch to the front of the list, and every touch
+// extends a session by the same ttl, expiry times increase from the back of
+// the list to the front, so we only have to look at the back of the list.  If
+// the ttl has changed, this may leave a few expired sessions around until a
+// later sweep, which is harmless: Get never returns an expired session.
+func (m *MemoryStore) sweep(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for el := m.lru.Back(); el != nil; el = m.lru.Back() {
+		if !now.After(el.Value.(*memoryEntry).expires) {
+			return
+		}
+		m.remove(el)
+	}
+}
+
+func (m *MemoryStore) sweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			m.sweep(now)
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// copySession makes a shallow copy of a session.  Values stored in sessions
+// are expected to be treated as immutable; the copy protects the map itself.
+func copySession(s Session) Session {
+	c := make(Session, len(s))
+	for k, v := range s {
+		c[k] = v
+	}
+	return c
+}
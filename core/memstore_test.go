@@ -0,0 +1,147 @@
+package din
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	m := NewMemoryStore(time.Hour, 0)
+	defer m.Close()
+
+	s := Session{"name": "bob"}
+	m.Set("a", s)
+	s["name"] = "alice"
+
+	got, err := m.Get("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["name"] != "bob" {
+		t.Errorf("store shares its session with the caller: got %v", got["name"])
+	}
+	got["name"] = "carol"
+	if again, _ := m.Get("a"); again["name"] != "bob" {
+		t.Errorf("store shares its session with the caller: got %v", again["name"])
+	}
+
+	m.Delete("a")
+	if _, err := m.Get("a"); err != ErrUnknownSessionId {
+		t.Errorf("expected ErrUnknownSessionId after delete, got %v", err)
+	}
+	if err := m.Delete("a"); err != nil {
+		t.Errorf("deleting a missing session failed: %v", err)
+	}
+}
+
+func TestMemoryStoreExpiry(t *testing.T) {
+	m := NewMemoryStore(time.Minute, 0)
+	defer m.Close()
+
+	m.Set("old", Session{})
+	m.Set("new", Session{})
+	m.entries["old"].Value.(*memoryEntry).expires = time.Now().Add(-time.Second)
+
+	m.sweep(time.Now())
+	if m.Len() != 1 {
+		t.Fatalf("expected 1 session after sweeping, have %d", m.Len())
+	}
+	if _, err := m.Get("new"); err != nil {
+		t.Errorf("live session was swept: %v", err)
+	}
+
+	m.entries["new"].Value.(*memoryEntry).expires = time.Now().Add(-time.Second)
+	if _, err := m.Get("new"); err != ErrUnknownSessionId {
+		t.Errorf("expected expired session to be unknown, got %v", err)
+	}
+	if m.Len() != 0 {
+		t.Errorf("expected expired session to be removed on read, have %d sessions", m.Len())
+	}
+}
+
+func TestMemoryStoreEviction(t *testing.T) {
+	m := NewMemoryStore(time.Hour, 3)
+	defer m.Close()
+
+	m.Set("a", Session{})
+	m.Set("b", Session{})
+	m.Set("c", Session{})
+	m.Get("a")
+	m.Set("d", Session{})
+
+	if m.Len() != 3 {
+		t.Fatalf("expected store to hold 3 sessions, have %d", m.Len())
+	}
+	if _, err := m.Get("b"); err != ErrUnknownSessionId {
+		t.Errorf("expected least recently used session to be evicted")
+	}
+	for _, id := range []string{"a", "c", "d"} {
+		if _, err := m.Get(id); err != nil {
+			t.Errorf("session %s was evicted out of order", id)
+		}
+	}
+}
+
+// these are meant to be run with -race.
+func TestMemoryStoreConcurrency(t *testing.T) {
+	m := NewMemoryStore(time.Hour, 50)
+	defer m.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				id := fmt.Sprintf("%d-%d", i, j%80)
+				m.Set(id, Session{"n": j})
+				if s, err := m.Get(id); err == nil {
+					s["n"] = -j
+				}
+				if j%7 == 0 {
+					m.Delete(id)
+				}
+				if j%50 == 0 {
+					m.sweep(time.Now())
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	if m.Len() > 50 {
+		t.Errorf("store grew past its bound: %d sessions", m.Len())
+	}
+}
+
+func TestSessionConcurrency(t *testing.T) {
+	defer func(h SessionHandler) { sessions = h }(sessions)
+	m := NewMemoryStore(time.Hour, 0)
+	defer m.Close()
+	SetSessionHandler(m)
+	router := sessionRouter()
+
+	cookie := sessionCookie(sessionGet(router, "/set", nil))
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				for _, path := range []string{"/set", "/get"} {
+					req := httptest.NewRequest("GET", path, nil)
+					req.AddCookie(cookie)
+					w := httptest.NewRecorder()
+					router.ServeHTTP(w, req)
+					if w.Code != http.StatusOK && w.Code != http.StatusNoContent {
+						t.Errorf("%s: unexpected status %d", path, w.Code)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,156 @@
+package din
+
+import (
+	"strconv"
+	"strings"
+)
+
+// an acceptRange is a single media range parsed out of an Accept header, e.g.,
+// "text/*;q=0.5"
+type acceptRange struct {
+	typ     string
+	subtype string
+	q       float64
+}
+
+// specificity ranks how closely an accept range describes a media type.
+// Exact matches beat type wildcards, which beat */*.  A negative value means
+// that the range doesn't match the media type at all.
+func (a acceptRange) specificity(typ, subtype string) int {
+	switch {
+	case a.typ == typ && a.subtype == subtype:
+		return 2
+	case a.typ == typ && a.subtype == "*":
+		return 1
+	case a.typ == "*" && a.subtype == "*":
+		return 0
+	}
+	return -1
+}
+
+// parseAccept parses the value of an Accept header into its media ranges.
+// Malformed ranges are skipped rather than rejecting the whole header, since
+// browsers have historically sent all manner of garbage in there.
+func parseAccept(header string) []acceptRange {
+	var ranges []acceptRange
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		i := strings.Index(mediaType, "/")
+		if i <= 0 || i == len(mediaType)-1 {
+			continue
+		}
+		a := acceptRange{typ: mediaType[:i], subtype: mediaType[i+1:], q: 1}
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			q, err := strconv.ParseFloat(param[2:], 64)
+			if err == nil && q >= 0 && q <= 1 {
+				a.q = q
+			}
+		}
+		ranges = append(ranges, a)
+	}
+	return ranges
+}
+
+// Accepts performs content negotiation against the request's Accept header.
+// It returns the entry in offers that the client would most like to receive,
+// or an empty string if the client has refused all of them.  When two offers
+// are equally acceptable, the one listed first wins, so offers should be
+// listed in the server's order of preference.  A request without an Accept
+// header accepts anything, and gets the first offer.
+func (r *Request) Accepts(offers ...string) string {
+	if len(offers) == 0 {
+		return ""
+	}
+	header := r.Header.Get("Accept")
+	if header == "" {
+		return offers[0]
+	}
+	ranges := parseAccept(header)
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		typ, subtype := offer, ""
+		if i := strings.Index(offer, "/"); i >= 0 {
+			typ, subtype = strings.ToLower(offer[:i]), strings.ToLower(offer[i+1:])
+		}
+		q, specificity := 0.0, -1
+		for _, a := range ranges {
+			if s := a.specificity(typ, subtype); s > specificity {
+				q, specificity = a.q, s
+			}
+		}
+		if q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// encodingQ gives the quality that an Accept-Encoding header assigns to a
+// content coding, falling back to the "*" entry for codings that aren't
+// named.  Codings that the header doesn't mention at all get a quality of
+// zero, except for identity, which is acceptable unless explicitly refused.
+func encodingQ(header, coding string) float64 {
+	q, wildcard := -1.0, -1.0
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		if name == "" {
+			continue
+		}
+		v := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			if parsed, err := strconv.ParseFloat(param[2:], 64); err == nil && parsed >= 0 && parsed <= 1 {
+				v = parsed
+			}
+		}
+		switch name {
+		case coding:
+			q = v
+		case "*":
+			wildcard = v
+		}
+	}
+	switch {
+	case q >= 0:
+		return q
+	case wildcard >= 0:
+		return wildcard
+	case coding == "identity":
+		return 1
+	}
+	return 0
+}
+
+// AcceptsEncoding performs content negotiation against the request's
+// Accept-Encoding header, much as Accepts does against the Accept header.  It
+// returns the content coding in offers that the client would most like to
+// receive, or an empty string if the client would rather have the response
+// as it is.  Offers should be listed in the server's order of preference.
+func (r *Request) AcceptsEncoding(offers ...string) string {
+	return negotiateEncoding(r.Header.Get("Accept-Encoding"), offers)
+}
+
+func negotiateEncoding(header string, offers []string) string {
+	if header == "" {
+		return ""
+	}
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		if q := encodingQ(header, offer); q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	if bestQ < encodingQ(header, "identity") {
+		return ""
+	}
+	return best
+}
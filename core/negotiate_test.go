@@ -0,0 +1,35 @@
+package din
+
+import (
+	"net/http"
+	"testing"
+)
+
+var acceptTests = []struct {
+	accept string
+	offers []string
+	out    string
+}{
+	{"", []string{"text/html", "application/json"}, "text/html"},
+	{"application/json", []string{"text/html", "application/json"}, "application/json"},
+	{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", []string{"text/html", "application/json"}, "text/html"},
+	{"application/json, text/plain;q=0.5", []string{"text/html", "text/plain", "application/json"}, "application/json"},
+	{"text/*;q=0.3, application/json;q=0.2", []string{"application/json", "text/plain"}, "text/plain"},
+	{"*/*", []string{"text/plain", "application/json"}, "text/plain"},
+	{"text/*, text/html;q=0", []string{"text/html", "text/plain"}, "text/plain"},
+	{"image/png", []string{"text/html", "application/json"}, ""},
+	{"garbage, application/json", []string{"text/html", "application/json"}, "application/json"},
+}
+
+func TestAccepts(t *testing.T) {
+	for i, test := range acceptTests {
+		raw, _ := http.NewRequest("GET", "/", nil)
+		if test.accept != "" {
+			raw.Header.Set("Accept", test.accept)
+		}
+		req := &Request{Request: raw}
+		if out := req.Accepts(test.offers...); out != test.out {
+			t.Errorf("test %d: Accept %q with offers %v gave %q, expected %q", i, test.accept, test.offers, out, test.out)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package din
+
+import (
+	"net/http"
+	"strings"
+)
+
+// ProblemContentType is the media type of the RFC 7807 problem details
+// documents that din renders for api clients.
+const ProblemContentType = "application/problem+json"
+
+// Problem holds the RFC 7807 "problem details" for a din.Error.  All of the
+// fields are optional.  Type is a URI identifying the kind of problem; when
+// it is left empty, it is rendered as "about:blank", meaning that the
+// problem is nothing more than its HTTP status code.  Detail falls back to
+// the message of the Error carrying the Problem.
+type Problem struct {
+	Type     string
+	Title    string
+	Detail   string
+	Instance string
+
+	// InvalidParams lists the request parameters that failed validation, one
+	// entry per offending field.
+	InvalidParams []InvalidParam
+
+	// Extensions are additional members of the problem document.  They may
+	// not replace any of the standard members.
+	Extensions map[string]interface{}
+}
+
+// InvalidParam describes a single request parameter that was rejected.
+type InvalidParam struct {
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// document assembles the json object to be rendered for a problem.  The
+// status and detail are taken from the Error carrying the problem, since the
+// Error is the authority on the response status.
+func (p *Problem) document(e Error) map[string]interface{} {
+	if p == nil {
+		p = new(Problem)
+	}
+	doc := make(map[string]interface{}, len(p.Extensions)+6)
+	for k, v := range p.Extensions {
+		doc[k] = v
+	}
+	doc["type"] = p.Type
+	if p.Type == "" {
+		doc["type"] = "about:blank"
+	}
+	doc["title"] = p.Title
+	if p.Title == "" {
+		doc["title"] = http.StatusText(e.StatusCode)
+	}
+	doc["status"] = e.StatusCode
+	detail := p.Detail
+	if detail == "" {
+		detail = e.Message
+	}
+	if detail != "" {
+		doc["detail"] = detail
+	} else {
+		delete(doc, "detail")
+	}
+	if p.Instance != "" {
+		doc["instance"] = p.Instance
+	} else {
+		delete(doc, "instance")
+	}
+	if len(p.InvalidParams) > 0 {
+		doc["invalid-params"] = p.InvalidParams
+	} else {
+		delete(doc, "invalid-params")
+	}
+	return doc
+}
+
+// ValidationError creates a 400 error listing every request parameter that
+// failed validation.  The message lists the failures for clients that aren't
+// interested in the problem document.
+func ValidationError(params ...InvalidParam) Error {
+	reasons := make([]string, len(params))
+	for i, p := range params {
+		reasons[i] = p.Name + ": " + p.Reason
+	}
+	return Error{
+		StatusCode: http.StatusBadRequest,
+		Message:    "invalid request parameters: " + strings.Join(reasons, "; "),
+		Problem: &Problem{
+			Title:         "invalid request parameters",
+			InvalidParams: params,
+		},
+	}
+}
+
+// invalidParam is shorthand for a ValidationError that concerns a single
+// parameter.
+func invalidParam(name, reason string) Error {
+	return ValidationError(InvalidParam{Name: name, Reason: reason})
+}
@@ -0,0 +1,387 @@
+package din
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrTooManyRequests is the error given to clients that have gone over a rate
+// limit.
+var ErrTooManyRequests = Error{
+	StatusCode: http.StatusTooManyRequests,
+	Message:    "too many requests",
+}
+
+// A RateLimit allows Requests requests in each period of length Per, with
+// bursts of up to Burst requests.  A zero Burst is taken to be the same as
+// Requests, so that a client that has been quiet may use the whole period's
+// allowance at once.
+//
+// Limits are enforced with the generic cell rate algorithm, which behaves
+// like a token bucket that holds Burst tokens and is refilled at a rate of
+// Requests tokens per Per, but which only needs to keep a single time per
+// client: the time at which the client's bucket will be full again.
+type RateLimit struct {
+	Requests int
+	Per      time.Duration
+	Burst    int
+}
+
+func (l RateLimit) burst() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return l.Requests
+}
+
+// interval is the time it takes for a single token to be replaced.
+func (l RateLimit) interval() time.Duration {
+	return l.Per / time.Duration(l.Requests)
+}
+
+// RateLimitResult describes the outcome of a request against a rate limit.
+type RateLimitResult struct {
+	Allowed bool
+
+	// the number of requests the client may make right now.
+	Remaining int
+
+	// how long the client has to wait before being allowed another
+	// request.  Zero when the request is allowed.
+	RetryAfter time.Duration
+
+	// how long it will be before the client has its full allowance again.
+	Reset time.Duration
+}
+
+// Apply works out whether a request made at now is allowed by the limit,
+// given tat, the time at which the client's bucket will be full again, as
+// returned by a previous call to Apply (or the zero time, for a client we
+// haven't seen).  It gives the new value of tat, which a RateLimitStore
+// should store if the request is allowed.  RateLimitStores implement Take
+// with Apply, so that they all count the same way.
+func (l RateLimit) Apply(tat, now time.Time) (time.Time, RateLimitResult) {
+	interval := l.interval()
+	tolerance := interval * time.Duration(l.burst())
+	if tat.Before(now) {
+		tat = now
+	}
+	next := tat.Add(interval)
+	if allowAt := next.Add(-tolerance); now.Before(allowAt) {
+		return tat, RateLimitResult{
+			RetryAfter: allowAt.Sub(now),
+			Reset:      tat.Sub(now),
+		}
+	}
+	return next, RateLimitResult{
+		Allowed:   true,
+		Remaining: int((tolerance - next.Sub(now)) / interval),
+		Reset:     next.Sub(now),
+	}
+}
+
+// A RateLimitStore keeps track of how much of their allowance clients have
+// used.  Take counts a request made under key at now against the limit.  It
+// must be safe for concurrent use, and Take must be atomic: two requests under
+// the same key can't both get the last request of an allowance.
+type RateLimitStore interface {
+	Take(key string, limit RateLimit, now time.Time) (RateLimitResult, error)
+}
+
+// MemoryRateLimitStore is a RateLimitStore that keeps counts in memory.  It's
+// the default RateLimitStore.  Counts are lost when the server restarts, and
+// aren't shared between servers; a site served by many servers should use a
+// shared store, or divide its limits by the number of servers.
+type MemoryRateLimitStore struct {
+	mu      sync.Mutex
+	entries map[string]time.Time
+	done    chan struct{}
+	closer  sync.Once
+}
+
+// NewMemoryRateLimitStore creates a MemoryRateLimitStore and starts its
+// background sweeper, which forgets clients whose allowance is full again.
+// The sweeper runs until the store is closed.
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	m := &MemoryRateLimitStore{
+		entries: make(map[string]time.Time),
+		done:    make(chan struct{}),
+	}
+	go m.sweeper(defaultSweepInterval)
+	return m
+}
+
+func (m *MemoryRateLimitStore) Take(key string, limit RateLimit, now time.Time) (RateLimitResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tat, res := limit.Apply(m.entries[key], now)
+	if res.Allowed {
+		m.entries[key] = tat
+	}
+	return res, nil
+}
+
+// Len gives the number of clients the store is keeping track of.
+func (m *MemoryRateLimitStore) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.entries)
+}
+
+// Close stops the store's background sweeper.
+func (m *MemoryRateLimitStore) Close() error {
+	m.closer.Do(func() { close(m.done) })
+	return nil
+}
+
+func (m *MemoryRateLimitStore) sweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			m.sweep(now)
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// sweep forgets every client whose allowance is full at now; they're
+// indistinguishable from clients we've never seen.
+func (m *MemoryRateLimitStore) sweep(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, tat := range m.entries {
+		if !tat.After(now) {
+			delete(m.entries, key)
+		}
+	}
+}
+
+var (
+	defaultRateLimitStore     RateLimitStore
+	defaultRateLimitStoreOnce sync.Once
+)
+
+// SetRateLimitStore sets the store used by RateLimiters that don't have one
+// of their own.  It should be called before the server starts.
+func SetRateLimitStore(s RateLimitStore) {
+	defaultRateLimitStoreOnce.Do(func() {})
+	defaultRateLimitStore = s
+}
+
+func getRateLimitStore() RateLimitStore {
+	defaultRateLimitStoreOnce.Do(func() {
+		defaultRateLimitStore = NewMemoryRateLimitStore()
+	})
+	return defaultRateLimitStore
+}
+
+// A RateLimitKey identifies the client that a request counts against.
+type RateLimitKey func(*Request) (string, error)
+
+var rateLimitKeys = map[string]RateLimitKey{
+	"ip":      ClientIPKey,
+	"session": SessionKeyOrIP,
+	"user":    UserKeyOrIP,
+	"route":   RouteKey,
+}
+
+// RegisterRateLimitKey makes a RateLimitKey available by name to the
+// RateLimit handler in routes.json.  The keys "ip", "session", "user" and
+// "route" are built in.
+func RegisterRateLimitKey(name string, key RateLimitKey) {
+	rateLimitKeys[name] = key
+}
+
+// ClientIPKey counts requests against the client's IP address.
+func ClientIPKey(req *Request) (string, error) {
+	return "ip:" + req.ClientIP(), nil
+}
+
+// SessionKeyOrIP counts requests against the client's session, as given by
+// Request.SessionIdentity, and those without a valid session against the
+// client's IP address.  Bear in mind that clients can shed their sessions at
+// will, so a limit keyed by session should be backed by a looser limit keyed
+// by IP.
+func SessionKeyOrIP(req *Request) (string, error) {
+	key, err := req.SessionIdentity()
+	if err != nil {
+		return ClientIPKey(req)
+	}
+	// session ids are secrets, and so aren't handed to the store as they are.
+	sum := sha256.Sum256([]byte(key))
+	return "session:" + hex.EncodeToString(sum[:16]), nil
+}
+
+// UserKeyOrIP counts requests against the authenticated user, and anonymous
+// requests against the client's IP address.  It runs the registered
+// Authenticators if no authentication stage has run yet.
+func UserKeyOrIP(req *Request) (string, error) {
+	if err := req.authenticate(); err != nil {
+		return "", err
+	}
+	if u := req.User(); u != nil {
+		return "user:" + u.UserId(), nil
+	}
+	return ClientIPKey(req)
+}
+
+// RouteKey counts requests against the client's IP address separately for
+// each route, so that a limiter installed with Router.Use gives every route
+// its own allowance.
+func RouteKey(req *Request) (string, error) {
+	name := ""
+	if req.RouteMatch != nil && req.Pipeline != nil {
+		name = req.Pipeline.Name
+	}
+	return "route:" + name + ":" + req.ClientIP(), nil
+}
+
+// ClientIP gives the IP address of the client.  When trust_proxy is set in the
+// core config, the last address in the X-Forwarded-For header is believed,
+// since that's the one added by our own proxy; otherwise the address of the
+// connection is used.
+func (r *Request) ClientIP() string {
+	if Config.Core.TrustProxy {
+		if fwd := r.Header.Values("X-Forwarded-For"); len(fwd) > 0 {
+			last := fwd[len(fwd)-1]
+			if i := strings.LastIndexByte(last, ','); i >= 0 {
+				last = last[i+1:]
+			}
+			if ip := strings.TrimSpace(last); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// each RateLimiter counts under its own prefix, so that two limiters sharing
+// a store don't eat into each other's allowances.
+var rateLimiterIds int64
+
+// A RateLimiter turns away clients that make requests faster than its limit
+// allows, with a 429 and a Retry-After header.  Every response that passes
+// through it carries RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset
+// headers, so that well-behaved clients can slow down before they're cut
+// off.
+type RateLimiter struct {
+	Limit RateLimit
+
+	// identifies the client a request counts against.  Defaults to
+	// ClientIPKey.
+	Key RateLimitKey
+
+	// where counts are kept.  Defaults to the store given to
+	// SetRateLimitStore, or else a shared MemoryRateLimitStore.
+	Store RateLimitStore
+
+	prefix string
+}
+
+// NewRateLimiter creates a RateLimiter that counts requests against the
+// client identified by key.  A nil key counts requests by IP address.
+func NewRateLimiter(limit RateLimit, key RateLimitKey) (*RateLimiter, error) {
+	if limit.Requests <= 0 || limit.Per <= 0 || limit.Burst < 0 {
+		return nil, fmt.Errorf("din: invalid rate limit of %d requests per %v", limit.Requests, limit.Per)
+	}
+	if limit.interval() <= 0 {
+		return nil, fmt.Errorf("din: rate limit of %d requests per %v is too fine", limit.Requests, limit.Per)
+	}
+	return &RateLimiter{
+		Limit:  limit,
+		Key:    key,
+		prefix: "rl" + strconv.FormatInt(atomic.AddInt64(&rateLimiterIds, 1), 10) + ":",
+	}, nil
+}
+
+// Stage is the RateLimiter as a Stage, to be put in a pipeline or installed
+// for every route with Router.Use.  Background revalidations of cached
+// responses aren't counted, since the client didn't make them.
+func (l *RateLimiter) Stage(req *Request) (Response, error) {
+	if req.revalidating() {
+		return nil, nil
+	}
+	key := l.Key
+	if key == nil {
+		key = ClientIPKey
+	}
+	k, err := key(req)
+	if err != nil {
+		return nil, err
+	}
+	store := l.Store
+	if store == nil {
+		store = getRateLimitStore()
+	}
+	res, err := store.Take(l.prefix+k, l.Limit, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	h := req.ResponseHeader()
+	h.Set("RateLimit-Limit", strconv.Itoa(l.Limit.burst()))
+	h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+	h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", l.Limit.Requests, ceilSeconds(l.Limit.Per)))
+	if !res.Allowed {
+		h.Set("Retry-After", strconv.Itoa(ceilSeconds(res.RetryAfter)))
+		return nil, ErrTooManyRequests
+	}
+	return nil, nil
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+func init() {
+	// e.g., "RateLimit(60, 1m)", "RateLimit(10, 1s, session)" or
+	// "RateLimit(100, 1h, user, 20)": requests, period, key, burst.
+	RegisterHandlerFactory("RateLimit", func(args ...string) (Stage, error) {
+		if len(args) < 2 || len(args) > 4 {
+			return nil, errors.New("RateLimit takes a number of requests, a period, and optionally a key and a burst")
+		}
+		var limit RateLimit
+		var err error
+		if limit.Requests, err = strconv.Atoi(args[0]); err != nil {
+			return nil, fmt.Errorf("RateLimit: bad number of requests %q", args[0])
+		}
+		if limit.Per, err = time.ParseDuration(args[1]); err != nil {
+			return nil, fmt.Errorf("RateLimit: bad period %q", args[1])
+		}
+		var key RateLimitKey
+		if len(args) > 2 {
+			var ok bool
+			if key, ok = rateLimitKeys[args[2]]; !ok {
+				return nil, fmt.Errorf("RateLimit: unknown key %q", args[2])
+			}
+		}
+		if len(args) > 3 {
+			if limit.Burst, err = strconv.Atoi(args[3]); err != nil {
+				return nil, fmt.Errorf("RateLimit: bad burst %q", args[3])
+			}
+		}
+		l, err := NewRateLimiter(limit, key)
+		if err != nil {
+			return nil, err
+		}
+		return l.Stage, nil
+	})
+}
@@ -0,0 +1,186 @@
+package din
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimitApply(t *testing.T) {
+	limit := RateLimit{Requests: 10, Per: 10 * time.Second, Burst: 3}
+	now := time.Unix(1000, 0)
+	var tat time.Time
+	var res RateLimitResult
+
+	for i := 2; i >= 0; i-- {
+		tat, res = limit.Apply(tat, now)
+		if !res.Allowed || res.Remaining != i {
+			t.Fatalf("expected request to be allowed with %d remaining, got %+v", i, res)
+		}
+	}
+	tat, res = limit.Apply(tat, now)
+	if res.Allowed || res.RetryAfter != time.Second || res.Reset != 3*time.Second {
+		t.Fatalf("expected burst to be used up, got %+v", res)
+	}
+
+	// a token comes back every second.
+	now = now.Add(time.Second)
+	if tat, res = limit.Apply(tat, now); !res.Allowed || res.Remaining != 0 {
+		t.Errorf("expected a request to be allowed after a second, got %+v", res)
+	}
+	now = now.Add(time.Minute)
+	if _, res = limit.Apply(tat, now); !res.Allowed || res.Remaining != 2 {
+		t.Errorf("expected the full burst to be back, got %+v", res)
+	}
+}
+
+func rateLimitRouter(t *testing.T, handlers string) *Router {
+	RegisterHandler("testOk", func(req *Request) (Response, error) {
+		return PlaintextResponseString("ok", http.StatusOK), nil
+	})
+	return httpAuthRouter(t, `[
+		{"route": "^/a$", "name": "a", "handlers": [`+handlers+`, "testOk"]},
+		{"route": "^/b$", "name": "b", "handlers": [`+handlers+`, "testOk"]}
+	]`)
+}
+
+func rateLimitGet(router *Router, path, addr string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	req.RemoteAddr = addr
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestRateLimitStage(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	defer store.Close()
+	SetRateLimitStore(store)
+
+	router := rateLimitRouter(t, `"RateLimit(2, 1m)"`)
+	for i, remaining := range []string{"1", "0"} {
+		w := rateLimitGet(router, "/a", "10.0.0.1:1234")
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d: expected 200, got %d", i, w.Code)
+		}
+		if got := w.Header().Get("RateLimit-Remaining"); got != remaining {
+			t.Errorf("request %d: expected %s remaining, got %s", i, remaining, got)
+		}
+		if got := w.Header().Get("RateLimit-Limit"); got != "2" {
+			t.Errorf("request %d: expected a limit of 2, got %s", i, got)
+		}
+	}
+	w := rateLimitGet(router, "/a", "10.0.0.1:1234")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "30" {
+		t.Errorf("expected to be told to retry after 30s, got %q", got)
+	}
+	if got := w.Header().Get("RateLimit-Policy"); got != "2;w=60" {
+		t.Errorf("unexpected policy %q", got)
+	}
+
+	// other clients, and other routes, have allowances of their own.
+	if w := rateLimitGet(router, "/a", "10.0.0.2:1234"); w.Code != http.StatusOK {
+		t.Errorf("expected another client to be let through, got %d", w.Code)
+	}
+	if w := rateLimitGet(router, "/b", "10.0.0.1:1234"); w.Code != http.StatusOK {
+		t.Errorf("expected another route's limiter to let the client through, got %d", w.Code)
+	}
+
+	store.sweep(time.Now().Add(time.Hour))
+	if n := store.Len(); n != 0 {
+		t.Errorf("expected sweep to forget every client, %d left", n)
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	defer store.Close()
+
+	limiter, err := NewRateLimiter(RateLimit{Requests: 1, Per: time.Minute}, RouteKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter.Store = store
+	router := rateLimitRouter(t, `"testOk"`)
+	router.Use(limiter.Stage)
+
+	for _, path := range []string{"/a", "/b"} {
+		if w := rateLimitGet(router, path, "10.0.0.1:1234"); w.Code != http.StatusOK {
+			t.Errorf("%s: expected first request to be let through, got %d", path, w.Code)
+		}
+		if w := rateLimitGet(router, path, "10.0.0.1:1234"); w.Code != http.StatusTooManyRequests {
+			t.Errorf("%s: expected second request to be turned away, got %d", path, w.Code)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	defer func(trust bool) { Config.Core.TrustProxy = trust }(Config.Core.TrustProxy)
+	req := &Request{Request: httptest.NewRequest("GET", "/", nil)}
+	req.RemoteAddr = "192.0.2.1:5555"
+	req.Header.Add("X-Forwarded-For", "203.0.113.9, 198.51.100.7")
+
+	Config.Core.TrustProxy = false
+	if ip := req.ClientIP(); ip != "192.0.2.1" {
+		t.Errorf("expected X-Forwarded-For to be ignored, got %s", ip)
+	}
+	Config.Core.TrustProxy = true
+	if ip := req.ClientIP(); ip != "198.51.100.7" {
+		t.Errorf("expected the address added by the proxy, got %s", ip)
+	}
+}
+
+func TestRateLimitFactory(t *testing.T) {
+	var stage Stage
+	for _, bad := range []string{`"RateLimit(10)"`, `"RateLimit(x, 1m)"`, `"RateLimit(10, soon)"`, `"RateLimit(10, 1m, nobody)"`, `"RateLimit(0, 1m)"`} {
+		if err := stage.UnmarshalJSON([]byte(bad)); err == nil {
+			t.Errorf("expected %s to be refused", bad)
+		}
+	}
+	if err := stage.UnmarshalJSON([]byte(`"RateLimit(100, 1h, session, 20)"`)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestSessionRateLimitKey(t *testing.T) {
+	defer useCookieStore(t, testKey(1))()
+	router := sessionRouter()
+	router.AddRoute("^/key$", "key", func(req *Request) (Response, error) {
+		key, err := SessionKeyOrIP(req)
+		if err != nil {
+			return nil, err
+		}
+		return PlaintextResponseString(key, http.StatusOK), nil
+	})
+
+	first := sessionCookie(sessionGet(router, "/set", nil))
+	latest := sessionCookie(sessionGet(router, "/set", first))
+	if first == nil || latest == nil || first.Value == latest.Value {
+		t.Fatalf("expected the session cookie to change when the session is saved, got %v and %v", first, latest)
+	}
+	key := sessionGet(router, "/key", first).Body.String()
+	if !strings.HasPrefix(key, "session:") {
+		t.Fatalf("expected a session key, got %q", key)
+	}
+	if got := sessionGet(router, "/key", latest).Body.String(); got != key {
+		t.Errorf("expected every cookie of a session to count against it, got %q and %q", key, got)
+	}
+	if other := sessionCookie(sessionGet(router, "/set", nil)); sessionGet(router, "/key", other).Body.String() == key {
+		t.Errorf("expected another session to have a key of its own")
+	}
+
+	// a session with no identity of its own counts against the client's IP.
+	value, err := sessions.(ClientSessionHandler).Encode(Session{"name": "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := &http.Cookie{Name: first.Name, Value: value}
+	if got := sessionGet(router, "/key", legacy).Body.String(); !strings.HasPrefix(got, "ip:") {
+		t.Errorf("expected a session without an identity to be keyed by IP, got %q", got)
+	}
+}
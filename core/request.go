@@ -1,9 +1,7 @@
 package din
 
 import (
-	"encoding/json"
 	"fmt"
-	"github.com/jordanorelli/din/dinutil"
 	"net/http"
 	"path"
 	"reflect"
@@ -33,11 +31,27 @@ type Request struct {
 	// time that the request was received.
 	Received time.Time
 
-	logmux      sync.Mutex
-	s           Session
-	sessionKey  string
-	newSession  bool
-	saveSession bool
+	logmux         sync.Mutex
+	s              Session
+	sessionKey     string
+	replacedKey    string
+	newSession     bool
+	sessionDirty   bool
+	sessionCleared bool
+	sessionEncoded bool
+	header         http.Header
+	csrfToken      string
+	flashes        []Flash
+	flashesRead    bool
+	failed         bool
+	committed      bool
+	tempFileUsers  int32
+	user           User
+	authenticated  bool
+	claims         Claims
+	cspNonce       string
+	cacheFlight    *cacheFlight
+	router         *Router
 }
 
 // parses an int from the query parameters found in the request.  The parameter
@@ -49,18 +63,18 @@ func (r *Request) BoundedInt(name string, required bool, min, max int) (int, err
 
 	if val_s == "" {
 		if required {
-			return 0, fmt.Errorf(`Missing required int parameter "%s"`, name)
+			return 0, invalidParam(name, "missing required int parameter")
 		}
 		return min, nil
 	}
 
 	val, err := strconv.Atoi(val_s)
 	if err != nil {
-		return 0, err
+		return 0, invalidParam(name, "must be an integer")
 	}
 
 	if val > max || val < min {
-		return 0, fmt.Errorf("%s parameter out of range. Min: %d, Max: %d", name, min, max)
+		return 0, invalidParam(name, fmt.Sprintf("out of range. Min: %d, Max: %d", min, max))
 	}
 
 	return val, nil
@@ -77,14 +91,14 @@ func (r *Request) Timestamp(name string, required bool) (time.Time, error) {
 
 	if val_s == "" {
 		if required {
-			return *new(time.Time), fmt.Errorf(`Missing required timestamp parameter "%s"`, name)
+			return *new(time.Time), invalidParam(name, "missing required timestamp parameter")
 		}
 		return *new(time.Time), nil
 	}
 
 	val, err := strconv.ParseInt(val_s, 10, 0)
 	if err != nil {
-		return *new(time.Time), err
+		return *new(time.Time), invalidParam(name, "must be a unix timestamp")
 	}
 
 	return time.Unix(val, 0), nil
@@ -131,12 +145,18 @@ func (r *Request) LogReceived() (int, error) {
 
 func (r *Request) LogError(err error) {
 	var statusCode int
+	var cause error
 	switch e := err.(type) {
 	case Error:
 		statusCode = e.StatusCode
+		cause = e.Cause
 	default:
 		statusCode = http.StatusInternalServerError
 	}
+	if cause != nil {
+		fmt.Println(statusCode, time.Now().Unix(), r.Id, statusCode, time.Since(r.Received), err.Error(), "cause:", cause.Error())
+		return
+	}
 	fmt.Println(statusCode, time.Now().Unix(), r.Id, statusCode, time.Since(r.Received), err.Error())
 }
 
@@ -161,15 +181,10 @@ func (r *Request) Logf(format string, v ...interface{}) {
 	fmt.Printf(format, v...)
 }
 
+// UnmarshalJSON decodes the request body as json into v, using the decoding
+// options found in the json section of the config.  See DecodeJSON.
 func (r *Request) UnmarshalJSON(v interface{}) error {
-	err := json.NewDecoder(r.Body).Decode(v)
-	if err != nil {
-		return Error{
-			StatusCode: http.StatusBadRequest,
-			Message:    `invalid json input`,
-		}
-	}
-	return nil
+	return r.DecodeJSON(v, Config.JSON)
 }
 
 func (r *Request) SessionGet(key string, dest interface{}) error {
@@ -180,56 +195,277 @@ func (r *Request) SessionGet(key string, dest interface{}) error {
 	return s.get(key, dest)
 }
 
+// sessionDelete removes a single key from the client's session.
+func (r *Request) sessionDelete(key string) {
+	s, err := r.session()
+	if err != nil {
+		return
+	}
+	if _, ok := s[key]; ok {
+		delete(s, key)
+		r.sessionDirty = true
+		r.sessionEncoded = false
+	}
+}
+
 func (r *Request) SessionClear() {
 	key, err := r.SessionKey()
 	if err == nil {
 		sessions.Delete(key)
 	}
+	if r.replacedKey != "" {
+		sessions.Delete(r.replacedKey)
+		r.replacedKey = ""
+	}
+	r.s = nil
+	r.sessionDirty = false
+	r.newSession = false
+	r.sessionCleared = true
 }
 
 func (r *Request) createSession() {
+	id, err := newSessionId()
+	if err != nil {
+		// there's no sensible way to carry on without a source of
+		// randomness; we certainly can't hand out guessable session ids.
+		panic("din: unable to generate session id: " + err.Error())
+	}
 	r.s = make(Session, 5)
+	r.s.setTimestamp(sessionCreatedKey, time.Now())
+	setClientSessionId(r.s, id)
 	r.newSession = true
-	r.sessionKey = dinutil.RandomString(32)
+	r.sessionKey = id
+}
+
+// setClientSessionId, when sessions are kept by a ClientSessionHandler,
+// stores id in the session as the identity that SessionIdentity gives for
+// it, since the key of such a session is the encoded session itself, which
+// changes each time it's saved.
+func setClientSessionId(s Session, id string) {
+	if _, ok := sessions.(ClientSessionHandler); ok {
+		s[sessionIdKey] = id
+	}
+}
+
+// SessionIdentity gives an identifier for the client's session that stays
+// the same for as long as the session does, until it's regenerated, for
+// keying things such as rate limits and cached responses by session.  It's
+// as much of a secret as the session id, and should be hashed before it's
+// stored anywhere.  Sessions kept by a ClientSessionHandler that were
+// started before din recorded identities in them have none, and give
+// ErrNoSessionId.
+func (r *Request) SessionIdentity() (string, error) {
+	s, err := r.session()
+	if err != nil {
+		return "", err
+	}
+	if _, ok := sessions.(ClientSessionHandler); !ok {
+		return r.SessionKey()
+	}
+	if id, ok := s[sessionIdKey].(string); ok && id != "" {
+		return id, nil
+	}
+	return "", ErrNoSessionId
 }
 
 func (r *Request) SessionSet(key string, v interface{}) {
 	if r.s == nil {
-		r.createSession()
+		if _, err := r.session(); err != nil {
+			r.createSession()
+		}
 	}
 	r.s.set(key, v)
-	r.saveSession = true
+	r.sessionDirty = true
+	r.sessionEncoded = false
 }
 
+// SessionRegenerate moves the client's session to a new session id, carrying
+// over everything stored in it, and discards the old id.  This should be
+// called whenever the client's privileges change, such as at login or
+// logout, so that a session id that leaked beforehand (or was planted by an
+// attacker, in a session fixation attack) is worthless afterwards.  If the
+// client has no session, a new one is started.  The old id is only discarded
+// once the session has been saved under the new one; if the request fails
+// and the session isn't saved, the client keeps the session it had.
+func (r *Request) SessionRegenerate() error {
+	s, err := r.session()
+	if err != nil {
+		s = nil
+	}
+	id, err := newSessionId()
+	if err != nil {
+		return err
+	}
+	if old, err := r.SessionKey(); err == nil && r.replacedKey == "" {
+		r.replacedKey = old
+	}
+	if s == nil {
+		s = make(Session, 5)
+		s.setTimestamp(sessionCreatedKey, time.Now())
+	}
+	setClientSessionId(s, id)
+	r.s = s
+	r.sessionKey = id
+	r.newSession = true
+	r.sessionDirty = true
+	r.sessionEncoded = false
+	return nil
+}
+
+// session loads the client's session from the session store.  Sessions that
+// have outlived the configured timeouts are deleted and reported as
+// ErrSessionExpired.
 func (r *Request) session() (Session, error) {
 	if r.s != nil {
 		return r.s, nil
 	}
+	if r.sessionCleared {
+		return nil, ErrNoSessionId
+	}
 	key, err := r.SessionKey()
 	if err != nil {
 		return nil, err
 	}
-	return sessions.Get(key)
+	s, err := sessions.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if s.expired(time.Now()) {
+		if err := sessions.Delete(key); err != nil {
+			r.LogError(err)
+		}
+		return nil, ErrSessionExpired
+	}
+	r.s = s
+	return s, nil
+}
+
+// sessionStale tells us whether a session that has been read, but not
+// modified, should be written back anyway, so that its expiry slides forward.
+// So as to not write out every session on every request, that's only done
+// once a tenth of the session's lifetime has passed since it was last saved.
+func (r *Request) sessionStale(now time.Time) bool {
+	accessed, ok := r.s.timestamp(sessionAccessedKey)
+	return !ok || now.Sub(accessed) > Config.Sessions.storeTTL()/10
+}
+
+// needsSave tells us whether the session has to be written out at the end of
+// the request.
+func (r *Request) needsSave(now time.Time) bool {
+	if r.s == nil {
+		return false
+	}
+	if r.failed && !Config.Sessions.SaveOnError {
+		return false
+	}
+	return r.sessionDirty || r.sessionStale(now)
+}
+
+// encodeSession, when sessions are kept by a ClientSessionHandler, encodes
+// the session as the new value of the session cookie, if it needs saving.
+// If the session can't be encoded, it isn't saved.
+func (r *Request) encodeSession() error {
+	enc, ok := sessions.(ClientSessionHandler)
+	now := time.Now()
+	if !ok || r.sessionEncoded || !r.needsSave(now) {
+		return nil
+	}
+	r.s.setTimestamp(sessionAccessedKey, now)
+	value, err := enc.Encode(r.s)
+	if err != nil {
+		r.s = nil
+		r.newSession = false
+		return err
+	}
+	r.sessionKey = value
+	r.newSession = true
+	r.sessionEncoded = true
+	return nil
+}
+
+// commitSession is the last thing done with the session on every response,
+// just before the response headers are written, however the response came
+// about.  A session that was modified is saved, and one that was only read
+// has its expiry slid forward in the store every so often; then the session
+// cookie is set or cleared as needed.  If a stage returned an error or
+// panicked, changes to the session are thrown away unless save_on_error is
+// set in the sessions config.
+func (r *Request) commitSession(w http.ResponseWriter) {
+	if r.committed {
+		return
+	}
+	r.committed = true
+	if r.revalidating() {
+		return
+	}
+
+	if r.s == nil {
+		if r.sessionCleared {
+			clearSessionId(w)
+		}
+		return
+	}
+	if _, ok := sessions.(ClientSessionHandler); ok {
+		if err := r.encodeSession(); err != nil {
+			r.LogError(err)
+		}
+		if r.sessionEncoded {
+			setSessionId(w, r.sessionKey)
+			r.deleteReplacedSession()
+		}
+		return
+	}
+
+	now := time.Now()
+	if !r.needsSave(now) {
+		return
+	}
+	if r.sessionDirty {
+		r.s.setTimestamp(sessionAccessedKey, now)
+		if err := sessions.Set(r.sessionKey, r.s); err != nil {
+			r.LogError(err)
+			return
+		}
+	} else if err := touchSession(r.sessionKey, now); err != nil {
+		// a session that has gone from the store since it was read was
+		// cleared by another request, and must stay that way.
+		if err != ErrUnknownSessionId {
+			r.LogError(err)
+		}
+		return
+	}
+	r.deleteReplacedSession()
+	// the cookie is sent again when the session is refreshed, so that a
+	// cookie with a max age slides forward along with the session.
+	if r.newSession || Config.Sessions.MaxAge > 0 {
+		setSessionId(w, r.sessionKey)
+	}
+}
+
+// deleteReplacedSession deletes the session that SessionRegenerate moved away
+// from, now that the session has been saved under its new id.
+func (r *Request) deleteReplacedSession() {
+	if r.replacedKey == "" {
+		return
+	}
+	if err := sessions.Delete(r.replacedKey); err != nil {
+		r.LogError(err)
+	}
+	r.replacedKey = ""
 }
 
 func (r *Request) SessionKey() (string, error) {
 	if r.sessionKey != "" {
 		return r.sessionKey, nil
 	}
-	cookie, err := r.Cookie(SESSION_COOKIE_NAME)
+	cookie, err := r.Cookie(Config.Sessions.cookieName())
 	if err != nil {
 		return "", ErrNoSessionId
 	}
-	/*
-		if !cookie.HttpOnly {
-			r.Log("WARN: potential false cookie attempt: cookie is not http only")
-			return "", ErrInvalidSessionCookie
-		}
-		if !cookie.Secure {
-			r.Log("WARN: potential false cookie attempt: cookie is not secure")
-			return "", ErrInvalidSessionCookie
-		}
-	*/
+	if _, ok := sessions.(ClientSessionHandler); !ok && !validSessionId(cookie.Value) {
+		r.Log("WARN: rejecting malformed session id")
+		return "", ErrInvalidSessionCookie
+	}
 	r.sessionKey = cookie.Value
 	return cookie.Value, nil
 }
@@ -277,9 +513,14 @@ func (r *Request) QueryVal(key string, v interface{}) error {
 		if u, isUnmarshaler := rv.Interface().(Unmarshaler); isUnmarshaler {
 			s := r.URL.Query().Get(key)
 			if s == "" {
-				return fmt.Errorf(`din: key missing in Request.QueryVal`)
+				return invalidParam(key, "missing required parameter")
 			}
-			return u.Unmarshal(s)
+			if err := u.Unmarshal(s); err != nil {
+				verr := invalidParam(key, "invalid value")
+				verr.Cause = err
+				return verr
+			}
+			return nil
 		}
 	}
 
@@ -287,12 +528,12 @@ func (r *Request) QueryVal(key string, v interface{}) error {
 	case *int:
 		s := r.URL.Query().Get(key)
 		if s == "" {
-			return fmt.Errorf(`din: key missing in Request.QueryVal`)
+			return invalidParam(key, "missing required parameter")
 		}
 
 		i, err := strconv.ParseInt(s, 10, 0)
 		if err != nil {
-			return err
+			return invalidParam(key, "must be an integer")
 		}
 		reflect.Indirect(rv).SetInt(i)
 		return nil
@@ -300,7 +541,7 @@ func (r *Request) QueryVal(key string, v interface{}) error {
 	case *string:
 		s := r.URL.Query().Get(key)
 		if s == "" {
-			return fmt.Errorf(`din: key missing in Request.QueryVal`)
+			return invalidParam(key, "missing required parameter")
 		}
 
 		reflect.Indirect(rv).SetString(s)
@@ -330,15 +571,36 @@ func KwargMissing(key string) Error {
 	}
 }
 
-// tells us whether a request is signed with an csrf token or not.  Right now,
-// this doesn't actually do any *security*, it just checks for the existence of
-// a _din_csrf cookie.
-func (r *Request) IsSigned() bool {
-	if _, err := r.Cookie(CSRFKey); err == nil {
-		return true
+// ResponseHeader returns the header map that will be added to the response
+// to this request, whichever stage ends up producing it, and even if that
+// stage returns an error.  This is how stages that run ahead of the one that
+// produces the response (e.g., authentication or csrf stages) get headers
+// and cookies onto it.
+func (r *Request) ResponseHeader() http.Header {
+	if r.header == nil {
+		r.header = make(http.Header)
 	}
-	if v := r.URL.Query().Get(CSRFKey); v != "" {
-		return true
+	return r.header
+}
+
+// SetCookie adds a Set-Cookie header to the response to this request.
+func (r *Request) SetCookie(cookie *http.Cookie) {
+	if v := cookie.String(); v != "" {
+		r.ResponseHeader().Add("Set-Cookie", v)
 	}
-	return false
+}
+
+// writeHeader copies the headers accumulated with ResponseHeader into w.
+func (r *Request) writeHeader(w http.ResponseWriter) {
+	h := w.Header()
+	for k, v := range r.header {
+		h[k] = append(h[k], v...)
+	}
+}
+
+// tells us whether a request is signed with a valid csrf token or not.  The
+// token may be supplied in either the csrf form field or the csrf header.  See
+// CSRFProtect.
+func (r *Request) IsSigned() bool {
+	return r.checkCSRFToken() == nil
 }
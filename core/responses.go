@@ -135,3 +135,26 @@ type notFoundResponse struct {
 	body        io.Reader
 	contentType string
 }
+
+func (r *notFoundResponse) Render(w http.ResponseWriter) error {
+	if r.contentType != "" {
+		w.Header().Set("Content-Type", r.contentType)
+	}
+	w.WriteHeader(http.StatusNotFound)
+	if r.body != nil {
+		_, err := io.Copy(w, r.body)
+		return err
+	}
+	return nil
+}
+
+func (r *notFoundResponse) Status() int {
+	return http.StatusNotFound
+}
+
+// NotFound creates a 404 response with the given body.  This is for handlers
+// that want full control over what a 404 looks like; to get the project's
+// usual 404 page, return ErrNotFound instead.
+func NotFound(contentType string, body io.Reader) Response {
+	return &notFoundResponse{body, contentType}
+}
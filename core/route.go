@@ -5,7 +5,6 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
 	"os"
 	"regexp"
@@ -32,6 +31,7 @@ type Router struct {
 	OnError         ErrorHandler
 	On404           NotFoundHandler
 	routes          []*Pipeline
+	middleware      []Stage
 	staticWhitelist []string
 	staticPaths     []staticPath
 	started         time.Time
@@ -45,6 +45,23 @@ type Pipeline struct {
 	Name     string  `json:"name"`
 	Doc      string  `json:"doc"`
 	Handlers []Stage `json:"handlers"`
+
+	// the largest request body, in bytes, that this pipeline will accept.
+	// Zero means that the max_body_size from the core config applies, and a
+	// negative value means that there is no limit at all.
+	MaxBodySize int64 `json:"max_body_size"`
+
+	// exempts the pipeline from the checks performed by CSRFProtect, for
+	// endpoints that are called by other servers rather than by browsers.
+	CSRFExempt bool `json:"csrf_exempt"`
+
+	// CORS options for this pipeline, in place of those in the cors section
+	// of the config file.
+	CORS *CORSOptions `json:"cors"`
+
+	// how the Cache stage caches the responses of this pipeline.  Without
+	// cache options, the pipeline's responses aren't cached.
+	CacheOptions *CacheOptions `json:"cache_options"`
 }
 
 func (p *Pipeline) String() string {
@@ -66,15 +83,29 @@ func NewRouter(errorHandler ErrorHandler, panicHandler PanicHandler) *Router {
 	}
 }
 
+// DefaultPanicHandler recovers from a panic in a pipeline stage and renders it
+// as a 500 error.  The panic value is logged, but the user only sees a generic
+// error page.
 func DefaultPanicHandler(w http.ResponseWriter, r *Request, p chan struct{}) {
 	if recovered := recover(); recovered != nil {
 		defer close(p)
-		fmt.Fprint(w, recovered)
+		r.LogPanic(recovered)
+		renderError(w, r, Error{
+			StatusCode: http.StatusInternalServerError,
+			Message:    http.StatusText(http.StatusInternalServerError),
+			Cause:      fmt.Errorf("panic: %v", recovered),
+		})
 	}
 }
 
-func JSONPanicHandler(w http.ResponseWriter, r *http.Request) {
+// JSONPanicHandler recovers from a panic in a pipeline stage and renders the
+// panic value along with a stack trace as json.  This exposes the innards of
+// your application to whoever triggered the panic, so it should only be used
+// for debugging.
+func JSONPanicHandler(w http.ResponseWriter, r *Request, p chan struct{}) {
 	if recovered := recover(); recovered != nil {
+		defer close(p)
+		r.LogPanic(recovered)
 		s := make([]uintptr, 10)
 		n := runtime.Callers(PanicDepth, s)
 		type trace struct {
@@ -91,87 +122,193 @@ func JSONPanicHandler(w http.ResponseWriter, r *http.Request) {
 		raw, err := json.MarshalIndent(struct {
 			Recovered interface{} `json:"recovered"`
 			Trace     []trace     `json:"trace"`
-		}{recovered, deets}, "", "  ")
+		}{fmt.Sprint(recovered), deets}, "", "  ")
 		if err != nil {
-			io.WriteString(w, "whyyyy")
+			renderError(w, r, asError(err))
 			return
 		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
 		w.Write(raw)
 	}
 }
 
+// DefaultErrorHandler renders the error returned by a pipeline stage.  The
+// response is negotiated from the request's Accept header: browsers get an
+// html page rendered from the errors/<code>.html template, api clients get
+// json, and everybody else gets plain text.  Errors that aren't din.Errors
+// are rendered as a generic 500, since their messages aren't known to be safe
+// to show to the user.
 func DefaultErrorHandler(w http.ResponseWriter, req *Request, err error) {
-	switch e := err.(type) {
-	case Error:
-		w.WriteHeader(e.StatusCode)
-		io.WriteString(w, e.Message)
-	default:
-		w.WriteHeader(http.StatusInternalServerError)
-		io.WriteString(w, e.Error())
-	}
+	renderError(w, req, asError(err))
 }
 
+// how long the stages of a pipeline have to come up with a response before
+// the request is given up on with ErrTimeout.
+var stageTimeout = 30 * time.Second
+
 // implements the http.Handler interface, so that we may use our router with
 // the default http package.
 func (r *Router) ServeHTTP(w http.ResponseWriter, raw *http.Request) {
-	c, errchan, p := make(chan Response), make(chan error), make(chan struct{})
+	// the stages can hand over their outcome and finish even if nobody is
+	// waiting for it anymore, as when the request has timed out.
+	c, errchan, p := make(chan Response, 1), make(chan error, 1), make(chan struct{})
 	req := r.match(raw)
 
+	defer req.holdTempFiles()()
+	defer req.finishCaching()
+
+	if cw := r.compressWriter(w, req); cw != nil {
+		defer cw.Close()
+		w = cw
+	}
+
+	// every response, however it comes about, goes out through hw, so that
+	// it carries the headers set on the request and the session is saved.
+	hw := &hookedWriter{ResponseWriter: w, beforeWrite: func() {
+		req.writeHeader(w)
+		req.commitSession(w)
+	}}
+
 	if req.RouteMatch == nil {
-		req.LogResponse(http.StatusNotFound)
-		if r.On404 != nil {
-			r.On404(w, req)
-			return
-		}
-		w.WriteHeader(http.StatusNotFound)
-		w.Write([]byte("404"))
+		r.notFound(hw, req)
+		hw.finish()
 		return
 	}
 
+	if r.handleCORS(hw, req) {
+		return
+	}
+
+	if err := req.limitBody(hw); err != nil {
+		r.OnError(hw, req, err)
+		hw.finish()
+		req.LogError(err)
+		return
+	}
+
+	release := req.holdTempFiles()
 	go func() {
-		defer r.OnPanic(w, req, p)
-		for _, fn := range req.Pipeline.Handlers {
+		defer release()
+		defer r.OnPanic(hw, req, p)
+		// marks the request as failed if a stage panics, before OnPanic
+		// renders the failure.
+		finished := false
+		defer func() {
+			if !finished {
+				req.failed = true
+			}
+		}()
+		for _, fn := range r.stages(req.Pipeline) {
 			res, err := fn(req)
 			if err != nil {
+				req.failed = true
+				finished = true
 				errchan <- err
 				return
 			}
 			if res != nil {
+				finished = true
 				c <- res
 				return
 			}
 		}
+		finished = true
 	}()
 
 	req.Logf("route: %v", req.RouteMatch.Pipeline.Name)
 
 	select {
-	case <-time.After(30 * time.Second):
-		w.WriteHeader(http.StatusGatewayTimeout)
-		w.Write([]byte("herp derp, i timed out"))
+	case <-time.After(stageTimeout):
+		// whatever the stages have done so far is abandoned along with
+		// them, as for any other failure.
+		req.failed = true
+		r.OnError(hw, req, ErrTimeout)
+		hw.finish()
 		req.LogTimeout()
 	case res := <-c:
-		if req.newSession {
-			setSessionId(w, req.sessionKey)
+		if b, ok := res.(requestBinder); ok {
+			b.bindRequest(req)
 		}
-		if err := res.Render(w); err != nil {
+		// a session that's too large for its cookie should be reported in
+		// place of the response, rather than lost after the fact.
+		if err := req.encodeSession(); err != nil {
+			r.OnError(hw, req, err)
 			req.LogError(err)
 			break
 		}
-		if req.saveSession {
-			if err := sessions.Set(req.sessionKey, req.s); err != nil {
-				req.LogError(err)
-			}
+		// the client may already have the response, or may only want it
+		// under conditions that don't hold.
+		if alt, err := conditional(req, res); err != nil {
+			r.OnError(hw, req, err)
+			hw.finish()
+			req.LogError(err)
+			break
+		} else if alt != nil {
+			res = alt
+		}
+		if err := res.Render(req.cacheWriter(hw)); err != nil {
+			hw.finish()
+			req.LogError(err)
+			break
 		}
+		hw.finish()
 		req.LogResponse(res.Status())
 	case err := <-errchan:
-		r.OnError(w, req, err)
+		r.OnError(hw, req, err)
+		hw.finish()
 		req.LogError(err)
 	case <-p:
 		break
 	}
 }
 
+// Use installs stages that run ahead of the handlers of every pipeline, in
+// the order given.  This is how stages that concern the whole site, such as
+// CSRFProtect, are set up.
+func (r *Router) Use(stages ...Stage) {
+	r.middleware = append(r.middleware, stages...)
+}
+
+// stages gives the full list of stages that a request matching p passes
+// through.
+func (r *Router) stages(p *Pipeline) []Stage {
+	if len(r.middleware) == 0 {
+		return p.Handlers
+	}
+	stages := make([]Stage, 0, len(r.middleware)+len(p.Handlers))
+	stages = append(stages, r.middleware...)
+	return append(stages, p.Handlers...)
+}
+
+// notFound handles a request that didn't match any route.  First we see if
+// the request can be satisfied by a static file; failing that, the router's
+// On404 handler gets a crack at it.  If there's no On404 handler, ErrNotFound
+// goes through OnError like any other error, so that it is logged and
+// rendered the same way (and with the same errors/404.html template) as a 404
+// returned by a pipeline stage.
+func (r *Router) notFound(w http.ResponseWriter, req *Request) {
+	if StaticRoot != "" || len(r.staticPaths) > 0 {
+		err := r.TryStatic(w, req)
+		if err == nil {
+			req.LogResponse(http.StatusOK)
+			return
+		}
+		if e, ok := err.(Error); !ok || e.StatusCode != http.StatusNotFound {
+			r.OnError(w, req, err)
+			req.LogError(err)
+			return
+		}
+	}
+	if r.On404 != nil {
+		req.LogResponse(http.StatusNotFound)
+		r.On404(w, req)
+		return
+	}
+	r.OnError(w, req, ErrNotFound)
+	req.LogError(ErrNotFound)
+}
+
 func (r *Router) ListenAndServe(addr string) error {
 	server := &http.Server{Addr: addr, Handler: r}
 	return server.ListenAndServe()
@@ -184,6 +321,7 @@ func (r *Router) match(raw *http.Request) *Request {
 		Request:  raw,
 		Id:       newRequestId(),
 		Received: time.Now(),
+		router:   r,
 	}
 
 	req.LogReceived() // TODO: observe returned error val
@@ -204,9 +342,9 @@ func (s *Stage) UnmarshalJSON(b []byte) error {
 	if err := json.Unmarshal(b, &name); err != nil {
 		return err
 	}
-	found, ok := getHandler(name)
-	if !ok {
-		return ErrUnknownHandler(name)
+	found, err := getHandler(name)
+	if err != nil {
+		return err
 	}
 	*s = found
 	return nil
@@ -218,12 +356,24 @@ type Response interface {
 	Status() int
 }
 
-func (router *Router) AddRoute(pattern string, name string, stages ...Stage) {
-	router.routes = append(router.routes, &Pipeline{
+// a requestBinder is a Response that needs to know which request it is
+// responding to in order to render itself.  The router hands the request over
+// just before rendering.
+type requestBinder interface {
+	bindRequest(*Request)
+}
+
+// AddRoute registers a pipeline of stages to handle requests whose path
+// matches pattern.  The new pipeline is returned so that its options may be
+// adjusted.
+func (router *Router) AddRoute(pattern string, name string, stages ...Stage) *Pipeline {
+	p := &Pipeline{
 		Route:    NewRoute(pattern),
 		Name:     name,
 		Handlers: stages,
-	})
+	}
+	router.routes = append(router.routes, p)
+	return p
 }
 
 type RouteMatch struct {
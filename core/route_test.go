@@ -1,6 +1,14 @@
 package din
 
-import "testing"
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
 
 func TestNoMatch(t *testing.T) {
 	r := NewRoute("^/foo$")
@@ -76,3 +84,79 @@ func TestHeterogenous(t *testing.T) {
 		t.Errorf("found bad match.")
 	}
 }
+
+func serve(router *Router, path, accept string) *httptest.ResponseRecorder {
+	raw, _ := http.NewRequest("GET", path, nil)
+	raw.Header.Set("Accept", accept)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, raw)
+	return w
+}
+
+// tests the flow for requests that match no route: static files first, then
+// On404, then the templated 404 page.
+func TestNotFound(t *testing.T) {
+	dir, err := ioutil.TempDir("", "din-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "static"), 0755)
+	os.MkdirAll(filepath.Join(dir, "templates", "errors"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "static", "robots.txt"), []byte("User-agent: *"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "templates", "errors", "404.html"), []byte("<p>lost: {{.Request.URL.Path}}</p>"), 0644)
+
+	defer func(root string, dirs []string) {
+		StaticRoot, Config.Core.TemplateDirs = root, dirs
+	}(StaticRoot, Config.Core.TemplateDirs)
+	StaticRoot = filepath.Join(dir, "static")
+	Config.Core.TemplateDirs = []string{filepath.Join(dir, "templates")}
+
+	router := NewRouter(nil, nil)
+	if w := serve(router, "/robots.txt", "*/*"); w.Code != http.StatusOK || w.Body.String() != "User-agent: *" {
+		t.Errorf("expected static file, got %d %q", w.Code, w.Body.String())
+	}
+	if w := serve(router, "/nope", "text/html"); w.Code != http.StatusNotFound || w.Body.String() != "<p>lost: /nope</p>" {
+		t.Errorf("expected templated 404, got %d %q", w.Code, w.Body.String())
+	}
+	if w := serve(router, "/nope", "application/json"); w.Header().Get("Content-Type") != ProblemContentType {
+		t.Errorf("expected negotiated 404, got content type %q", w.Header().Get("Content-Type"))
+	}
+
+	router.On404 = func(w http.ResponseWriter, req *Request) {
+		req.ResponseHeader().Set("X-Lost", "yes")
+		w.WriteHeader(http.StatusTeapot)
+	}
+	if w := serve(router, "/nope", "text/html"); w.Code != http.StatusTeapot || w.Header().Get("X-Lost") != "yes" {
+		t.Errorf("expected On404 to be called with the request's headers, got %d %v", w.Code, w.Header())
+	}
+	if w := serve(router, "/robots.txt", "*/*"); w.Code != http.StatusOK {
+		t.Errorf("expected static file to take precedence over On404, got %d", w.Code)
+	}
+}
+
+func TestStaticTraversal(t *testing.T) {
+	defer func(root string) { StaticRoot = root }(StaticRoot)
+	dir := t.TempDir()
+	StaticRoot = filepath.Join(dir, "public")
+	if err := os.Mkdir(StaticRoot, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "secret.txt"), []byte("hunter2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(StaticRoot, "ok.txt"), []byte("fine"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouter(nil, nil)
+
+	for _, target := range []string{"/../secret.txt", "/a/../../secret.txt", "/..%2fsecret.txt", `/..\secret.txt`} {
+		w := serve(router, target, "*/*")
+		if w.Code == http.StatusOK || strings.Contains(w.Body.String(), "hunter2") {
+			t.Errorf("%s: expected the file outside the static root to be refused, got %d %q", target, w.Code, w.Body.String())
+		}
+	}
+	if w := serve(router, "/./ok.txt", "*/*"); w.Code != http.StatusOK || w.Body.String() != "fine" {
+		t.Errorf("expected a file inside the static root to be served, got %d %q", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,137 @@
+package din
+
+import (
+	"github.com/jordanorelli/din/dinutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// placeholder in the content security policy that's replaced with the
+// request's nonce.
+const cspNoncePlaceholder = "{nonce}"
+
+// number of random bytes in a csp nonce.
+const cspNonceLen = 16
+
+// SecurityOptions configures the headers set by the SecurityHeaders stage.
+// These are read from the security section of the config file.  Headers
+// whose options are empty aren't sent; nosniff, a DENY frame policy and a
+// strict-origin-when-cross-origin referrer policy are sent unless the config
+// says otherwise.
+type SecurityOptions struct {
+	// the Content-Security-Policy.  Any occurrence of {nonce} is replaced
+	// with a nonce made for the request, e.g.:
+	//
+	//	"script-src 'self' 'nonce-{nonce}'"
+	//
+	// so that inline scripts may be allowed one by one, by giving them the
+	// nonce from the csp_nonce template function:
+	//
+	//	<script nonce="{{csp_nonce}}">...</script>
+	ContentSecurityPolicy string `json:"content_security_policy"`
+
+	// send the policy as Content-Security-Policy-Report-Only, so that
+	// violations are reported but not blocked, while trying out a policy.
+	CSPReportOnly bool `json:"csp_report_only"`
+
+	// how long browsers should insist on https for the site.  The
+	// Strict-Transport-Security header is only sent over https, since
+	// browsers ignore it otherwise.
+	HSTSMaxAge            Duration `json:"hsts_max_age"`
+	HSTSIncludeSubdomains bool     `json:"hsts_include_subdomains"`
+	HSTSPreload           bool     `json:"hsts_preload"`
+
+	// the X-Content-Type-Options header.  Defaults to nosniff.
+	ContentTypeOptions string `json:"content_type_options"`
+
+	// the X-Frame-Options header.  Defaults to DENY.
+	FrameOptions string `json:"frame_options"`
+
+	// the Referrer-Policy header.  Defaults to
+	// strict-origin-when-cross-origin.
+	ReferrerPolicy string `json:"referrer_policy"`
+
+	// the Permissions-Policy header, e.g., "camera=(), geolocation=()".
+	PermissionsPolicy string `json:"permissions_policy"`
+}
+
+func (o SecurityOptions) hsts() string {
+	if o.HSTSMaxAge <= 0 {
+		return ""
+	}
+	v := "max-age=" + strconv.FormatInt(int64(time.Duration(o.HSTSMaxAge)/time.Second), 10)
+	if o.HSTSIncludeSubdomains {
+		v += "; includeSubDomains"
+	}
+	if o.HSTSPreload {
+		v += "; preload"
+	}
+	return v
+}
+
+// CSPNonce gives the nonce for inline scripts and styles in the response to
+// this request, making one if need be.  Each request gets a nonce of its own.
+// In templates, it's available as {{csp_nonce}}.  The nonce is only of use
+// if the content security policy, as set by SecurityHeaders, mentions it.
+func (r *Request) CSPNonce() (string, error) {
+	if r.cspNonce != "" {
+		return r.cspNonce, nil
+	}
+	nonce, err := dinutil.SecureToken(cspNonceLen)
+	if err != nil {
+		return "", err
+	}
+	r.cspNonce = nonce
+	return nonce, nil
+}
+
+// SecurityHeaders is a Stage that adds the headers described by the security
+// config to the response, telling browsers to guard against cross-site
+// scripting, clickjacking and the like.  It's best put at the head of every
+// pipeline, or installed with Router.Use, so that error responses carry the
+// headers too.  A later stage may replace any of the headers for its own
+// response with Request.ResponseHeader.
+func SecurityHeaders(req *Request) (Response, error) {
+	opts := Config.Security
+	h := req.ResponseHeader()
+	set := func(name, value string) {
+		if value != "" {
+			h.Set(name, value)
+		}
+	}
+
+	if csp := opts.ContentSecurityPolicy; csp != "" {
+		if strings.Contains(csp, cspNoncePlaceholder) {
+			nonce, err := req.CSPNonce()
+			if err != nil {
+				return nil, err
+			}
+			csp = strings.Replace(csp, cspNoncePlaceholder, nonce, -1)
+		}
+		if opts.CSPReportOnly {
+			h.Set("Content-Security-Policy-Report-Only", csp)
+		} else {
+			h.Set("Content-Security-Policy", csp)
+		}
+	}
+	if req.TLS != nil || req.UsingSSL() {
+		set("Strict-Transport-Security", opts.hsts())
+	}
+	set("X-Content-Type-Options", opts.ContentTypeOptions)
+	set("X-Frame-Options", opts.FrameOptions)
+	set("Referrer-Policy", opts.ReferrerPolicy)
+	set("Permissions-Policy", opts.PermissionsPolicy)
+	return nil, nil
+}
+
+func init() {
+	Config.Security.ContentTypeOptions = "nosniff"
+	Config.Security.FrameOptions = "DENY"
+	Config.Security.ReferrerPolicy = "strict-origin-when-cross-origin"
+
+	RegisterHandler("SecurityHeaders", SecurityHeaders)
+	RegisterRequestTemplateFn("csp_nonce", func(req *Request) interface{} {
+		return req.CSPNonce
+	})
+}
@@ -0,0 +1,74 @@
+package din
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	defer func(opts SecurityOptions) { Config.Security = opts }(Config.Security)
+	Config.Security.ContentSecurityPolicy = "script-src 'self' 'nonce-{nonce}'"
+	Config.Security.HSTSMaxAge = Duration(365 * 24 * time.Hour)
+	Config.Security.HSTSIncludeSubdomains = true
+	Config.Security.PermissionsPolicy = "camera=()"
+
+	RegisterHandler("testNonce", func(req *Request) (Response, error) {
+		nonce, err := req.CSPNonce()
+		if err != nil {
+			return nil, err
+		}
+		return PlaintextResponseString(nonce, http.StatusOK), nil
+	})
+	router := httpAuthRouter(t, `[
+		{"route": "^/$", "name": "home", "handlers": ["SecurityHeaders", "testNonce"]}
+	]`)
+
+	get := func(ssl bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		if ssl {
+			req.Header.Set("X-Forwarded-Ssl", "on")
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get(true)
+	nonce := w.Body.String()
+	if nonce == "" {
+		t.Fatal("expected a nonce")
+	}
+	expected := map[string]string{
+		"Content-Security-Policy":   "script-src 'self' 'nonce-" + nonce + "'",
+		"Strict-Transport-Security": "max-age=31536000; includeSubDomains",
+		"X-Content-Type-Options":    "nosniff",
+		"X-Frame-Options":           "DENY",
+		"Referrer-Policy":           "strict-origin-when-cross-origin",
+		"Permissions-Policy":        "camera=()",
+	}
+	for k, v := range expected {
+		if got := w.Header().Get(k); got != v {
+			t.Errorf("expected %s: %q, got %q", k, v, got)
+		}
+	}
+
+	w = get(false)
+	if w.Body.String() == nonce {
+		t.Errorf("expected every request to get a nonce of its own")
+	}
+	if h := w.Header().Get("Strict-Transport-Security"); h != "" {
+		t.Errorf("expected no HSTS header over http, got %q", h)
+	}
+
+	Config.Security.CSPReportOnly = true
+	Config.Security.FrameOptions = ""
+	w = get(false)
+	if w.Header().Get("Content-Security-Policy") != "" || w.Header().Get("Content-Security-Policy-Report-Only") == "" {
+		t.Errorf("expected the policy to be report-only: %v", w.Header())
+	}
+	if h := w.Header().Get("X-Frame-Options"); h != "" {
+		t.Errorf("expected X-Frame-Options to be turned off, got %q", h)
+	}
+}
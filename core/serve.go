@@ -81,7 +81,13 @@ great.
 			if err := ParseConfigFile(path); err != nil {
 				cmd.Bail(err)
 			}
-			fmt.Println(Config)
+			if err := configureSessions(); err != nil {
+				cmd.Bail(err)
+			}
+			configureAuth()
+			// the config holds secrets (session keys, bearer tokens, the
+			// jwt secret), so it's never printed as a whole.
+			fmt.Println("listening on " + Config.Core.Addr)
 			if autoBrowse {
 				time.AfterFunc(time.Second, openBrowser)
 			}
@@ -0,0 +1,287 @@
+package din
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// A SessionCodec serializes sessions, for session stores that keep them
+// somewhere other than in process memory.
+type SessionCodec interface {
+	Encode(Session) ([]byte, error)
+	Decode([]byte) (Session, error)
+}
+
+var (
+	// JSONCodec serializes sessions as json.  Values of types registered
+	// with RegisterSessionType come back as the type that was stored;
+	// everything else comes back as whatever encoding/json makes of it, and
+	// is converted when it's read out of the session with SessionGet.  This
+	// is the default codec of the session stores.
+	JSONCodec SessionCodec = jsonCodec{}
+
+	// GobCodec serializes sessions with encoding/gob.  Gob needs to know
+	// about every type stored in a session other than the basic types, so
+	// any such type must be registered with RegisterSessionType.
+	GobCodec SessionCodec = gobCodec{}
+)
+
+// sessionCodec finds a codec by the name used for it in the sessions config.
+func sessionCodec(name string) (SessionCodec, error) {
+	switch name {
+	case "", "json":
+		return JSONCodec, nil
+	case "gob":
+		return GobCodec, nil
+	}
+	return nil, fmt.Errorf("din: unknown session codec %q", name)
+}
+
+// codecOrDefault lets the session stores treat a nil codec as the default.
+func codecOrDefault(c SessionCodec) SessionCodec {
+	if c == nil {
+		return JSONCodec
+	}
+	return c
+}
+
+var sessionTypes = struct {
+	sync.RWMutex
+	byName map[string]reflect.Type
+	byType map[reflect.Type]string
+}{
+	byName: make(map[string]reflect.Type),
+	byType: make(map[reflect.Type]string),
+}
+
+// RegisterSessionType records the type of value as one that will be stored
+// in sessions, so that the session codecs can bring values of that type back
+// as the same type.  It should be called from an init function, once for
+// each type, in the same way as gob.Register.
+func RegisterSessionType(value interface{}) {
+	gob.Register(value)
+	t := reflect.TypeOf(value)
+	name := sessionTypeName(t)
+	sessionTypes.Lock()
+	defer sessionTypes.Unlock()
+	sessionTypes.byName[name] = t
+	sessionTypes.byType[t] = name
+}
+
+// sessionTypeName gives the name under which a registered type is written by
+// the json codec, which includes the package path, so as to not be confused
+// by types of the same name from different packages.
+func sessionTypeName(t reflect.Type) string {
+	if t.Kind() == reflect.Ptr {
+		return "*" + sessionTypeName(t.Elem())
+	}
+	if t.Name() != "" && t.PkgPath() != "" {
+		return t.PkgPath() + "." + t.Name()
+	}
+	return t.String()
+}
+
+func registeredSessionType(v interface{}) (string, bool) {
+	if v == nil {
+		return "", false
+	}
+	sessionTypes.RLock()
+	defer sessionTypes.RUnlock()
+	name, ok := sessionTypes.byType[reflect.TypeOf(v)]
+	return name, ok
+}
+
+func lookupSessionType(name string) (reflect.Type, bool) {
+	sessionTypes.RLock()
+	defer sessionTypes.RUnlock()
+	t, ok := sessionTypes.byName[name]
+	return t, ok
+}
+
+type jsonCodec struct{}
+
+// how a value of a registered type is written by the json codec.
+type typedSessionValue struct {
+	Type  string          `json:"@type"`
+	Value json.RawMessage `json:"@value"`
+}
+
+func (jsonCodec) Encode(s Session) ([]byte, error) {
+	out := make(map[string]interface{}, len(s))
+	for k, v := range s {
+		name, ok := registeredSessionType(v)
+		if !ok {
+			out[k] = v
+			continue
+		}
+		raw, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		out[k] = typedSessionValue{Type: name, Value: raw}
+	}
+	return json.Marshal(out)
+}
+
+func (jsonCodec) Decode(data []byte) (Session, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	s := make(Session, len(raw))
+	for k, msg := range raw {
+		v, err := decodeSessionValue(msg)
+		if err != nil {
+			return nil, fmt.Errorf("din: unable to decode session value %q: %v", k, err)
+		}
+		s[k] = v
+	}
+	return s, nil
+}
+
+// decodeSessionValue decodes a single value written by the json codec.
+// Numbers are decoded as json.Numbers, so that large integers aren't mangled
+// by a trip through float64.
+func decodeSessionValue(msg json.RawMessage) (interface{}, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(msg), []byte("{")) {
+		var tv typedSessionValue
+		if err := json.Unmarshal(msg, &tv); err == nil && tv.Type != "" {
+			if t, ok := lookupSessionType(tv.Type); ok {
+				p := reflect.New(t)
+				if err := json.Unmarshal(tv.Value, p.Interface()); err != nil {
+					return nil, err
+				}
+				return p.Elem().Interface(), nil
+			}
+		}
+	}
+	dec := json.NewDecoder(bytes.NewReader(msg))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Encode(s Session) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(map[string]interface{}(s)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Decode(data []byte) (Session, error) {
+	var s Session
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// assignSessionValue stores v, a value read from a session, in dst.  Values
+// that have been through a session codec may not be of the type that was
+// originally stored, so as long as no information is lost, numbers are
+// converted between numeric types, structs are converted between struct
+// types with the same fields, and values that encoding/json has turned into
+// maps and slices are decoded into dst as json.
+func assignSessionValue(dst reflect.Value, v interface{}) error {
+	if v == nil {
+		dst.Set(reflect.Zero(dst.Type()))
+		return nil
+	}
+	src := reflect.ValueOf(v)
+	if src.Type().AssignableTo(dst.Type()) {
+		dst.Set(src)
+		return nil
+	}
+
+	if n, ok := v.(json.Number); ok {
+		if i, err := n.Int64(); err == nil {
+			src = reflect.ValueOf(i)
+		} else if f, err := n.Float64(); err == nil {
+			src = reflect.ValueOf(f)
+		}
+	}
+	if isNumberKind(src.Kind()) && isNumberKind(dst.Kind()) {
+		if isUintKind(dst.Kind()) && isNegative(src) {
+			return fmt.Errorf("%w: %v doesn't fit in a %s", ErrInvalidSessionDest, v, dst.Type())
+		}
+		converted := src.Convert(dst.Type())
+		if isUintKind(src.Kind()) && !isUintKind(dst.Kind()) && isNegative(converted) {
+			return fmt.Errorf("%w: %v doesn't fit in a %s", ErrInvalidSessionDest, v, dst.Type())
+		}
+		if !isFloatKind(dst.Kind()) && converted.Convert(src.Type()).Interface() != src.Interface() {
+			return fmt.Errorf("%w: %v doesn't fit in a %s", ErrInvalidSessionDest, v, dst.Type())
+		}
+		dst.Set(converted)
+		return nil
+	}
+	if src.Kind() == reflect.Struct && src.Type().ConvertibleTo(dst.Type()) {
+		dst.Set(src.Convert(dst.Type()))
+		return nil
+	}
+
+	switch src.Kind() {
+	case reflect.Map, reflect.Slice, reflect.String:
+		switch dst.Kind() {
+		case reflect.Struct, reflect.Map, reflect.Slice, reflect.Array, reflect.Ptr:
+			raw, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			p := reflect.New(dst.Type())
+			if err := json.Unmarshal(raw, p.Interface()); err != nil {
+				return fmt.Errorf("%w: %v", ErrInvalidSessionDest, err)
+			}
+			dst.Set(p.Elem())
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: can't store a %T in a %s", ErrInvalidSessionDest, v, dst.Type())
+}
+
+func isNumberKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+func isFloatKind(k reflect.Kind) bool {
+	return k == reflect.Float32 || k == reflect.Float64
+}
+
+func isUintKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+func isNegative(v reflect.Value) bool {
+	switch {
+	case isFloatKind(v.Kind()):
+		return v.Float() < 0
+	case isUintKind(v.Kind()):
+		return false
+	}
+	return v.Int() < 0
+}
+
+func init() {
+	// times are common enough in sessions to be registered up front.
+	RegisterSessionType(time.Time{})
+}
@@ -0,0 +1,117 @@
+package din
+
+import (
+	"testing"
+	"time"
+)
+
+type codecUser struct {
+	Name  string
+	Admin bool
+	Seen  time.Time
+}
+
+type codecUserCopy struct {
+	Name  string
+	Admin bool
+	Seen  time.Time
+}
+
+type codecPoint struct {
+	X, Y int
+}
+
+func init() {
+	RegisterSessionType(codecUser{})
+}
+
+func TestSessionCodecs(t *testing.T) {
+	seen := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	user := codecUser{Name: "bob", Admin: true, Seen: seen}
+	stored := Session{
+		"int":   42,
+		"big":   int64(1) << 60,
+		"float": 1.5,
+		"user":  user,
+		"point": codecPoint{3, 4},
+		"tags":  []string{"a", "b"},
+		"seen":  seen,
+	}
+
+	for name, codec := range map[string]SessionCodec{"json": JSONCodec, "gob": GobCodec} {
+		if name == "gob" {
+			// gob needs to know about every type it's given.
+			RegisterSessionType(codecPoint{})
+		}
+		raw, err := codec.Encode(stored)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		s, err := codec.Decode(raw)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		var i int
+		if err := s.get("int", &i); err != nil || i != 42 {
+			t.Errorf("%s: expected int 42, got %v %v", name, i, err)
+		}
+		var u8 uint8
+		if err := s.get("int", &u8); err != nil || u8 != 42 {
+			t.Errorf("%s: expected uint8 42, got %v %v", name, u8, err)
+		}
+		var big int64
+		if err := s.get("big", &big); err != nil || big != 1<<60 {
+			t.Errorf("%s: expected int64 %d, got %v %v", name, int64(1)<<60, big, err)
+		}
+		if err := s.get("big", &i); err != nil {
+			t.Errorf("%s: expected int64 to fit in an int: %v", name, err)
+		}
+		if err := s.get("big", &u8); err == nil {
+			t.Errorf("%s: expected overflow to be refused", name)
+		}
+		if err := s.get("float", &i); err == nil {
+			t.Errorf("%s: expected fractional number to be refused by an int", name)
+		}
+		var f float32
+		if err := s.get("float", &f); err != nil || f != 1.5 {
+			t.Errorf("%s: expected float32 1.5, got %v %v", name, f, err)
+		}
+
+		var any interface{}
+		if err := s.get("user", &any); err != nil || any != user {
+			t.Errorf("%s: registered type didn't survive: %#v %v", name, any, err)
+		}
+		var cp codecUserCopy
+		if err := s.get("user", &cp); err != nil || cp != codecUserCopy(user) {
+			t.Errorf("%s: expected struct conversion, got %#v %v", name, cp, err)
+		}
+		var pt codecPoint
+		if err := s.get("point", &pt); err != nil || pt != (codecPoint{3, 4}) {
+			t.Errorf("%s: expected point, got %#v %v", name, pt, err)
+		}
+		var tags []string
+		if err := s.get("tags", &tags); err != nil || len(tags) != 2 || tags[1] != "b" {
+			t.Errorf("%s: expected tags, got %v %v", name, tags, err)
+		}
+		var when time.Time
+		if err := s.get("seen", &when); err != nil || !when.Equal(seen) {
+			t.Errorf("%s: expected time, got %v %v", name, when, err)
+		}
+		var str string
+		if err := s.get("int", &str); err == nil {
+			t.Errorf("%s: expected a number to be refused by a string", name)
+		}
+	}
+}
+
+func TestSessionGetDest(t *testing.T) {
+	s := Session{"n": 1}
+	var n int
+	if err := s.get("n", n); err == nil {
+		t.Errorf("expected a non-pointer destination to be refused")
+	}
+	if err := s.get("missing", &n); err != ErrInvalidSessionKey {
+		t.Errorf("expected ErrInvalidSessionKey, got %v", err)
+	}
+}
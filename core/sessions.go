@@ -1,83 +1,325 @@
 package din
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jordanorelli/din/dinutil"
 	"net/http"
 	"reflect"
-	// "time"
+	"strings"
+	"time"
 )
 
 const SESSION_COOKIE_NAME = "_din_session"
 
+// number of random bytes in a session id.
+const sessionIdLen = 32
+
+// keys under which din keeps its own bookkeeping inside of a Session.
+const (
+	sessionCreatedKey  = "_din_created"
+	sessionAccessedKey = "_din_accessed"
+	sessionIdKey       = "_din_id"
+)
+
+var ErrSessionExpired = errors.New("session expired")
+
+// SessionOptions configures the session cookie and how long sessions live.
+// These are read from the sessions section of the config file.
+type SessionOptions struct {
+	// name of the session cookie.  Defaults to SESSION_COOKIE_NAME.
+	CookieName string `json:"cookie_name"`
+
+	// Domain and Path attributes of the session cookie.  Path defaults to /.
+	Domain string `json:"domain"`
+	Path   string `json:"path"`
+
+	// only send the session cookie over https.  This should be turned on for
+	// any site that is served over https.
+	Secure bool `json:"secure"`
+
+	// keep the session cookie out of reach of javascript.  On by default.
+	HttpOnly bool `json:"http_only"`
+
+	// SameSite attribute of the session cookie: "lax" (the default),
+	// "strict", or "none".
+	SameSite string `json:"same_site"`
+
+	// lifetime of the session cookie.  Zero means that the cookie lasts until
+	// the browser is closed.
+	MaxAge Duration `json:"max_age"`
+
+	// a session that goes unused for longer than IdleTimeout is expired.
+	// Zero means that sessions never go idle.
+	IdleTimeout Duration `json:"idle_timeout"`
+
+	// a session older than AbsoluteTimeout is expired no matter how much it
+	// has been used.  Zero means no limit.
+	AbsoluteTimeout Duration `json:"absolute_timeout"`
+
+	// where sessions are kept: "memory" (the default) keeps them in the
+	// server's memory, "file" keeps them in files under Dir, and "cookie"
+	// keeps them, encrypted, in the session cookie itself.
+	Store string `json:"store"`
+
+	// directory in which the file session store keeps sessions.
+	Dir string `json:"dir"`
+
+	// how sessions are serialized by the file, cookie and sql session
+	// stores: "json" (the default) or "gob".  See RegisterSessionType.
+	Codec string `json:"codec"`
+
+	// base64-encoded keys for the cookie session store.  The first key is
+	// used to encrypt new sessions; the rest are only used to decrypt
+	// sessions encrypted before a key rotation.
+	Keys []string `json:"keys"`
+
+	// save changes to the session even when the request fails with an error
+	// or a panic.  By default, they're thrown away, so that a request that
+	// fails halfway through doesn't leave a session half updated.
+	SaveOnError bool `json:"save_on_error"`
+
+	// the most sessions that the in-memory session store will hold before it
+	// starts evicting the least recently used.  Defaults to
+	// defaultMaxSessions.
+	MaxSessions int `json:"max_sessions"`
+}
+
+func (o SessionOptions) cookieName() string {
+	if o.CookieName != "" {
+		return o.CookieName
+	}
+	return SESSION_COOKIE_NAME
+}
+
+// storeTTL is how long a session store should hang on to a session that
+// isn't being used.  There's no point keeping a session around for longer
+// than the session timeouts allow, and we don't keep them forever even when
+// there are no timeouts.
+func (o SessionOptions) storeTTL() time.Duration {
+	switch {
+	case o.IdleTimeout > 0:
+		return time.Duration(o.IdleTimeout)
+	case o.AbsoluteTimeout > 0:
+		return time.Duration(o.AbsoluteTimeout)
+	case o.MaxAge > 0:
+		return time.Duration(o.MaxAge)
+	}
+	return defaultSessionTTL
+}
+
+func (o SessionOptions) maxSessions() int {
+	if o.MaxSessions > 0 {
+		return o.MaxSessions
+	}
+	return defaultMaxSessions
+}
+
+func (o SessionOptions) sameSite() http.SameSite {
+	switch strings.ToLower(o.SameSite) {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	}
+	return http.SameSiteLaxMode
+}
+
+// newSessionId generates a session id from the system's cryptographically
+// secure random source.
+func newSessionId() (string, error) {
+	return dinutil.SecureToken(sessionIdLen)
+}
+
+// validSessionId tells us whether a session id presented by a client could
+// have been generated by newSessionId.  Anything else was made up by the
+// client, and isn't worth a trip to the session store.
+func validSessionId(id string) bool {
+	if len(id) != base64.RawURLEncoding.EncodedLen(sessionIdLen) {
+		return false
+	}
+	_, err := base64.RawURLEncoding.DecodeString(id)
+	return err == nil
+}
+
 var sessions SessionHandler
 
 type Session map[string]interface{}
 
 func (s Session) get(key string, dest interface{}) error {
 	destValue := reflect.ValueOf(dest)
-	if destValue.IsNil() || destValue.Kind() != reflect.Ptr {
+	if destValue.Kind() != reflect.Ptr || destValue.IsNil() {
 		return &InvalidUnmarshalError{reflect.TypeOf(dest)}
 	}
 	storedVal, ok := s[key]
 	if !ok {
 		return ErrInvalidSessionKey
 	}
-	if !reflect.Indirect(destValue).CanSet() {
-		return ErrInvalidSessionDest
-	}
-	if reflect.Indirect(destValue).Type() != reflect.ValueOf(storedVal).Type() {
+	if !destValue.Elem().CanSet() {
 		return ErrInvalidSessionDest
 	}
-	reflect.Indirect(destValue).Set(reflect.ValueOf(storedVal))
-	return nil
+	return assignSessionValue(destValue.Elem(), storedVal)
 }
 
 func (s Session) set(key string, val interface{}) {
 	s[key] = val
 }
 
+// timestamp reads one of din's bookkeeping timestamps out of the session.
+// Timestamps are stored as unix seconds, and may come back from a session
+// store as any numeric type.
+func (s Session) timestamp(key string) (time.Time, bool) {
+	switch v := s[key].(type) {
+	case int64:
+		return time.Unix(v, 0), true
+	case int:
+		return time.Unix(int64(v), 0), true
+	case float64:
+		return time.Unix(int64(v), 0), true
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return time.Unix(n, 0), true
+		}
+	}
+	return time.Time{}, false
+}
+
+func (s Session) setTimestamp(key string, t time.Time) {
+	s[key] = t.Unix()
+}
+
+// expired tells us whether the session has outlived either of the session
+// timeouts.
+func (s Session) expired(now time.Time) bool {
+	opts := Config.Sessions
+	if opts.IdleTimeout > 0 {
+		if accessed, ok := s.timestamp(sessionAccessedKey); ok && now.Sub(accessed) > time.Duration(opts.IdleTimeout) {
+			return true
+		}
+	}
+	if opts.AbsoluteTimeout > 0 {
+		if created, ok := s.timestamp(sessionCreatedKey); ok && now.Sub(created) > time.Duration(opts.AbsoluteTimeout) {
+			return true
+		}
+	}
+	return false
+}
+
 type SessionHandler interface {
 	Get(string) (Session, error)
 	Set(string, Session) error
 	Delete(string) error
 }
 
-func SetSessionHandler(handler SessionHandler) {
-	sessions = handler
+// A SessionToucher is a SessionHandler that can slide a session's expiry
+// forward without writing the whole session back.  Touch records the time at
+// which the session stored under id was accessed, and extends its lifetime in
+// the store, leaving the rest of the session as the store has it.  Touching a
+// session that isn't in the store gives ErrUnknownSessionId.
+type SessionToucher interface {
+	SessionHandler
+	Touch(id string, accessed time.Time) error
 }
 
-type defaultSessionHandler map[string]Session
-
-func (d defaultSessionHandler) Get(id string) (Session, error) {
-	s, ok := d[id]
-	if !ok {
-		return nil, ErrUnknownSessionId
+// touchSession slides the expiry of the stored session forward without
+// overwriting changes made to it by concurrent requests since this request
+// read it.  Stores that can't do that themselves have the session read back
+// and written out again.
+func touchSession(id string, now time.Time) error {
+	if t, ok := sessions.(SessionToucher); ok {
+		return t.Touch(id, now)
 	}
-	return s, nil
+	s, err := sessions.Get(id)
+	if err != nil {
+		return err
+	}
+	s.setTimestamp(sessionAccessedKey, now)
+	return sessions.Set(id, s)
 }
 
-func (d defaultSessionHandler) Set(id string, s Session) error {
-	d[id] = s
-	return nil
+func SetSessionHandler(handler SessionHandler) {
+	sessions = handler
 }
 
-func (d defaultSessionHandler) Delete(id string) error {
-	delete(d, id)
-	return nil
+// configureSessions installs the session store named in the sessions config.
+func configureSessions() error {
+	codec, err := sessionCodec(Config.Sessions.Codec)
+	if err != nil {
+		return err
+	}
+	switch Config.Sessions.Store {
+	case "", "memory":
+		return nil
+	case "file":
+		if Config.Sessions.Dir == "" {
+			return errors.New("din: the file session store needs a dir")
+		}
+		store, err := NewFileStore(Config.Sessions.Dir, 0)
+		if err != nil {
+			return err
+		}
+		store.Codec = codec
+		SetSessionHandler(store)
+		return nil
+	case "cookie":
+		store, err := NewCookieStore(Config.Sessions.Keys)
+		if err != nil {
+			return err
+		}
+		store.Codec = codec
+		SetSessionHandler(store)
+		return nil
+	}
+	return fmt.Errorf("din: unknown session store %q", Config.Sessions.Store)
 }
 
 func init() {
 	if sessions == nil {
-		SetSessionHandler(make(defaultSessionHandler))
+		SetSessionHandler(NewMemoryStore(0, 0))
 	}
+	Config.Sessions.HttpOnly = true
+	Config.Sessions.SameSite = "lax"
 }
 
+// setSessionId sets the session cookie, with the attributes found in the
+// sessions config.
 func setSessionId(w http.ResponseWriter, id string) {
+	opts := Config.Sessions
+	cookie := &http.Cookie{
+		Name:     opts.cookieName(),
+		Value:    id,
+		Domain:   opts.Domain,
+		Path:     opts.Path,
+		Secure:   opts.Secure,
+		HttpOnly: opts.HttpOnly,
+		SameSite: opts.sameSite(),
+	}
+	if cookie.Path == "" {
+		cookie.Path = "/"
+	}
+	if opts.MaxAge > 0 {
+		cookie.MaxAge = int(time.Duration(opts.MaxAge) / time.Second)
+		cookie.Expires = time.Now().Add(time.Duration(opts.MaxAge))
+	}
+	http.SetCookie(w, cookie)
+}
+
+// clearSessionId tells the client to throw away its session cookie.
+func clearSessionId(w http.ResponseWriter) {
+	opts := Config.Sessions
+	path := opts.Path
+	if path == "" {
+		path = "/"
+	}
 	http.SetCookie(w, &http.Cookie{
-		Name:  SESSION_COOKIE_NAME,
-		Path:  "/",
-		Value: id,
-		// Domain:   "",
-		// HttpOnly: true,
-		// Secure:   true,
+		Name:     opts.cookieName(),
+		Domain:   opts.Domain,
+		Path:     path,
+		MaxAge:   -1,
+		Secure:   opts.Secure,
+		HttpOnly: opts.HttpOnly,
+		SameSite: opts.sameSite(),
 	})
 }
@@ -0,0 +1,308 @@
+package din
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func sessionRouter() *Router {
+	router := NewRouter(nil, nil)
+	router.AddRoute("^/set$", "set", func(req *Request) (Response, error) {
+		req.SessionSet("name", "bob")
+		return EmptyResponse(http.StatusNoContent), nil
+	})
+	router.AddRoute("^/get$", "get", func(req *Request) (Response, error) {
+		var name string
+		if err := req.SessionGet("name", &name); err != nil {
+			return PlaintextResponseString(err.Error(), http.StatusOK), nil
+		}
+		return PlaintextResponseString(name, http.StatusOK), nil
+	})
+	router.AddRoute("^/login$", "login", func(req *Request) (Response, error) {
+		if err := req.SessionRegenerate(); err != nil {
+			return nil, err
+		}
+		return EmptyResponse(http.StatusNoContent), nil
+	})
+	return router
+}
+
+func sessionCookie(w *httptest.ResponseRecorder) *http.Cookie {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == Config.Sessions.cookieName() {
+			return c
+		}
+	}
+	return nil
+}
+
+func sessionGet(router *Router, path string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestSessionCookie(t *testing.T) {
+	defer func(opts SessionOptions) { Config.Sessions = opts }(Config.Sessions)
+	Config.Sessions.Secure = true
+	Config.Sessions.SameSite = "strict"
+	Config.Sessions.MaxAge = Duration(time.Hour)
+	router := sessionRouter()
+
+	cookie := sessionCookie(sessionGet(router, "/set", nil))
+	if cookie == nil {
+		t.Fatal("expected a session cookie")
+	}
+	if !cookie.HttpOnly || !cookie.Secure || cookie.SameSite != http.SameSiteStrictMode || cookie.MaxAge != 3600 {
+		t.Errorf("session cookie is missing attributes: %v", cookie)
+	}
+	if !validSessionId(cookie.Value) {
+		t.Errorf("bad session id: %q", cookie.Value)
+	}
+	if w := sessionGet(router, "/get", cookie); w.Body.String() != "bob" {
+		t.Errorf("expected session value bob, got %q", w.Body.String())
+	}
+
+	forged := &http.Cookie{Name: cookie.Name, Value: "12345"}
+	if w := sessionGet(router, "/get", forged); w.Body.String() != ErrInvalidSessionCookie.Error() {
+		t.Errorf("expected forged session id to be rejected, got %q", w.Body.String())
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	defer func(opts SessionOptions) { Config.Sessions = opts }(Config.Sessions)
+	router := sessionRouter()
+
+	tests := []struct {
+		opts     SessionOptions
+		created  time.Duration
+		accessed time.Duration
+		expired  bool
+	}{
+		{SessionOptions{}, -48 * time.Hour, -48 * time.Hour, false},
+		{SessionOptions{IdleTimeout: Duration(time.Hour)}, -48 * time.Hour, -time.Minute, false},
+		{SessionOptions{IdleTimeout: Duration(time.Hour)}, -48 * time.Hour, -2 * time.Hour, true},
+		{SessionOptions{AbsoluteTimeout: Duration(24 * time.Hour)}, -12 * time.Hour, -time.Minute, false},
+		{SessionOptions{AbsoluteTimeout: Duration(24 * time.Hour)}, -48 * time.Hour, -time.Minute, true},
+	}
+	for i, test := range tests {
+		Config.Sessions = test.opts
+		cookie := sessionCookie(sessionGet(router, "/set", nil))
+		s, err := sessions.Get(cookie.Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := time.Now()
+		s.setTimestamp(sessionCreatedKey, now.Add(test.created))
+		s.setTimestamp(sessionAccessedKey, now.Add(test.accessed))
+		sessions.Set(cookie.Value, s)
+
+		body := sessionGet(router, "/get", cookie).Body.String()
+		if test.expired && body != ErrSessionExpired.Error() {
+			t.Errorf("test %d: expected session to expire, got %q", i, body)
+		}
+		if !test.expired && body != "bob" {
+			t.Errorf("test %d: expected session to be live, got %q", i, body)
+		}
+	}
+}
+
+func TestSessionRegenerate(t *testing.T) {
+	router := sessionRouter()
+	before := sessionCookie(sessionGet(router, "/set", nil))
+	after := sessionCookie(sessionGet(router, "/login", before))
+	if after == nil || after.Value == before.Value {
+		t.Fatalf("expected a new session id, got %v", after)
+	}
+	if w := sessionGet(router, "/get", after); w.Body.String() != "bob" {
+		t.Errorf("expected session data to follow the new id, got %q", w.Body.String())
+	}
+	if w := sessionGet(router, "/get", before); w.Body.String() == "bob" {
+		t.Errorf("old session id still works after regeneration")
+	}
+}
+
+func TestSessionRegenerateOnError(t *testing.T) {
+	defer func(opts SessionOptions) { Config.Sessions = opts }(Config.Sessions)
+	Config.Sessions.SaveOnError = false
+	router := sessionRouter()
+	router.AddRoute("^/login-fail$", "login-fail", func(req *Request) (Response, error) {
+		if err := req.SessionRegenerate(); err != nil {
+			return nil, err
+		}
+		return nil, ErrNotFound
+	})
+
+	before := sessionCookie(sessionGet(router, "/set", nil))
+	w := sessionGet(router, "/login-fail", before)
+	if c := sessionCookie(w); c != nil {
+		t.Errorf("expected no new session cookie from a failed request, got %v", c)
+	}
+	if w := sessionGet(router, "/get", before); w.Body.String() != "bob" {
+		t.Errorf("a failed regeneration lost the client's session: %q", w.Body.String())
+	}
+}
+
+// silentResponse renders nothing at all.
+type silentResponse struct{}
+
+func (silentResponse) Render(w http.ResponseWriter) error { return nil }
+func (silentResponse) Status() int                        { return http.StatusOK }
+
+func TestSessionSaveOnError(t *testing.T) {
+	defer func(opts SessionOptions) { Config.Sessions = opts }(Config.Sessions)
+	router := sessionRouter()
+	router.AddRoute("^/fail$", "fail", func(req *Request) (Response, error) {
+		req.SessionSet("name", "mallory")
+		return nil, ErrNotFound
+	})
+	router.AddRoute("^/panic$", "panic", func(req *Request) (Response, error) {
+		req.SessionSet("name", "mallory")
+		panic("oh no")
+	})
+	router.AddRoute("^/silent$", "silent", func(req *Request) (Response, error) {
+		req.SessionSet("name", "carol")
+		return silentResponse{}, nil
+	})
+
+	for _, path := range []string{"/fail", "/panic"} {
+		Config.Sessions.SaveOnError = false
+		cookie := sessionCookie(sessionGet(router, "/set", nil))
+		sessionGet(router, path, cookie)
+		if w := sessionGet(router, "/get", cookie); w.Body.String() != "bob" {
+			t.Errorf("%s: session changes survived a failed request: %q", path, w.Body.String())
+		}
+		if w := sessionGet(router, path, nil); sessionCookie(w) != nil {
+			t.Errorf("%s: a failed request started a session", path)
+		}
+
+		Config.Sessions.SaveOnError = true
+		sessionGet(router, path, cookie)
+		if w := sessionGet(router, "/get", cookie); w.Body.String() != "mallory" {
+			t.Errorf("%s: expected session changes to be saved with save_on_error, got %q", path, w.Body.String())
+		}
+		if w := sessionGet(router, path, nil); sessionCookie(w) == nil {
+			t.Errorf("%s: expected a new session to be started with save_on_error", path)
+		}
+	}
+
+	cookie := sessionCookie(sessionGet(router, "/silent", nil))
+	if cookie == nil {
+		t.Fatal("expected a session cookie from a response that writes nothing")
+	}
+	if w := sessionGet(router, "/get", cookie); w.Body.String() != "carol" {
+		t.Errorf("session set by a response that writes nothing was lost: %q", w.Body.String())
+	}
+}
+
+func TestSessionRefresh(t *testing.T) {
+	defer func(opts SessionOptions) { Config.Sessions = opts }(Config.Sessions)
+	Config.Sessions.IdleTimeout = Duration(time.Hour)
+	Config.Sessions.MaxAge = Duration(time.Hour)
+	router := sessionRouter()
+
+	cookie := sessionCookie(sessionGet(router, "/set", nil))
+	if w := sessionGet(router, "/get", cookie); sessionCookie(w) != nil {
+		t.Errorf("a freshly saved session was written again")
+	}
+
+	s, _ := sessions.Get(cookie.Value)
+	stale := time.Now().Add(-30 * time.Minute)
+	s.setTimestamp(sessionAccessedKey, stale)
+	sessions.Set(cookie.Value, s)
+
+	w := sessionGet(router, "/get", cookie)
+	if sessionCookie(w) == nil {
+		t.Errorf("expected the session cookie to be sent again when the session is refreshed")
+	}
+	s, _ = sessions.Get(cookie.Value)
+	if accessed, _ := s.timestamp(sessionAccessedKey); !accessed.After(stale) {
+		t.Errorf("reading the session didn't slide its expiry")
+	}
+
+	// another request changes the session while this one has it open, after
+	// which sliding the expiry must not put back the session this one read.
+	router.AddRoute("^/race$", "race", func(req *Request) (Response, error) {
+		var name string
+		req.SessionGet("name", &name)
+		key, _ := req.SessionKey()
+		s, _ := sessions.Get(key)
+		s["name"] = "alice"
+		sessions.Set(key, s)
+		return PlaintextResponseString(name, http.StatusOK), nil
+	})
+	s.setTimestamp(sessionAccessedKey, stale)
+	sessions.Set(cookie.Value, s)
+	if w := sessionGet(router, "/race", cookie); w.Body.String() != "bob" {
+		t.Fatalf("expected the session as it was read, got %q", w.Body.String())
+	}
+	if w := sessionGet(router, "/get", cookie); w.Body.String() != "alice" {
+		t.Errorf("refreshing the session overwrote a concurrent change: %q", w.Body.String())
+	}
+
+	// nor may it bring back a session that another request cleared.
+	s.setTimestamp(sessionAccessedKey, stale)
+	sessions.Set(cookie.Value, s)
+	router.AddRoute("^/cleared$", "cleared", func(req *Request) (Response, error) {
+		var name string
+		req.SessionGet("name", &name)
+		key, _ := req.SessionKey()
+		sessions.Delete(key)
+		return PlaintextResponseString(name, http.StatusOK), nil
+	})
+	sessionGet(router, "/cleared", cookie)
+	if _, err := sessions.Get(cookie.Value); err != ErrUnknownSessionId {
+		t.Errorf("refreshing the session brought back a cleared session: %v", err)
+	}
+}
+
+type failingResponse struct{}
+
+func (failingResponse) Render(w http.ResponseWriter) error { return errors.New("unable to render") }
+func (failingResponse) Status() int                        { return http.StatusOK }
+
+func TestSessionCommitOnTimeoutAndRenderError(t *testing.T) {
+	defer func(timeout time.Duration, opts CORSOptions) {
+		stageTimeout, Config.CORS = timeout, opts
+	}(stageTimeout, Config.CORS)
+	stageTimeout = 20 * time.Millisecond
+	Config.CORS = CORSOptions{AllowedOrigins: []string{"*"}}
+
+	release := make(chan struct{})
+	defer close(release)
+	router := sessionRouter()
+	router.AddRoute("^/slow$", "slow", func(req *Request) (Response, error) {
+		<-release
+		return EmptyResponse(http.StatusNoContent), nil
+	})
+	router.AddRoute("^/broken$", "broken", func(req *Request) (Response, error) {
+		req.SessionSet("name", "bob")
+		return failingResponse{}, nil
+	})
+
+	// a request that times out is answered like any other failure, with the
+	// headers collected for it.
+	req := httptest.NewRequest("GET", "/slow", nil)
+	req.Header.Set("Origin", "https://anywhere.test")
+	req.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusGatewayTimeout || w.Header().Get("Content-Type") != ProblemContentType {
+		t.Errorf("expected a rendered 504, got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	if w.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("expected the timeout to carry the request's headers, got %v", w.Header())
+	}
+
+	// a response that fails to render still has its session committed.
+	if cookie := sessionCookie(sessionGet(router, "/broken", nil)); cookie == nil {
+		t.Errorf("expected the session to be committed when rendering fails")
+	}
+}
@@ -0,0 +1,247 @@
+package din
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SQLStoreOptions configures a SQLStore.
+type SQLStoreOptions struct {
+	// name of the table holding the sessions.  It is created if it doesn't
+	// exist.  Defaults to din_sessions.
+	Table string
+
+	// how long an unused session is kept.  Zero means that it's taken from
+	// the sessions config.
+	TTL time.Duration
+
+	// produces the placeholder for the nth (counting from 1) parameter of a
+	// query.  Defaults to QuestionPlaceholder, as used by sqlite and mysql;
+	// postgres needs DollarPlaceholder.
+	Placeholder func(n int) string
+
+	// gives the statements that create the table, if it doesn't already
+	// exist, along with its indexes.  Defaults to DefaultSchema, which works
+	// for sqlite and postgres; mysql needs MySQLSchema.
+	Schema func(table string) []string
+
+	// serializes sessions for the table.  Defaults to JSONCodec.  Whatever
+	// the codec, sessions are stored base64-encoded, since not every codec
+	// produces text.
+	Codec SessionCodec
+}
+
+// QuestionPlaceholder writes query parameters as ?.
+func QuestionPlaceholder(n int) string {
+	return "?"
+}
+
+// DollarPlaceholder writes query parameters as $1, $2, and so on.
+func DollarPlaceholder(n int) string {
+	return "$" + strconv.Itoa(n)
+}
+
+// DefaultSchema creates the session table with statements that sqlite and
+// postgres understand.
+func DefaultSchema(table string) []string {
+	return []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			id VARCHAR(64) NOT NULL PRIMARY KEY,
+			data TEXT NOT NULL,
+			expires BIGINT NOT NULL
+		)`, table),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_expires ON %s (expires)", table, table),
+	}
+}
+
+// MySQLSchema creates the session table for mysql, which has no CREATE INDEX
+// IF NOT EXISTS, so the index is declared along with the table instead.
+func MySQLSchema(table string) []string {
+	return []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			id VARCHAR(64) NOT NULL PRIMARY KEY,
+			data TEXT NOT NULL,
+			expires BIGINT NOT NULL,
+			INDEX %s_expires (expires)
+		)`, table, table),
+	}
+}
+
+var validTableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// SQLStore is a SessionHandler that keeps sessions in a table of a sql
+// database, for sites where several servers need to share sessions.  The
+// table is keyed by a hash of the session id, and records when each session
+// expires, so that expired sessions can be removed with a single query.
+type SQLStore struct {
+	db     *sql.DB
+	opts   SQLStoreOptions
+	done   chan struct{}
+	closer sync.Once
+
+	// queries, written for the table and placeholders in opts.
+	q struct {
+		get, insert, update, touch, remove, sweep string
+	}
+}
+
+// NewSQLStore creates a SQLStore on db, creating its table if need be, and
+// starts a background sweeper that deletes expired sessions until the store
+// is closed.  The driver for db must already be registered; din doesn't
+// import any drivers itself.
+func NewSQLStore(db *sql.DB, opts SQLStoreOptions) (*SQLStore, error) {
+	if opts.Table == "" {
+		opts.Table = "din_sessions"
+	}
+	if !validTableName.MatchString(opts.Table) {
+		return nil, fmt.Errorf("din: invalid session table name %q", opts.Table)
+	}
+	if opts.Placeholder == nil {
+		opts.Placeholder = QuestionPlaceholder
+	}
+	if opts.Schema == nil {
+		opts.Schema = DefaultSchema
+	}
+	s := &SQLStore{db: db, opts: opts, done: make(chan struct{})}
+	if err := s.migrate(); err != nil {
+		return nil, err
+	}
+
+	t, p := opts.Table, opts.Placeholder
+	s.q.get = fmt.Sprintf("SELECT data FROM %s WHERE id = %s AND expires >= %s", t, p(1), p(2))
+	s.q.insert = fmt.Sprintf("INSERT INTO %s (id, data, expires) VALUES (%s, %s, %s)", t, p(1), p(2), p(3))
+	s.q.update = fmt.Sprintf("UPDATE %s SET data = %s, expires = %s WHERE id = %s", t, p(1), p(2), p(3))
+	s.q.touch = fmt.Sprintf("UPDATE %s SET data = %s, expires = %s WHERE id = %s AND data = %s", t, p(1), p(2), p(3), p(4))
+	s.q.remove = fmt.Sprintf("DELETE FROM %s WHERE id = %s", t, p(1))
+	s.q.sweep = fmt.Sprintf("DELETE FROM %s WHERE expires < %s", t, p(1))
+	go s.sweeper(defaultSweepInterval)
+	return s, nil
+}
+
+// migrate brings the session table up to date.  There's only the one
+// version of the table so far.
+func (s *SQLStore) migrate() error {
+	for _, stmt := range s.opts.Schema(s.opts.Table) {
+		if _, err := s.db.Exec(stmt); err != nil {
+			return fmt.Errorf("din: unable to create session table: %v", err)
+		}
+	}
+	return nil
+}
+
+func (s *SQLStore) getTTL() time.Duration {
+	if s.opts.TTL > 0 {
+		return s.opts.TTL
+	}
+	return Config.Sessions.storeTTL()
+}
+
+func (s *SQLStore) Get(id string) (Session, error) {
+	var data string
+	err := s.db.QueryRow(s.q.get, hashSessionId(id), time.Now().Unix()).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUnknownSessionId
+	}
+	if err != nil {
+		return nil, err
+	}
+	raw, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, err
+	}
+	return codecOrDefault(s.opts.Codec).Decode(raw)
+}
+
+// Set writes the session with an update, falling back to an insert for new
+// sessions, since there's no upsert that all databases agree on.
+func (s *SQLStore) Set(id string, sess Session) error {
+	raw, err := codecOrDefault(s.opts.Codec).Encode(sess)
+	if err != nil {
+		return err
+	}
+	data := base64.StdEncoding.EncodeToString(raw)
+	key, expires := hashSessionId(id), time.Now().Add(s.getTTL()).Unix()
+
+	res, err := s.db.Exec(s.q.update, data, expires, key)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		return nil
+	}
+	if _, err := s.db.Exec(s.q.insert, key, data, expires); err != nil {
+		// somebody else may have inserted the same session in the meantime.
+		if _, uerr := s.db.Exec(s.q.update, data, expires, key); uerr != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Touch reads the session back and writes it out again with its access time
+// updated, but only if it hasn't changed in between.  If it has, whoever
+// changed it has just extended it anyway, so there's nothing left to do.
+func (s *SQLStore) Touch(id string, accessed time.Time) error {
+	key := hashSessionId(id)
+	var data string
+	err := s.db.QueryRow(s.q.get, key, time.Now().Unix()).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrUnknownSessionId
+	}
+	if err != nil {
+		return err
+	}
+	codec := codecOrDefault(s.opts.Codec)
+	raw, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return err
+	}
+	sess, err := codec.Decode(raw)
+	if err != nil {
+		return err
+	}
+	sess.setTimestamp(sessionAccessedKey, accessed)
+	if raw, err = codec.Encode(sess); err != nil {
+		return err
+	}
+	expires := time.Now().Add(s.getTTL()).Unix()
+	_, err = s.db.Exec(s.q.touch, base64.StdEncoding.EncodeToString(raw), expires, key, data)
+	return err
+}
+
+func (s *SQLStore) Delete(id string) error {
+	_, err := s.db.Exec(s.q.remove, hashSessionId(id))
+	return err
+}
+
+// Close stops the store's background sweeper.  It doesn't close the
+// database.
+func (s *SQLStore) Close() error {
+	s.closer.Do(func() { close(s.done) })
+	return nil
+}
+
+// sweep deletes the sessions that expired before now.
+func (s *SQLStore) sweep(now time.Time) error {
+	_, err := s.db.Exec(s.q.sweep, now.Unix())
+	return err
+}
+
+func (s *SQLStore) sweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.sweep(now)
+		case <-s.done:
+			return
+		}
+	}
+}
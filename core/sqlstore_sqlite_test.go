@@ -0,0 +1,47 @@
+//go:build sqlite
+
+package din
+
+import (
+	"database/sql"
+	_ "github.com/mattn/go-sqlite3"
+	"testing"
+	"time"
+)
+
+// run with: go test -tags sqlite, to check the queries against a real database.
+func TestSQLStoreSQLite(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// each connection to :memory: is a database of its own.
+	db.SetMaxOpenConns(1)
+
+	store, err := NewSQLStore(db, SQLStoreOptions{TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	// creating the store again must not trip over the existing table.
+	if _, err := NewSQLStore(db, SQLStoreOptions{TTL: time.Hour}); err != nil {
+		t.Fatalf("migration is not idempotent: %v", err)
+	}
+
+	sessionStoreTests(t, store, func(id string) {
+		db.Exec("UPDATE din_sessions SET expires = ? WHERE id = ?", time.Now().Add(-time.Hour).Unix(), hashSessionId(id))
+	})
+
+	store.sweep(time.Now())
+	var n int
+	db.QueryRow("SELECT COUNT(*) FROM din_sessions").Scan(&n)
+	if n != 1 {
+		t.Errorf("expected only the live session to survive a sweep, have %d", n)
+	}
+
+	if _, err := NewSQLStore(db, SQLStoreOptions{Table: "x; DROP TABLE din_sessions"}); err == nil {
+		t.Errorf("expected a bad table name to be rejected")
+	}
+}
@@ -0,0 +1,243 @@
+package din
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSessionDB is a database/sql driver that understands just the queries a
+// SQLStore makes, so that SQLStore can be tested without a real database.
+// It only checks the shape of the queries; sqlstore_sqlite_test.go runs them
+// against sqlite when the sqlite build tag is set.  Each name passed to
+// sql.Open is a database of its own.
+type fakeSessionDB struct {
+	sync.Mutex
+	tables map[string]map[string]*fakeSessionRow
+}
+
+type fakeSessionRow struct {
+	data    string
+	expires int64
+}
+
+var fakeSessionDBs = struct {
+	sync.Mutex
+	m map[string]*fakeSessionDB
+}{m: make(map[string]*fakeSessionDB)}
+
+func init() {
+	sql.Register("dinfake", fakeSessionDriver{})
+}
+
+type fakeSessionDriver struct{}
+
+func (fakeSessionDriver) Open(name string) (driver.Conn, error) {
+	fakeSessionDBs.Lock()
+	defer fakeSessionDBs.Unlock()
+	db, ok := fakeSessionDBs.m[name]
+	if !ok {
+		db = &fakeSessionDB{tables: make(map[string]map[string]*fakeSessionRow)}
+		fakeSessionDBs.m[name] = db
+	}
+	return &fakeSessionConn{db}, nil
+}
+
+type fakeSessionConn struct{ db *fakeSessionDB }
+
+func (c *fakeSessionConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeSessionStmt{c.db, query}, nil
+}
+
+func (c *fakeSessionConn) Close() error { return nil }
+
+func (c *fakeSessionConn) Begin() (driver.Tx, error) {
+	return nil, fmt.Errorf("fake session db: no transactions")
+}
+
+var (
+	fakePlaceholder = regexp.MustCompile(`\?|\$\d+`)
+	fakeCreateTable = regexp.MustCompile(`^CREATE TABLE IF NOT EXISTS (\w+) \(`)
+	fakeCreateIndex = regexp.MustCompile(`^CREATE INDEX IF NOT EXISTS \w+ ON (\w+) \(expires\)$`)
+	fakeSelect      = regexp.MustCompile(`^SELECT data FROM (\w+) WHERE id = P AND expires >= P$`)
+	fakeInsert      = regexp.MustCompile(`^INSERT INTO (\w+) \(id, data, expires\) VALUES \(P, P, P\)$`)
+	fakeUpdate      = regexp.MustCompile(`^UPDATE (\w+) SET data = P, expires = P WHERE id = P$`)
+	fakeTouch       = regexp.MustCompile(`^UPDATE (\w+) SET data = P, expires = P WHERE id = P AND data = P$`)
+	fakeDelete      = regexp.MustCompile(`^DELETE FROM (\w+) WHERE id = P$`)
+	fakeSweep       = regexp.MustCompile(`^DELETE FROM (\w+) WHERE expires < P$`)
+)
+
+type fakeSessionStmt struct {
+	db    *fakeSessionDB
+	query string
+}
+
+func (s *fakeSessionStmt) Close() error  { return nil }
+func (s *fakeSessionStmt) NumInput() int { return -1 }
+
+func (s *fakeSessionStmt) Exec(args []driver.Value) (driver.Result, error) {
+	n, err := s.run(args, nil)
+	return driver.RowsAffected(n), err
+}
+
+func (s *fakeSessionStmt) Query(args []driver.Value) (driver.Rows, error) {
+	rows := &fakeSessionRows{}
+	_, err := s.run(args, rows)
+	return rows, err
+}
+
+// run carries out the statement, giving the number of rows it affected, and
+// collecting any rows it selects into rows.
+func (s *fakeSessionStmt) run(args []driver.Value, rows *fakeSessionRows) (int64, error) {
+	s.db.Lock()
+	defer s.db.Unlock()
+
+	query := strings.Join(strings.Fields(s.query), " ")
+	if m := fakeCreateTable.FindStringSubmatch(query); m != nil {
+		if s.db.tables[m[1]] == nil {
+			s.db.tables[m[1]] = make(map[string]*fakeSessionRow)
+		}
+		return 0, nil
+	}
+	if m := fakeCreateIndex.FindStringSubmatch(query); m != nil {
+		if s.db.tables[m[1]] == nil {
+			return 0, fmt.Errorf("fake session db: no such table %s", m[1])
+		}
+		return 0, nil
+	}
+
+	query = fakePlaceholder.ReplaceAllString(query, "P")
+	match := func(re *regexp.Regexp, nargs int) map[string]*fakeSessionRow {
+		m := re.FindStringSubmatch(query)
+		if m == nil || len(args) != nargs {
+			return nil
+		}
+		return s.db.tables[m[1]]
+	}
+	if table := match(fakeSelect, 2); table != nil {
+		if row, ok := table[args[0].(string)]; ok && row.expires >= args[1].(int64) {
+			rows.data = append(rows.data, row.data)
+		}
+		return 0, nil
+	}
+	if table := match(fakeInsert, 3); table != nil {
+		id := args[0].(string)
+		if _, ok := table[id]; ok {
+			return 0, fmt.Errorf("fake session db: duplicate id %s", id)
+		}
+		table[id] = &fakeSessionRow{args[1].(string), args[2].(int64)}
+		return 1, nil
+	}
+	if table := match(fakeUpdate, 3); table != nil {
+		row, ok := table[args[2].(string)]
+		if !ok {
+			return 0, nil
+		}
+		row.data, row.expires = args[0].(string), args[1].(int64)
+		return 1, nil
+	}
+	if table := match(fakeTouch, 4); table != nil {
+		row, ok := table[args[2].(string)]
+		if !ok || row.data != args[3].(string) {
+			return 0, nil
+		}
+		row.data, row.expires = args[0].(string), args[1].(int64)
+		return 1, nil
+	}
+	if table := match(fakeDelete, 1); table != nil {
+		id := args[0].(string)
+		if _, ok := table[id]; !ok {
+			return 0, nil
+		}
+		delete(table, id)
+		return 1, nil
+	}
+	if table := match(fakeSweep, 1); table != nil {
+		var n int64
+		for id, row := range table {
+			if row.expires < args[0].(int64) {
+				delete(table, id)
+				n++
+			}
+		}
+		return n, nil
+	}
+	return 0, fmt.Errorf("fake session db: unexpected query %q", s.query)
+}
+
+type fakeSessionRows struct {
+	data []string
+}
+
+func (r *fakeSessionRows) Columns() []string { return []string{"data"} }
+func (r *fakeSessionRows) Close() error      { return nil }
+
+func (r *fakeSessionRows) Next(dest []driver.Value) error {
+	if len(r.data) == 0 {
+		return io.EOF
+	}
+	dest[0], r.data = r.data[0], r.data[1:]
+	return nil
+}
+
+func TestSQLStore(t *testing.T) {
+	dialects := []struct {
+		placeholder func(int) string
+		schema      func(string) []string
+	}{
+		{QuestionPlaceholder, DefaultSchema},
+		{DollarPlaceholder, DefaultSchema},
+		{QuestionPlaceholder, MySQLSchema},
+	}
+	for i, dialect := range dialects {
+		name := fmt.Sprintf("%s%d", t.Name(), i)
+		db, err := sql.Open("dinfake", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		opts := SQLStoreOptions{TTL: time.Hour, Placeholder: dialect.placeholder, Schema: dialect.schema}
+		store, err := NewSQLStore(db, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer store.Close()
+
+		// creating the store again must not trip over the existing table.
+		if _, err := NewSQLStore(db, opts); err != nil {
+			t.Fatalf("migration is not idempotent: %v", err)
+		}
+
+		fakeSessionDBs.Lock()
+		fake := fakeSessionDBs.m[name]
+		fakeSessionDBs.Unlock()
+		sessionStoreTests(t, store, func(id string) {
+			fake.Lock()
+			fake.tables["din_sessions"][hashSessionId(id)].expires = time.Now().Add(-time.Hour).Unix()
+			fake.Unlock()
+		})
+
+		if err := store.sweep(time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		fake.Lock()
+		n := len(fake.tables["din_sessions"])
+		fake.Unlock()
+		if n != 1 {
+			t.Errorf("expected only the live session to survive a sweep, have %d", n)
+		}
+	}
+
+	db, _ := sql.Open("dinfake", t.Name())
+	defer db.Close()
+	if _, err := NewSQLStore(db, SQLStoreOptions{Table: "x; DROP TABLE din_sessions"}); err == nil {
+		t.Errorf("expected a bad table name to be rejected")
+	}
+}
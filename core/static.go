@@ -5,11 +5,14 @@ import (
 	"fmt"
 	"io"
 	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
 	"os"
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -17,6 +20,14 @@ import (
 
 var StaticRoot = ""
 
+// ErrInvalidPath is the error given to requests for static files whose paths
+// contain ".." segments, which could otherwise reach files outside of
+// StaticRoot.
+var ErrInvalidPath = Error{
+	StatusCode: http.StatusBadRequest,
+	Message:    "invalid URL path",
+}
+
 func (r *Router) WhiteList(relpath string) {
 	if r.staticWhitelist == nil {
 		r.staticWhitelist = []string{relpath}
@@ -25,16 +36,28 @@ func (r *Router) WhiteList(relpath string) {
 	}
 }
 
+// TryStatic attempts to satisfy a request with a static file.  Paths
+// registered with Router.Static are tried first; otherwise the request path
+// is looked up underneath StaticRoot.  If no file can be found, a 404
+// din.Error is returned and nothing is written to w; likewise, a failed
+// precondition gives ErrPreconditionFailed.
 func (r *Router) TryStatic(w http.ResponseWriter, req *Request) error {
-	if StaticRoot == "" {
-		return InternalServerError("static root isn't set")
-	}
 	for _, p := range r.staticPaths {
 		if p.MatchString(req.Request.URL.Path) {
+			if StaticRoot == "" {
+				return InternalServerError("static root isn't set")
+			}
 			return ServeFile(w, req.Request, filepath.Join(StaticRoot, p.relpath))
 		}
 	}
-	return ServeFile(w, req.Request, StaticRoot+req.Request.URL.Path)
+	if StaticRoot == "" {
+		return ErrNotFound
+	}
+	if containsDotDot(req.Request.URL.Path) {
+		return ErrInvalidPath
+	}
+	// http.Dir confines the lookup to StaticRoot.
+	return serveFile(w, req.Request, http.Dir(StaticRoot), path.Clean("/"+req.Request.URL.Path), false)
 }
 
 type staticPath struct {
@@ -56,15 +79,37 @@ func (r *Router) Static(pattern string, relpath string) {
 *
 *    - disable directory listing
 *    - expose 404 errors on serving static files
+*    - serve precompressed .gz siblings of files
+*    - serve multiple ranges as multipart/byteranges
+*    - ETags and the full set of conditional requests
 *
 ----------------------------------------------------------------------------- */
 
 // ServeFile replies to the request with the contents of the named file or directory.
+// As with http.ServeFile, requests whose paths contain ".." segments are
+// rejected with ErrInvalidPath, in case name was built from the path.
 func ServeFile(w http.ResponseWriter, r *http.Request, name string) error {
+	if containsDotDot(r.URL.Path) {
+		return ErrInvalidPath
+	}
 	dir, file := filepath.Split(name)
 	return serveFile(w, r, http.Dir(dir), file, false)
 }
 
+func containsDotDot(v string) bool {
+	if !strings.Contains(v, "..") {
+		return false
+	}
+	for _, ent := range strings.FieldsFunc(v, isSlashRune) {
+		if ent == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+func isSlashRune(r rune) bool { return r == '/' || r == '\\' }
+
 // localRedirect gives a Moved Permanently response.
 // It does not convert relative paths to absolute paths like Redirect does.
 func localRedirect(w http.ResponseWriter, r *http.Request, newPath string) {
@@ -75,29 +120,44 @@ func localRedirect(w http.ResponseWriter, r *http.Request, newPath string) {
 	w.WriteHeader(http.StatusMovedPermanently)
 }
 
-// modtime is the modification time of the resource to be served, or IsZero().
-// return value is whether this request is now complete.
-func checkLastModified(w http.ResponseWriter, r *http.Request, modtime time.Time) bool {
+// staticETag makes an ETag for a file from its modification time and size,
+// which is much cheaper than hashing its contents, and changes whenever the
+// file is replaced or edited in any way that would be noticed.
+func staticETag(modtime time.Time, size int64) string {
 	if modtime.IsZero() {
-		return false
+		return ""
 	}
+	return StrongETag(strconv.FormatInt(modtime.UnixNano(), 36) + "-" + strconv.FormatInt(size, 36))
+}
 
-	// The Date-Modified header truncates sub-second precision, so
-	// use mtime < t+1s instead of mtime <= t to check for unmodified.
-	if t, err := time.Parse(http.TimeFormat, r.Header.Get("If-Modified-Since")); err == nil && modtime.Before(t.Add(1*time.Second)) {
-		w.WriteHeader(http.StatusNotModified)
-		return true
+// checkConditions sets the validators of the resource to be served, and
+// answers the request with a 304 if its conditional headers call for it.  A
+// failed precondition gives ErrPreconditionFailed, which is left for the
+// caller to render like any other error.  modtime is the modification time of
+// the resource, or IsZero(); etag may be empty.  The return value is whether
+// this request is now complete.
+func checkConditions(w http.ResponseWriter, r *http.Request, etag string, modtime time.Time) (bool, error) {
+	setValidators(w.Header(), etag, modtime)
+	switch code := checkPreconditions(r, etag, modtime); code {
+	case http.StatusNotModified:
+		h := w.Header()
+		h.Del("Content-Type")
+		h.Del("Content-Length")
+		w.WriteHeader(code)
+		return true, nil
+	case http.StatusPreconditionFailed:
+		return true, ErrPreconditionFailed
 	}
-	w.Header().Set("Last-Modified", modtime.UTC().Format(http.TimeFormat))
-	return false
+	return false, nil
 }
 
 // if name is empty, filename is unknown. (used for mime type, before sniffing)
 // if modtime.IsZero(), modtime is unknown.
 // content must be seeked to the beginning of the file.
-func serveContent(w http.ResponseWriter, r *http.Request, name string, modtime time.Time, size int64, content io.ReadSeeker) {
-	if checkLastModified(w, r, modtime) {
-		return
+func serveContent(w http.ResponseWriter, r *http.Request, name string, modtime time.Time, size int64, content io.ReadSeeker) error {
+	etag := staticETag(modtime, size)
+	if done, err := checkConditions(w, r, etag, modtime); done {
+		return err
 	}
 
 	code := http.StatusOK
@@ -114,50 +174,72 @@ func serveContent(w http.ResponseWriter, r *http.Request, name string, modtime t
 			_, err := content.Seek(0, os.SEEK_SET) // rewind to output whole file
 			if err != nil {
 				http.Error(w, "seeker can't seek", http.StatusInternalServerError)
-				return
+				return nil
 			}
 		}
 		w.Header().Set("Content-Type", ctype)
 	}
 
 	// handle Content-Range header.
-	// TODO(adg): handle multiple ranges
 	sendSize := size
+	var parts []httpRange
+	var mw *multipart.Writer
+	ctype := w.Header().Get("Content-Type")
 	if size >= 0 {
-		ranges, err := parseRange(r.Header.Get("Range"), size)
-		if err == nil && len(ranges) > 1 {
-			err = errors.New("multiple ranges not supported")
+		rangeHeader := r.Header.Get("Range")
+		if !checkIfRange(r, etag, modtime) {
+			rangeHeader = ""
 		}
+		ranges, err := parseRange(rangeHeader, size)
 		if err != nil {
+			if err == errNoOverlap {
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			}
 			http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
-			return
+			return nil
 		}
-		if len(ranges) == 1 {
+		if len(ranges) > maxRanges {
+			// a client asking for this many pieces of a file is better off
+			// with the whole thing.
+			ranges = nil
+		}
+		ranges = coalesceRanges(ranges)
+		switch {
+		case len(ranges) == 1:
 			ra := ranges[0]
 			if _, err := content.Seek(ra.start, os.SEEK_SET); err != nil {
 				http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
-				return
+				return nil
 			}
 			sendSize = ra.length
 			code = http.StatusPartialContent
-			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", ra.start, ra.start+ra.length-1, size))
+			w.Header().Set("Content-Range", ra.contentRange(size))
+		case len(ranges) > 1:
+			parts = ranges
+			mw = multipart.NewWriter(w)
+			sendSize = rangesMIMESize(ranges, mw.Boundary(), ctype, size)
+			code = http.StatusPartialContent
+			w.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
 		}
 
 		w.Header().Set("Accept-Ranges", "bytes")
-		if w.Header().Get("Content-Encoding") == "" {
-			w.Header().Set("Content-Length", strconv.FormatInt(sendSize, 10))
-		}
+		w.Header().Set("Content-Length", strconv.FormatInt(sendSize, 10))
 	}
 
 	w.WriteHeader(code)
 
-	if r.Method != "HEAD" {
-		if sendSize == -1 {
-			io.Copy(w, content)
-		} else {
-			io.CopyN(w, content, sendSize)
-		}
+	if r.Method == "HEAD" {
+		return nil
 	}
+	switch {
+	case mw != nil:
+		writeRanges(mw, content, parts, ctype, size)
+	case sendSize == -1:
+		io.Copy(w, content)
+	default:
+		io.CopyN(w, content, sendSize)
+	}
+	return nil
 }
 
 // name is '/'-separated, not filepath.Separator.
@@ -174,10 +256,7 @@ func serveFile(w http.ResponseWriter, r *http.Request, fs http.FileSystem, name
 
 	f, err := fs.Open(name)
 	if err != nil {
-		return Error{
-			StatusCode: http.StatusNotFound,
-			Message:    "file not found",
-		}
+		return ErrFileNotFound
 	}
 	defer f.Close()
 
@@ -208,9 +287,6 @@ func serveFile(w http.ResponseWriter, r *http.Request, fs http.FileSystem, name
 
 	// use contents of index.html for directory, if present
 	if d.IsDir() {
-		if checkLastModified(w, r, d.ModTime()) {
-			return nil
-		}
 		index := name + indexPage
 		ff, err := fs.Open(index)
 		if err == nil {
@@ -226,14 +302,41 @@ func serveFile(w http.ResponseWriter, r *http.Request, fs http.FileSystem, name
 
 	if d.IsDir() {
 		// dirList(w, f)
-		return Error{
-			StatusCode: http.StatusNotFound,
-			Message:    "file not found",
-		}
+		return ErrFileNotFound
 	}
 
-	serveContent(w, r, d.Name(), d.ModTime(), d.Size(), f)
-	return nil
+	if served, err := servePrecompressed(w, r, fs, name, d.Name()); served {
+		return err
+	}
+	return serveContent(w, r, d.Name(), d.ModTime(), d.Size(), f)
+}
+
+// servePrecompressed serves the gzipped sibling of a file (e.g., app.js.gz for
+// app.js) in its place, if there is one and the client accepts gzip, so that
+// static files can be compressed once, ahead of time, at the highest level.
+// The sibling is served as is, ranges and all, with the content type of the
+// file it stands in for.
+func servePrecompressed(w http.ResponseWriter, r *http.Request, fs http.FileSystem, name, base string) (bool, error) {
+	gz, err := fs.Open(name + ".gz")
+	if err != nil {
+		return false, nil
+	}
+	defer gz.Close()
+	d, err := gz.Stat()
+	if err != nil || d.IsDir() {
+		return false, nil
+	}
+	addVary(w.Header(), "Accept-Encoding")
+	if negotiateEncoding(r.Header.Get("Accept-Encoding"), []string{"gzip"}) != "gzip" {
+		return false, nil
+	}
+	w.Header().Set("Content-Encoding", "gzip")
+	if err := serveContent(w, r, base, d.ModTime(), d.Size(), gz); err != nil {
+		// the error is rendered in place of the file, uncompressed.
+		w.Header().Del("Content-Encoding")
+		return true, err
+	}
+	return true, nil
 }
 
 // httpRange specifies the byte range to be sent to the client.
@@ -241,7 +344,28 @@ type httpRange struct {
 	start, length int64
 }
 
-// parseRange parses a Range header string as per RFC 2616.
+func (r httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+func (r httpRange) mimeHeader(contentType string, size int64) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Range": {r.contentRange(size)},
+		"Content-Type":  {contentType},
+	}
+}
+
+// the most ranges that we'll serve from a single request.  Past that, the
+// whole file is sent instead.
+const maxRanges = 100
+
+// errNoOverlap is returned by parseRange if none of the ranges asked for
+// overlap the file, which is answered with a 416.
+var errNoOverlap = errors.New("invalid range: failed to overlap")
+
+// parseRange parses a Range header string as per RFC 9110, section 14.1.2.
+// Ranges that start past the end of the file are dropped; if that leaves no
+// ranges at all, errNoOverlap is returned.
 func parseRange(s string, size int64) ([]httpRange, error) {
 	if s == "" {
 		return nil, nil // header not present
@@ -251,20 +375,33 @@ func parseRange(s string, size int64) ([]httpRange, error) {
 		return nil, errors.New("invalid range")
 	}
 	var ranges []httpRange
+	noOverlap := false
 	for _, ra := range strings.Split(s[len(b):], ",") {
+		ra = textproto.TrimString(ra)
+		if ra == "" {
+			continue
+		}
 		i := strings.Index(ra, "-")
 		if i < 0 {
 			return nil, errors.New("invalid range")
 		}
-		start, end := ra[:i], ra[i+1:]
+		start, end := textproto.TrimString(ra[:i]), textproto.TrimString(ra[i+1:])
 		var r httpRange
 		if start == "" {
 			// If no start is specified, end specifies the
 			// range start relative to the end of the file.
+			if end == "" || end[0] == '-' {
+				return nil, errors.New("invalid range")
+			}
 			i, err := strconv.ParseInt(end, 10, 64)
 			if err != nil {
 				return nil, errors.New("invalid range")
 			}
+			if i == 0 || size == 0 {
+				// the last zero bytes of the file overlap nothing.
+				noOverlap = true
+				continue
+			}
 			if i > size {
 				i = size
 			}
@@ -272,9 +409,13 @@ func parseRange(s string, size int64) ([]httpRange, error) {
 			r.length = size - r.start
 		} else {
 			i, err := strconv.ParseInt(start, 10, 64)
-			if err != nil || i > size || i < 0 {
+			if err != nil || i < 0 {
 				return nil, errors.New("invalid range")
 			}
+			if i >= size {
+				noOverlap = true
+				continue
+			}
 			r.start = i
 			if end == "" {
 				// If no end is specified, range extends to end of the file.
@@ -292,5 +433,77 @@ func parseRange(s string, size int64) ([]httpRange, error) {
 		}
 		ranges = append(ranges, r)
 	}
+	if noOverlap && len(ranges) == 0 {
+		return nil, errNoOverlap
+	}
 	return ranges, nil
 }
+
+// coalesceRanges merges ranges that overlap or abut one another, as allowed
+// by RFC 9110, section 14.2, so that no part of the file is sent twice.
+// Ranges that are all apart are left in the order they were asked for;
+// otherwise they come out sorted, since the parts of a multipart/byteranges
+// response each say which range they hold.
+func coalesceRanges(ranges []httpRange) []httpRange {
+	if len(ranges) < 2 {
+		return ranges
+	}
+	sorted := append([]httpRange(nil), ranges...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].start < sorted[j].start })
+	out := sorted[:1]
+	for _, r := range sorted[1:] {
+		last := &out[len(out)-1]
+		if end := last.start + last.length; r.start <= end {
+			if r.start+r.length > end {
+				last.length = r.start + r.length - last.start
+			}
+			continue
+		}
+		out = append(out, r)
+	}
+	if len(out) == len(ranges) {
+		return ranges
+	}
+	return out
+}
+
+// rangesMIMESize gives the length of the multipart/byteranges body that
+// writeRanges produces, so that it can be sent as the Content-Length.
+func rangesMIMESize(ranges []httpRange, boundary, contentType string, size int64) int64 {
+	var w countingWriter
+	mw := multipart.NewWriter(&w)
+	mw.SetBoundary(boundary)
+	var encSize int64
+	for _, ra := range ranges {
+		mw.CreatePart(ra.mimeHeader(contentType, size))
+		encSize += ra.length
+	}
+	mw.Close()
+	return encSize + int64(w)
+}
+
+// writeRanges writes each of the ranges of content as a part of a
+// multipart/byteranges body.
+func writeRanges(mw *multipart.Writer, content io.ReadSeeker, ranges []httpRange, contentType string, size int64) error {
+	for _, ra := range ranges {
+		part, err := mw.CreatePart(ra.mimeHeader(contentType, size))
+		if err != nil {
+			return err
+		}
+		if _, err := content.Seek(ra.start, os.SEEK_SET); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(part, content, ra.length); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+// countingWriter counts how many bytes have been written to it.
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (n int, err error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
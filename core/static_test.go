@@ -0,0 +1,155 @@
+package din
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header string
+		size   int64
+		ranges []httpRange
+		err    error
+	}{
+		{"", 10, nil, nil},
+		{"bytes=0-4", 10, []httpRange{{0, 5}}, nil},
+		{"bytes=2-", 10, []httpRange{{2, 8}}, nil},
+		{"bytes=-3", 10, []httpRange{{7, 3}}, nil},
+		{"bytes=-30", 10, []httpRange{{0, 10}}, nil},
+		{"bytes=5-100", 10, []httpRange{{5, 5}}, nil},
+		{"bytes=0-0, -1", 10, []httpRange{{0, 1}, {9, 1}}, nil},
+		{"bytes= 1-2 ,, 4-5 ", 10, []httpRange{{1, 2}, {4, 2}}, nil},
+		{"bytes=0-1,10-20", 10, []httpRange{{0, 2}}, nil},
+		{"bytes=10-20", 10, nil, errNoOverlap},
+		{"bytes=-0", 10, nil, errNoOverlap},
+		{"bytes=0-", 0, nil, errNoOverlap},
+	}
+	for _, test := range tests {
+		ranges, err := parseRange(test.header, test.size)
+		if err != test.err || !reflect.DeepEqual(ranges, test.ranges) {
+			t.Errorf("%q: expected %v %v, got %v %v", test.header, test.ranges, test.err, ranges, err)
+		}
+	}
+
+	for _, header := range []string{"bits=0-1", "bytes=1", "bytes=4-2", "bytes=x-2", "bytes=--2", "bytes=-"} {
+		if _, err := parseRange(header, 10); err == nil || err == errNoOverlap {
+			t.Errorf("%q: expected an invalid range, got %v", header, err)
+		}
+	}
+}
+
+func TestCoalesceRanges(t *testing.T) {
+	tests := []struct {
+		in, out []httpRange
+	}{
+		{[]httpRange{{6, 2}, {0, 2}}, []httpRange{{6, 2}, {0, 2}}},
+		{[]httpRange{{0, 5}, {3, 4}}, []httpRange{{0, 7}}},
+		{[]httpRange{{0, 5}, {5, 2}}, []httpRange{{0, 7}}},
+		{[]httpRange{{8, 2}, {0, 3}, {2, 2}}, []httpRange{{0, 4}, {8, 2}}},
+		{[]httpRange{{0, 10}, {2, 2}}, []httpRange{{0, 10}}},
+	}
+	for _, test := range tests {
+		if got := coalesceRanges(test.in); !reflect.DeepEqual(got, test.out) {
+			t.Errorf("%v: expected %v, got %v", test.in, test.out, got)
+		}
+	}
+}
+
+func TestStaticRanges(t *testing.T) {
+	defer func(root string) { StaticRoot = root }(StaticRoot)
+	StaticRoot = t.TempDir()
+	if err := os.WriteFile(filepath.Join(StaticRoot, "data.txt"), []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	router := NewRouter(nil, nil)
+	etag := conditionalRequest(router, "GET", "/data.txt").Header().Get("ETag")
+
+	type part struct {
+		contentRange, body string
+	}
+	tests := []struct {
+		headers      []string
+		status       int
+		contentRange string
+		body         string
+		parts        []part
+	}{
+		{[]string{"Range", "bytes=-3"}, http.StatusPartialContent, "bytes 7-9/10", "789", nil},
+		{[]string{"Range", "bytes=0-2,3-5"}, http.StatusPartialContent, "bytes 0-5/10", "012345", nil},
+		{[]string{"Range", "bytes=0-4,2-6"}, http.StatusPartialContent, "bytes 0-6/10", "0123456", nil},
+		{[]string{"Range", "bytes=0-1,-2"}, http.StatusPartialContent, "", "", []part{
+			{"bytes 0-1/10", "01"},
+			{"bytes 8-9/10", "89"},
+		}},
+		{[]string{"Range", "bytes=6-7,0-1,1-2"}, http.StatusPartialContent, "", "", []part{
+			{"bytes 0-2/10", "012"},
+			{"bytes 6-7/10", "67"},
+		}},
+		{[]string{"Range", "bytes=1-1,5-5", "If-Range", etag}, http.StatusPartialContent, "", "", []part{
+			{"bytes 1-1/10", "1"},
+			{"bytes 5-5/10", "5"},
+		}},
+		{[]string{"Range", "bytes=1-1,5-5", "If-Range", `"stale"`}, http.StatusOK, "", "0123456789", nil},
+		{[]string{"Range", "bytes=20-30"}, http.StatusRequestedRangeNotSatisfiable, "bytes */10", "", nil},
+		{[]string{"Range", "bytes=" + strings.Repeat("0-0,", maxRanges) + "1-1"}, http.StatusOK, "", "0123456789", nil},
+	}
+	for _, test := range tests {
+		w := conditionalRequest(router, "GET", "/data.txt", test.headers...)
+		if w.Code != test.status {
+			t.Errorf("%v: expected %d, got %d", test.headers, test.status, w.Code)
+			continue
+		}
+		if got := w.Header().Get("Content-Range"); got != test.contentRange {
+			t.Errorf("%v: expected Content-Range %q, got %q", test.headers, test.contentRange, got)
+		}
+		if w.Header().Get("Content-Length") != strconv.Itoa(w.Body.Len()) && w.Code != http.StatusRequestedRangeNotSatisfiable {
+			t.Errorf("%v: Content-Length %s doesn't match the body's length %d", test.headers, w.Header().Get("Content-Length"), w.Body.Len())
+		}
+		if test.parts == nil {
+			if test.body != "" && w.Body.String() != test.body {
+				t.Errorf("%v: expected %q, got %q", test.headers, test.body, w.Body.String())
+			}
+			continue
+		}
+
+		mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+		if err != nil || mediaType != "multipart/byteranges" {
+			t.Errorf("%v: expected a multipart response, got %q", test.headers, w.Header().Get("Content-Type"))
+			continue
+		}
+		mr := multipart.NewReader(w.Body, params["boundary"])
+		var parts []part
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ct := p.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+				t.Errorf("%v: expected each part to have the file's type, got %q", test.headers, ct)
+			}
+			body, _ := io.ReadAll(p)
+			parts = append(parts, part{p.Header.Get("Content-Range"), string(body)})
+		}
+		if !reflect.DeepEqual(parts, test.parts) {
+			t.Errorf("%v: expected parts %v, got %v", test.headers, test.parts, parts)
+		}
+	}
+
+	// HEAD gets the headers of the multipart response, without its body.
+	w := conditionalRequest(router, "HEAD", "/data.txt", "Range", "bytes=0-1,4-5")
+	if w.Code != http.StatusPartialContent || w.Body.Len() != 0 || w.Header().Get("Content-Length") == "" {
+		t.Errorf("expected a bodiless 206, got %d %q", w.Code, w.Body.String())
+	}
+}
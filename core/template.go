@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"github.com/jordanorelli/din/dinutil"
 	"html/template"
 	"io/ioutil"
 	"net/http"
@@ -70,11 +69,8 @@ var templateFuncs = template.FuncMap{
 		}
 		return template.JS(b), nil
 	},
-	"csrf_token": func() (template.JS, error) {
-		return template.JS(dinutil.RandomString(40)), nil
-	},
-	"csrf_key": func() (template.JS, error) {
-		return template.JS(CSRFKey), nil
+	"csrf_key": func() string {
+		return Config.CSRF.fieldName()
 	},
 	"git_shorthash": func() (string, error) {
 		return gitShortHash()
@@ -85,10 +81,28 @@ var templateFuncs = template.FuncMap{
 	"date": shExpose("date"),
 }
 
+// template functions whose behavior depends on the request being responded
+// to.  Each entry builds the function to be handed to the template for a
+// given request.
+var requestTemplateFuncs = make(map[string]func(*Request) interface{}, 5)
+
+// RegisterRequestTemplateFn registers a template function that needs to know
+// about the request being responded to, e.g., to read from the session.  For
+// every TemplateResponse, fn is called with the request, and the function it
+// returns is made available to the template under the given key.  Templates
+// rendered outside of a request get a function that always fails.
+func RegisterRequestTemplateFn(key string, fn func(*Request) interface{}) {
+	requestTemplateFuncs[key] = fn
+	templateFuncs[key] = func() (string, error) {
+		return "", fmt.Errorf("din: template function %s requires a request", key)
+	}
+}
+
 type TemplateResponse struct {
 	*template.Template
 	Context    interface{}
 	StatusCode int
+	request    *Request
 }
 
 func NewTemplateResponse(relpath string, context interface{}, code int) (*TemplateResponse, error) {
@@ -96,12 +110,39 @@ func NewTemplateResponse(relpath string, context interface{}, code int) (*Templa
 	if err != nil {
 		return nil, err
 	}
-	return &TemplateResponse{t, context, code}, nil
+	return &TemplateResponse{Template: t, Context: context, StatusCode: code}, nil
+}
+
+func (t *TemplateResponse) bindRequest(req *Request) {
+	t.request = req
+}
+
+// boundTemplate gives the template to be executed, with the request-specific
+// template functions filled in.  Templates are cached and shared between
+// requests, so we bind a clone rather than the original.  That also keeps the
+// cached template from ever being executed, since an html/template can't be
+// cloned after that; should it happen anyway, the template is used as is.
+func (t *TemplateResponse) boundTemplate() *template.Template {
+	if len(requestTemplateFuncs) == 0 {
+		return t.Template
+	}
+	clone, err := t.Template.Clone()
+	if err != nil {
+		return t.Template
+	}
+	if t.request == nil {
+		return clone
+	}
+	funcs := make(template.FuncMap, len(requestTemplateFuncs))
+	for key, fn := range requestTemplateFuncs {
+		funcs[key] = fn(t.request)
+	}
+	return clone.Funcs(funcs)
 }
 
 func (t *TemplateResponse) Render(w http.ResponseWriter) error {
 	var buf bytes.Buffer
-	if err := t.Template.Execute(&buf, t.Context); err != nil {
+	if err := t.boundTemplate().Execute(&buf, t.Context); err != nil {
 		return err
 	}
 	_, err := w.Write(buf.Bytes())
@@ -192,7 +233,7 @@ func (r *Router) Template(pattern string, relpath string, code int) {
 			req.LogError(err)
 			return nil, InternalServerError("unable to read template")
 		}
-		return &TemplateResponse{t, nil, code}, nil
+		return &TemplateResponse{Template: t, StatusCode: code}, nil
 	})
 }
 
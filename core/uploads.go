@@ -0,0 +1,174 @@
+package din
+
+import (
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"sync/atomic"
+)
+
+// the number of bytes of a multipart form that are held in memory when the
+// config doesn't say otherwise.  The rest is spooled to temporary files.
+const defaultUploadMemory = 32 << 20
+
+// the number of bytes that http.DetectContentType looks at.
+const sniffLen = 512
+
+// An Upload describes a file uploaded as part of a multipart form.  Small
+// uploads are held in memory and larger ones are spooled to temporary files;
+// either way, the contents are available through Open until the response has
+// been rendered, at which point any temporary files are removed.
+type Upload struct {
+	// the file name supplied by the client.  This is not to be trusted as a
+	// path on the local filesystem.
+	Filename string
+
+	// size of the upload, in bytes.
+	Size int64
+
+	// the content type as determined by sniffing the upload's contents.
+	ContentType string
+
+	// the content type that the client claimed the upload to be.
+	DeclaredType string
+
+	// the MIME headers of the upload's part of the multipart form.
+	Header textproto.MIMEHeader
+
+	fh *multipart.FileHeader
+}
+
+// Open opens the upload for reading.
+func (u *Upload) Open() (multipart.File, error) {
+	return u.fh.Open()
+}
+
+// sniff fills in the upload's ContentType from the first few bytes of its
+// contents.
+func (u *Upload) sniff() error {
+	f, err := u.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	buf := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	u.ContentType = http.DetectContentType(buf[:n])
+	return nil
+}
+
+// Files returns the files uploaded in the named field of a multipart form.
+// A field that has no uploads results in an empty slice rather than an
+// error, so that optional upload fields are easy to handle.
+func (r *Request) Files(field string) ([]*Upload, error) {
+	if err := r.parseMultipart(); err != nil {
+		return nil, err
+	}
+	headers := r.MultipartForm.File[field]
+	uploads := make([]*Upload, 0, len(headers))
+	for _, fh := range headers {
+		u := &Upload{
+			Filename:     fh.Filename,
+			Size:         fh.Size,
+			DeclaredType: fh.Header.Get("Content-Type"),
+			Header:       fh.Header,
+			fh:           fh,
+		}
+		if err := u.sniff(); err != nil {
+			return nil, WrapError(err, http.StatusInternalServerError, "unable to read upload")
+		}
+		uploads = append(uploads, u)
+	}
+	return uploads, nil
+}
+
+// parseMultipart parses the request body as a multipart form, if it hasn't
+// been parsed already.
+func (r *Request) parseMultipart() error {
+	if r.MultipartForm != nil {
+		return nil
+	}
+	memory := Config.Core.UploadMemory
+	if memory <= 0 {
+		memory = defaultUploadMemory
+	}
+	if err := r.ParseMultipartForm(memory); err != nil {
+		return bodyError(err, "invalid multipart form")
+	}
+	return nil
+}
+
+// holdTempFiles registers a user of the files that were spooled to disk while
+// parsing a multipart form, returning the function that releases it.  The
+// files are removed once the last of their users has released them, which
+// lets the stages of a request that timed out carry on using them after the
+// response has gone out.
+func (r *Request) holdTempFiles() func() {
+	atomic.AddInt32(&r.tempFileUsers, 1)
+	return func() {
+		if atomic.AddInt32(&r.tempFileUsers, -1) == 0 {
+			r.removeTempFiles()
+		}
+	}
+}
+
+// removeTempFiles removes any files that were spooled to disk while parsing a
+// multipart form.
+func (r *Request) removeTempFiles() {
+	if r.MultipartForm == nil {
+		return
+	}
+	if err := r.MultipartForm.RemoveAll(); err != nil {
+		r.LogError(err)
+	}
+}
+
+// maxBodySize determines the body size limit in effect for the request.  Zero
+// means that there is no limit.
+func (r *Request) maxBodySize() int64 {
+	if r.Pipeline != nil && r.Pipeline.MaxBodySize != 0 {
+		if r.Pipeline.MaxBodySize < 0 {
+			return 0
+		}
+		return r.Pipeline.MaxBodySize
+	}
+	return Config.Core.MaxBodySize
+}
+
+// limitBody enforces the request's body size limit.  Requests that declare an
+// oversized body are turned away immediately.  Otherwise, the body is capped,
+// so that a client that lies about its Content-Length (or doesn't send one at
+// all) gets an ErrBodyTooLarge when the body is read.
+func (r *Request) limitBody(w http.ResponseWriter) error {
+	limit := r.maxBodySize()
+	if limit <= 0 || r.Body == nil {
+		return nil
+	}
+	if r.ContentLength > limit {
+		return ErrBodyTooLarge
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	return nil
+}
+
+// bodyError translates an error encountered while reading the request body
+// into a din.Error.  Bodies that turned out to be too big get a 413; anything
+// else is the client's fault for sending us garbage.
+func bodyError(err error, msg string) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		e := ErrBodyTooLarge
+		e.Cause = err
+		return e
+	}
+	return Error{
+		StatusCode: http.StatusBadRequest,
+		Message:    msg,
+		Cause:      err,
+	}
+}
@@ -0,0 +1,178 @@
+package din
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the first bytes of a png file; enough to fool http.DetectContentType.
+var pngHeader = []byte("\x89PNG\x0D\x0A\x1A\x0A\x00\x00\x00\x0DIHDR")
+
+func uploadRequest(t *testing.T, size int) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("caption", "a cat")
+	fw, err := mw.CreateFormFile("photo", "cat.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(pngHeader)
+	fw.Write(bytes.Repeat([]byte{0}, size))
+	mw.Close()
+
+	raw, _ := http.NewRequest("POST", "/upload", &body)
+	raw.Header.Set("Content-Type", mw.FormDataContentType())
+	return raw
+}
+
+func TestUploads(t *testing.T) {
+	defer func(memory int64) { Config.Core.UploadMemory = memory }(Config.Core.UploadMemory)
+	Config.Core.UploadMemory = 1024
+
+	var spooled string
+	router := NewRouter(nil, nil)
+	router.AddRoute("^/upload$", "upload", func(req *Request) (Response, error) {
+		uploads, err := req.Files("photo")
+		if err != nil {
+			return nil, err
+		}
+		if len(uploads) != 1 {
+			t.Errorf("expected 1 upload, got %d", len(uploads))
+			return nil, ErrNotFound
+		}
+		u := uploads[0]
+		if u.Filename != "cat.txt" || u.ContentType != "image/png" || u.DeclaredType != "application/octet-stream" {
+			t.Errorf("bad upload descriptor: %+v", u)
+		}
+		if u.Size != int64(len(pngHeader)+4096) {
+			t.Errorf("expected upload of %d bytes, got %d", len(pngHeader)+4096, u.Size)
+		}
+		f, err := u.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if file, ok := f.(*os.File); ok {
+			spooled = file.Name()
+		}
+		if req.PostForm.Get("caption") != "a cat" {
+			t.Errorf("lost the non-file form field")
+		}
+		if none, err := req.Files("nothing"); err != nil || len(none) != 0 {
+			t.Errorf("expected no uploads for an empty field, got %v %v", none, err)
+		}
+		return EmptyResponse(http.StatusNoContent), nil
+	})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, uploadRequest(t, 4096))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected status 204, got %d: %s", w.Code, w.Body.String())
+	}
+	if spooled == "" {
+		t.Fatalf("expected upload larger than %d bytes to be spooled to disk", Config.Core.UploadMemory)
+	}
+	if _, err := os.Stat(spooled); !os.IsNotExist(err) {
+		t.Errorf("temp file %s was not removed after rendering", spooled)
+	}
+}
+
+func TestMaxBodySize(t *testing.T) {
+	router := NewRouter(nil, nil)
+	p := router.AddRoute("^/upload$", "upload", func(req *Request) (Response, error) {
+		if _, err := req.Files("photo"); err != nil {
+			return nil, err
+		}
+		return EmptyResponse(http.StatusNoContent), nil
+	})
+	p.MaxBodySize = 1024
+
+	// declared up front
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, uploadRequest(t, 4096))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status 413 for declared length, got %d", w.Code)
+	}
+
+	// discovered while reading
+	raw := uploadRequest(t, 4096)
+	raw.ContentLength = -1
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, raw)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected status 413 for unknown length, got %d", w.Code)
+	}
+
+	// a body that's turned away up front still gets the headers collected
+	// for the request, such as those for CORS.
+	defer func(opts CORSOptions) { Config.CORS = opts }(Config.CORS)
+	Config.CORS = CORSOptions{AllowedOrigins: []string{"*"}}
+	raw = uploadRequest(t, 4096)
+	raw.Header.Set("Origin", "https://anywhere.test")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, raw)
+	if w.Code != http.StatusRequestEntityTooLarge || w.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("expected a 413 with CORS headers, got %d %v", w.Code, w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, uploadRequest(t, 16))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expected small upload to be accepted, got %d: %s", w.Code, strings.TrimSpace(w.Body.String()))
+	}
+}
+
+func TestUploadsOutliveTimeout(t *testing.T) {
+	defer func(memory int64, timeout time.Duration) {
+		Config.Core.UploadMemory, stageTimeout = memory, timeout
+	}(Config.Core.UploadMemory, stageTimeout)
+	Config.Core.UploadMemory = 1024
+	stageTimeout = 20 * time.Millisecond
+
+	spooled, release, stat := make(chan string, 1), make(chan struct{}), make(chan error, 1)
+	router := NewRouter(nil, nil)
+	router.AddRoute("^/upload$", "upload", func(req *Request) (Response, error) {
+		uploads, err := req.Files("photo")
+		if err != nil {
+			return nil, err
+		}
+		f, err := uploads[0].Open()
+		if err != nil {
+			return nil, err
+		}
+		name := f.(*os.File).Name()
+		f.Close()
+		spooled <- name
+		<-release
+		_, err = os.Stat(name)
+		stat <- err
+		return EmptyResponse(http.StatusNoContent), nil
+	})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, uploadRequest(t, 4096))
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected status 504, got %d", w.Code)
+	}
+	name := <-spooled
+	close(release)
+	if err := <-stat; err != nil {
+		t.Errorf("temp file was removed while the stages were still using it: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("temp file %s was not removed once the stages were done with it", name)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
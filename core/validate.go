@@ -0,0 +1,351 @@
+package din
+
+import (
+	"fmt"
+	"net/http"
+	"net/mail"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// A Validator checks a single field of a bound struct.  It is given the
+// field's value (with any pointers already followed) and the parameter that
+// followed the validator's name in the struct tag, e.g., "10" for
+// `validate:"max=10"`.  The message of a returned error is shown to the user
+// as the reason the field was rejected, so it should read as the end of a
+// sentence that begins with the field name: "must be a valid slug".
+type Validator func(value interface{}, param string) error
+
+var validatorRegistry = make(map[string]Validator, 10)
+
+// RegisterValidator makes a Validator available to the validate struct tag
+// under the given name.  Registering a name a second time replaces the
+// existing validator, including the built-in ones.
+func RegisterValidator(name string, fn Validator) {
+	validatorRegistry[name] = fn
+}
+
+func getValidator(name string) (Validator, bool) {
+	fn, ok := validatorRegistry[name]
+	return fn, ok
+}
+
+// a validation rule parsed out of a validate tag.
+type validationRule struct {
+	name  string
+	param string
+}
+
+// parseRules parses a validate tag.  Rules are separated by commas.  Since
+// regular expressions are likely to contain commas themselves, a regexp rule
+// takes the remainder of the tag, and so must come last.
+func parseRules(tag string) []validationRule {
+	var rules []validationRule
+	for tag != "" {
+		var rule string
+		if strings.HasPrefix(tag, "regexp=") {
+			rule, tag = tag, ""
+		} else if i := strings.Index(tag, ","); i >= 0 {
+			rule, tag = tag[:i], tag[i+1:]
+		} else {
+			rule, tag = tag, ""
+		}
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		r := validationRule{name: rule}
+		if i := strings.Index(rule, "="); i >= 0 {
+			r.name, r.param = rule[:i], rule[i+1:]
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// Validate checks each field of the struct pointed to by v against the rules
+// in its validate tag, e.g.:
+//
+//   Page  int    `query:"page" validate:"min=1,max=100"`
+//   Email string `form:"email" validate:"required,email"`
+//
+// The built-in rules are required, min, max, len, regexp, oneof and email;
+// more may be added with RegisterValidator.  Rules apply to zero values like
+// any other, so that min=1 rejects an explicit 0, with two exceptions: a nil
+// pointer is taken to be absent, and is only checked by required, and the
+// omitempty option skips every rule but required for a field holding its zero
+// value.  When called by Request.Bind, a field whose parameter wasn't in the
+// request at all also counts as absent.  Nested structs are validated
+// recursively.  If any field fails, the returned error is a 422 din.Error
+// listing each failing field along with why it failed.  Request.Bind calls
+// Validate on its destination after binding it, so most handlers won't need
+// to call this directly.
+func Validate(v interface{}) error {
+	return validate(v, nil)
+}
+
+// validate is Validate for a struct that was bound from req, which tells us
+// which fields were absent from the request.  req may be nil.
+func validate(v interface{}, req *Request) error {
+	rv := reflect.ValueOf(v)
+	visited := make(map[uintptr]bool)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return &InvalidUnmarshalError{reflect.TypeOf(v)}
+		}
+		visited[rv.Pointer()] = true
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return &InvalidUnmarshalError{reflect.TypeOf(v)}
+	}
+
+	var invalid []InvalidParam
+	if err := validateStruct(rv, &invalid, req, visited); err != nil {
+		return err
+	}
+	if len(invalid) > 0 {
+		e := ValidationError(invalid...)
+		e.StatusCode = http.StatusUnprocessableEntity
+		return e
+	}
+	return nil
+}
+
+// validateStruct checks each field of the struct v, appending a description
+// of every failure to invalid.  visited holds the pointers that have been
+// followed so far, so that a value that refers back to itself (e.g., a Next
+// field pointing at its own struct) is checked only once.
+func validateStruct(v reflect.Value, invalid *[]InvalidParam, req *Request, visited map[uintptr]bool) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" && !field.Anonymous {
+			continue
+		}
+		fv := v.Field(i)
+
+		if tag := field.Tag.Get("validate"); tag != "" && tag != "-" {
+			absent := false
+			if source, name := bindTag(field); req != nil && source != "" {
+				absent = len(req.bindValues(source, name)) == 0
+			}
+			reason, err := validateField(fv, parseRules(tag), absent)
+			if err != nil {
+				return fmt.Errorf("din: field %s of %v: %v", field.Name, t, err)
+			}
+			if reason != "" {
+				*invalid = append(*invalid, InvalidParam{Name: paramName(field), Reason: reason})
+				continue
+			}
+		}
+
+		if bindsRecursively(field.Type) {
+			if fv.Kind() == reflect.Ptr {
+				if fv.IsNil() || visited[fv.Pointer()] {
+					continue
+				}
+				visited[fv.Pointer()] = true
+				fv = fv.Elem()
+			}
+			if err := validateStruct(fv, invalid, req, visited); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validateField applies rules to a single field, returning the reason for the
+// first rule that fails.  absent is set for fields whose parameter was missing
+// from the request.  A non-nil error means that the rules themselves are
+// broken, e.g., they name a validator that doesn't exist.
+func validateField(v reflect.Value, rules []validationRule, absent bool) (string, error) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			break
+		}
+		v = v.Elem()
+	}
+	zero := !v.IsValid() || isZero(v)
+	// a nil pointer is absent however the struct was filled in, but a value
+	// that came from somewhere else, such as a json body, isn't absent just
+	// because its parameter wasn't in the request.
+	isNil := !v.IsValid() || ((v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil())
+	absent = isNil || (absent && zero)
+	for _, rule := range rules {
+		if rule.name == "omitempty" {
+			absent = absent || zero
+		}
+	}
+	for _, rule := range rules {
+		if rule.name == "required" {
+			if zero {
+				return "is required", nil
+			}
+			continue
+		}
+		if rule.name == "omitempty" || absent {
+			continue
+		}
+		fn, ok := getValidator(rule.name)
+		if !ok {
+			return "", fmt.Errorf("unknown validator %q", rule.name)
+		}
+		if err := fn(v.Interface(), rule.param); err != nil {
+			if _, broken := err.(ruleError); broken {
+				return "", err
+			}
+			return err.Error(), nil
+		}
+	}
+	return "", nil
+}
+
+// a ruleError is returned by a validator when the rule it was given doesn't
+// make sense, as opposed to when the value it was given is invalid.
+type ruleError string
+
+func (e ruleError) Error() string { return string(e) }
+
+// isZero tells us whether a field was left empty.  Empty collections count as
+// empty, even if they aren't nil.
+func isZero(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	}
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
+
+// paramName gives the name by which a field is known to the client: the name
+// in its binding tag or json tag if it has one, or its Go name otherwise.
+func paramName(field reflect.StructField) string {
+	for _, s := range bindSources {
+		if tag := field.Tag.Get(s); tag != "" {
+			return tag
+		}
+	}
+	if tag := field.Tag.Get("json"); tag != "" {
+		if name := strings.Split(tag, ",")[0]; name != "" && name != "-" {
+			return name
+		}
+	}
+	return field.Name
+}
+
+// measure gives the quantity that min, max and len constrain for a value: the
+// number itself for numbers, the number of characters for strings, and the
+// number of items for collections.  The unit is used in messages.
+func measure(value interface{}) (n float64, unit string, ok bool) {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), "", true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(v.Uint()), "", true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), "", true
+	case reflect.String:
+		return float64(utf8.RuneCountInString(v.String())), " characters long", true
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return float64(v.Len()), " items", true
+	}
+	return 0, "", false
+}
+
+// boundValidator builds the min, max and len validators, which differ only in
+// how they compare a value with their parameter.
+func boundValidator(name, phrase string, ok func(n, bound float64) bool) Validator {
+	return func(value interface{}, param string) error {
+		bound, err := strconv.ParseFloat(param, 64)
+		if err != nil {
+			return ruleError(fmt.Sprintf("%s requires a numeric parameter, got %q", name, param))
+		}
+		n, unit, measurable := measure(value)
+		if !measurable {
+			return ruleError(fmt.Sprintf("%s can't be applied to %T", name, value))
+		}
+		if !ok(n, bound) {
+			if unit == " items" {
+				return fmt.Errorf("must have %s %s%s", phrase, param, unit)
+			}
+			return fmt.Errorf("must be %s %s%s", phrase, param, unit)
+		}
+		return nil
+	}
+}
+
+// compiled regexps from validate tags.  Tags don't change at runtime, so
+// there's no need to ever evict anything from here.
+var validationRegexps = struct {
+	sync.Mutex
+	m map[string]*regexp.Regexp
+}{m: make(map[string]*regexp.Regexp)}
+
+func validationRegexp(pattern string) (*regexp.Regexp, error) {
+	validationRegexps.Lock()
+	defer validationRegexps.Unlock()
+	if re, ok := validationRegexps.m[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	validationRegexps.m[pattern] = re
+	return re, nil
+}
+
+func validateRegexp(value interface{}, param string) error {
+	s, ok := value.(string)
+	if !ok {
+		return ruleError(fmt.Sprintf("regexp can't be applied to %T", value))
+	}
+	re, err := validationRegexp(param)
+	if err != nil {
+		return ruleError(fmt.Sprintf("bad regexp %q: %v", param, err))
+	}
+	if !re.MatchString(s) {
+		return fmt.Errorf("must match the pattern %s", param)
+	}
+	return nil
+}
+
+func validateOneOf(value interface{}, param string) error {
+	options := strings.Fields(param)
+	s := fmt.Sprint(value)
+	for _, option := range options {
+		if s == option {
+			return nil
+		}
+	}
+	return fmt.Errorf("must be one of %s", strings.Join(options, ", "))
+}
+
+func validateEmail(value interface{}, param string) error {
+	s, ok := value.(string)
+	if !ok {
+		return ruleError(fmt.Sprintf("email can't be applied to %T", value))
+	}
+	addr, err := mail.ParseAddress(s)
+	if err != nil || addr.Name != "" || addr.Address != s {
+		return fmt.Errorf("must be an email address")
+	}
+	return nil
+}
+
+func init() {
+	RegisterValidator("min", boundValidator("min", "at least", func(n, bound float64) bool { return n >= bound }))
+	RegisterValidator("max", boundValidator("max", "at most", func(n, bound float64) bool { return n <= bound }))
+	RegisterValidator("len", boundValidator("len", "exactly", func(n, bound float64) bool { return n == bound }))
+	RegisterValidator("regexp", validateRegexp)
+	RegisterValidator("oneof", validateOneOf)
+	RegisterValidator("email", validateEmail)
+}
@@ -0,0 +1,37 @@
+package din
+
+import (
+	"net/http"
+)
+
+// hookedWriter wraps an http.ResponseWriter, calling a hook just before the
+// response headers are written.  The router uses this to get headers and
+// cookies that were set on the request onto the response, even when they're
+// set while the response is being rendered (e.g., a csrf token that is first
+// issued by a template).
+type hookedWriter struct {
+	http.ResponseWriter
+	beforeWrite func()
+	wroteHeader bool
+}
+
+func (w *hookedWriter) WriteHeader(code int) {
+	w.finish()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// finish runs the hook if the response was completed without writing
+// anything.
+func (w *hookedWriter) finish() {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.beforeWrite()
+	}
+}
+
+func (w *hookedWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
@@ -0,0 +1,104 @@
+package dinutil
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// PasswordIterations is the number of PBKDF2 iterations used by HashPassword.
+// It follows the OWASP recommendation for PBKDF2-HMAC-SHA256 at the time of
+// writing.  Raising it doesn't invalidate existing hashes, since each hash
+// records its own iteration count; see NeedsRehash.
+var PasswordIterations = 600000
+
+// hashes that ask for more than this many times PasswordIterations are
+// rejected as malformed, rather than letting a bad hash tie up CheckPassword
+// for minutes on end.
+const maxIterationsFactor = 10
+
+const (
+	passwordScheme  = "pbkdf2-sha256"
+	passwordSaltLen = 16
+	passwordKeyLen  = 32
+)
+
+var ErrInvalidHash = errors.New("invalid password hash")
+
+// HashPassword hashes a password for storage, with PBKDF2-HMAC-SHA256 and a
+// random salt.  The hash is encoded in the modular crypt format used by
+// bcrypt and argon2, e.g.:
+//
+//	$pbkdf2-sha256$i=600000$<salt>$<key>
+//
+// with the salt and key in unpadded base64, so that it can be stored as a
+// string and checked with CheckPassword.
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, passwordSaltLen)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, PasswordIterations, passwordKeyLen)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$%s$i=%d$%s$%s", passwordScheme, PasswordIterations,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// CheckPassword tells us whether password matches a hash produced by
+// HashPassword.  The comparison takes the same amount of time however much
+// of the hash matches.  A malformed hash gives ErrInvalidHash, as does one
+// that asks for far more iterations than HashPassword uses.
+func CheckPassword(hash, password string) (bool, error) {
+	iterations, salt, key, err := parsePasswordHash(hash)
+	if err != nil {
+		return false, err
+	}
+	computed, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(key))
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare(computed, key) == 1, nil
+}
+
+// NeedsRehash tells us whether a hash was made with fewer iterations than
+// HashPassword currently uses.  The usual thing to do is to check for this
+// after a successful login, and to store a new hash of the password, which
+// is known at that point.
+func NeedsRehash(hash string) bool {
+	iterations, _, _, err := parsePasswordHash(hash)
+	return err != nil || iterations < PasswordIterations
+}
+
+func parsePasswordHash(hash string) (int, []byte, []byte, error) {
+	// "", scheme, params, salt, key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 5 || parts[0] != "" || parts[1] != passwordScheme {
+		return 0, nil, nil, ErrInvalidHash
+	}
+	if !strings.HasPrefix(parts[2], "i=") {
+		return 0, nil, nil, ErrInvalidHash
+	}
+	iterations, err := strconv.Atoi(strings.TrimPrefix(parts[2], "i="))
+	if err != nil || iterations < 1 || iterations > maxIterationsFactor*PasswordIterations {
+		return 0, nil, nil, ErrInvalidHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return 0, nil, nil, ErrInvalidHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil || len(key) == 0 {
+		return 0, nil, nil, ErrInvalidHash
+	}
+	return iterations, salt, key, nil
+}
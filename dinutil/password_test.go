@@ -0,0 +1,89 @@
+package dinutil
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestPasswordHashVectors(t *testing.T) {
+	// the widely published PBKDF2-HMAC-SHA256 vectors for "password" and "salt".
+	tests := []struct {
+		iterations int
+		key        string
+	}{
+		{1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+	}
+	for _, test := range tests {
+		key, _ := hex.DecodeString(test.key)
+		hash := fmt.Sprintf("$pbkdf2-sha256$i=%d$%s$%s", test.iterations,
+			base64.RawStdEncoding.EncodeToString([]byte("salt")),
+			base64.RawStdEncoding.EncodeToString(key))
+		if ok, err := CheckPassword(hash, "password"); !ok || err != nil {
+			t.Errorf("%d iterations: expected a match, got %v %v", test.iterations, ok, err)
+		}
+	}
+}
+
+func TestPasswordHash(t *testing.T) {
+	defer func(n int) { PasswordIterations = n }(PasswordIterations)
+	PasswordIterations = 1000
+
+	hash, err := HashPassword("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$pbkdf2-sha256$i=1000$") {
+		t.Errorf("unexpected hash format: %s", hash)
+	}
+	if ok, err := CheckPassword(hash, "correct horse"); !ok || err != nil {
+		t.Errorf("expected the password to match its hash, got %v %v", ok, err)
+	}
+	for _, wrong := range []string{"", "correct horse ", "Correct horse", "battery staple"} {
+		if ok, err := CheckPassword(hash, wrong); ok || err != nil {
+			t.Errorf("%q: expected a wrong password not to match, got %v %v", wrong, ok, err)
+		}
+	}
+
+	again, _ := HashPassword("correct horse")
+	if again == hash {
+		t.Errorf("expected each hash to have a salt of its own")
+	}
+
+	if NeedsRehash(hash) {
+		t.Errorf("a current hash shouldn't need rehashing")
+	}
+	PasswordIterations = 2000
+	if !NeedsRehash(hash) {
+		t.Errorf("expected a hash with fewer iterations to need rehashing")
+	}
+	if ok, _ := CheckPassword(hash, "correct horse"); !ok {
+		t.Errorf("raising the iteration count broke an existing hash")
+	}
+}
+
+func TestInvalidPasswordHash(t *testing.T) {
+	for _, hash := range []string{
+		"",
+		"plaintext",
+		"$2a$10$abcdefghijklmnopqrstuv",
+		"$pbkdf2-sha256$600000$c2FsdA$a2V5",
+		"$pbkdf2-sha256$i=0$c2FsdA$a2V5",
+		"$pbkdf2-sha256$i=x$c2FsdA$a2V5",
+		"$pbkdf2-sha256$i=1$!!$a2V5",
+		"$pbkdf2-sha256$i=1$c2FsdA$",
+		"$pbkdf2-sha256$i=1$c2FsdA$a2V5$",
+		"$pbkdf2-sha256$i=2000000000$c2FsdA$a2V5",
+	} {
+		if ok, err := CheckPassword(hash, "password"); ok || err != ErrInvalidHash {
+			t.Errorf("%q: expected ErrInvalidHash, got %v %v", hash, ok, err)
+		}
+		if !NeedsRehash(hash) {
+			t.Errorf("%q: expected a malformed hash to need rehashing", hash)
+		}
+	}
+}
@@ -50,3 +50,15 @@ func CryptoRandURL(n int) string {
 	io.ReadFull(crand.Reader, b)
 	return base64.URLEncoding.EncodeToString(b)
 }
+
+// generates a URL-safe, unpadded base64 string encoding n bytes of
+// cryptographically random data.  Unlike CryptoRandURL, a failure to read
+// from the system's random source is reported, which makes this suitable for
+// secrets such as session ids and csrf tokens.
+func SecureToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(crand.Reader, b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}